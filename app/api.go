@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiPath is the path below the prefix which is reserved for the endpoints of dave.
+const apiPath = "/.dave/"
+
+// eventKeepAlive is the interval of comments sent to keep idle event streams open.
+const eventKeepAlive = 30 * time.Second
+
+// serve dispatches an authenticated request either to one of the endpoints of dave or
+// to the webdav handler.
+func serve(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	throttleAuthenticated(ctx)
+	release, ok := a.Limiter.limitUser(ctx, w, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if crossTransfer(a.Config, req) {
+		serveTransfer(ctx, w, req, a)
+		return
+	}
+	if endpoint, ok := apiEndpoint(a.Config, req.URL.Path); ok {
+		if isAnonymous(ctx) && !strings.HasPrefix(endpoint, "ui/") {
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+
+		switch {
+		case endpoint == "events":
+			serveEvents(ctx, w, req, a)
+		case endpoint == "shares" || strings.HasPrefix(endpoint, "shares/"):
+			serveShareAPI(ctx, w, req, a, strings.TrimPrefix(strings.TrimPrefix(endpoint, "shares"), "/"))
+		case endpoint == "search":
+			serveSearchAPI(ctx, w, req, a)
+		case strings.HasPrefix(endpoint, "uploads/"):
+			serveChunkedUpload(ctx, w, req, a, strings.TrimPrefix(endpoint, "uploads/"))
+		case strings.HasPrefix(endpoint, "ui/"):
+			serveUIAsset(w, req, strings.TrimPrefix(endpoint, "ui/"))
+		default:
+			http.NotFound(w, req)
+		}
+		return
+	}
+
+	switch req.Method {
+	case "SEARCH":
+		serveSearch(ctx, w, req, a)
+		return
+	case http.MethodOptions:
+		if a.Index != nil {
+			w.Header().Set("DASL", "<DAV:basicsearch>")
+		}
+	}
+
+	if servePreview(ctx, w, req, a) || serveArchive(ctx, w, req, a) || serveUI(ctx, w, req, a) || serveListing(ctx, w, req, a) {
+		return
+	}
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		setChecksumHeaders(ctx, w, req, a)
+	}
+	if rejectHidden(ctx, w, req, a) {
+		return
+	}
+	if req.Method == http.MethodPut && extractRequested(req) {
+		if name, ok := a.webdavPath(req.URL.Path); ok {
+			serveExtract(ctx, w, req, a, name)
+			return
+		}
+	}
+	if req.Method == http.MethodPut && req.Header.Get("Content-Range") != "" {
+		if name, ok := a.webdavPath(req.URL.Path); ok {
+			servePartialPut(ctx, w, req, a, name)
+			return
+		}
+	}
+
+	a.Handler.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// webdavPath strips the prefix from the path of an url like the webdav handler does.
+func (a *App) webdavPath(urlPath string) (string, bool) {
+	if a.Config.Prefix == "" {
+		return urlPath, true
+	}
+	if r := strings.TrimPrefix(urlPath, a.Config.Prefix); len(r) < len(urlPath) {
+		return r, true
+	}
+
+	return "", false
+}
+
+// apiEndpoint returns the name of the requested endpoint of dave, if the path points
+// into the reserved api path.
+func apiEndpoint(config *Config, urlPath string) (string, bool) {
+	p := strings.TrimPrefix(urlPath, config.Prefix)
+	if len(p) == len(urlPath) && config.Prefix != "" {
+		return "", false
+	}
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	if !strings.HasPrefix(p, apiPath) {
+		return "", false
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(p, apiPath), "/"), true
+}
+
+// serveEvents streams the file events of the users tree as server-sent events.
+func serveEvents(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || a.Events == nil {
+		http.Error(w, "event stream not supported", http.StatusNotImplemented)
+		return
+	}
+
+	username := ""
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		username = authInfo.Username
+	}
+
+	events := make(chan Event, 64)
+	unsubscribe := a.Events.Subscribe(func(e Event) {
+		select {
+		case events <- e:
+		default:
+			log.WithField("user", username).Warn("Dropped event of slow event stream client")
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case e := <-events:
+			e, visible := e.ForUser(a.Config, username)
+			if !visible {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
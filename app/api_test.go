@@ -0,0 +1,79 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiEndpoint(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+		wantOk bool
+	}{
+		{"", "/.dave/events", "events", true},
+		{"", "/a/.dave/events", "", false},
+		{"/webdav", "/webdav/.dave/events", "events", true},
+		{"/webdav", "/.dave/events", "", false},
+		{"/", "/.dave/events/", "events", true},
+		{"", "/.davex", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := apiEndpoint(&Config{Prefix: tt.prefix}, tt.path)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("apiEndpoint() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestServeEvents(t *testing.T) {
+	a := &App{Config: createTestConfig("/tmp"), Events: NewEventBus()}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveEvents(ctx, w, r, a)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("error requesting event stream. error = %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %v, want text/event-stream", got)
+	}
+
+	go func() {
+		// the subscription is registered after the headers have been sent
+		time.Sleep(100 * time.Millisecond)
+		a.Events.Publish(Event{Type: EventCreate, Path: "/subdir2/hidden"})
+		a.Events.Publish(Event{Type: EventCreate, Path: "/subdir1/visible"})
+	}()
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("error reading event stream. error = %v", err)
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	if lines[0] != "event: create" {
+		t.Errorf("got %v, want event: create", lines[0])
+	}
+	if !strings.Contains(lines[1], `"path":"/visible"`) {
+		t.Errorf("got %v, want data of /visible", lines[1])
+	}
+}
@@ -3,8 +3,13 @@ package app
 
 import "golang.org/x/net/webdav"
 
-// App holds configuration information and the webdav handler.
+// App holds configuration information, the webdav handler, the event bus, the store of
+// share links, the search index and the limiter of requests.
 type App struct {
 	Config  *Config
 	Handler *webdav.Handler
+	Events  *EventBus
+	Shares  *ShareStore
+	Index   *Index
+	Limiter *Limiter
 }
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// Archive formats of folder downloads.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// archiveWriter adds the files of a folder download to an archive.
+type archiveWriter interface {
+	add(name string, fi os.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// serveArchive answers GET and HEAD requests of directories with an archive parameter,
+// like ?archive=zip or ?archive=tar.gz, with an archive of the directory. The archive is
+// streamed while the tree is walked and contains what the user is allowed to read. It
+// returns false if the request doesn't ask for an archive.
+func serveArchive(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	format := req.URL.Query().Get("archive")
+	if format == "" {
+		return false
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+	if format != ArchiveZip && format != ArchiveTarGz {
+		http.Error(w, "unsupported archive format "+format, http.StatusBadRequest)
+		return true
+	}
+
+	fs := a.Handler.FileSystem
+	f, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		writeFileError(w, err)
+		return true
+	}
+	fi, err := f.Stat()
+	f.Close()
+	if err != nil {
+		writeFileError(w, err)
+		return true
+	}
+	if !fi.IsDir() {
+		http.Error(w, "only directories can be downloaded as archive", http.StatusBadRequest)
+		return true
+	}
+
+	base := path.Base(path.Clean("/" + name))
+	if base == "/" {
+		base = "dave"
+	}
+	contentType := "application/zip"
+	if format == ArchiveTarGz {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": base + "." + format}))
+	if req.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return true
+	}
+
+	var aw archiveWriter
+	if format == ArchiveZip {
+		aw = &zipArchive{zip.NewWriter(w)}
+	} else {
+		aw = newTarArchive(w)
+	}
+	err = walkArchive(ctx, fs, name, base, aw)
+	if cerr := aw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// the status has been sent already, the client notices the truncated archive
+		log.WithField("path", name).WithError(err).Error("Error writing archive")
+	}
+
+	return true
+}
+
+// walkArchive adds a directory and everything below it, which can be read, to an archive.
+// Files which can't be opened, like the content of drop boxes, are skipped.
+func walkArchive(ctx context.Context, fs webdav.FileSystem, name, archived string, aw archiveWriter) error {
+	dir, err := fs.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	fi, err := dir.Stat()
+	if err != nil {
+		dir.Close()
+		return nil
+	}
+	infos, err := dir.Readdir(0)
+	dir.Close()
+	if err != nil {
+		return nil
+	}
+	if err := aw.add(archived+"/", fi, nil); err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if isInternal(info.Name()) {
+			continue
+		}
+		childName := path.Join(name, info.Name())
+		childArchived := archived + "/" + info.Name()
+		switch {
+		case info.IsDir():
+			if err := walkArchive(ctx, fs, childName, childArchived, aw); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			f, err := fs.OpenFile(ctx, childName, os.O_RDONLY, 0)
+			if err != nil {
+				continue
+			}
+			err = aw.add(childArchived, info, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (z *zipArchive) add(name string, fi os.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if strings.HasSuffix(name, "/") {
+		header.Method = zip.Store
+	} else {
+		header.Method = zip.Deflate
+	}
+	fw, err := z.CreateHeader(header)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+
+	return err
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func newTarArchive(w io.Writer) *tarArchive {
+	gz := gzip.NewWriter(w)
+	return &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+}
+
+func (t *tarArchive) add(name string, fi os.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// owners of the server aren't meaningful to the user
+	header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+	if err := t.tw.WriteHeader(header); err != nil || r == nil {
+		return err
+	}
+	// files growing while they are read are truncated to the size in the header
+	_, err = io.CopyN(t.tw, r, header.Size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+func (t *tarArchive) Close() error {
+	err := t.tw.Close()
+	if gerr := t.gz.Close(); err == nil {
+		err = gerr
+	}
+
+	return err
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeArchive(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs", "specs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs", "inbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "readme.md"), []byte("readme"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "specs", "api.md"), []byte("api"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "specs", tempPrefix+"api.md-01"), []byte("temp"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "inbox", "secret.md"), []byte("secret"), 0600)
+
+	config := createTestConfig(tmpDir)
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/docs/inbox"}}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	want := "docs/,docs/inbox/,docs/readme.md=readme,docs/specs/,docs/specs/api.md=api"
+
+	readZip := func(b []byte) string {
+		r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("invalid zip: %v", err)
+		}
+		var entries []string
+		for _, f := range r.File {
+			entry := f.Name
+			if !strings.HasSuffix(f.Name, "/") {
+				rc, _ := f.Open()
+				content, _ := ioutil.ReadAll(rc)
+				rc.Close()
+				entry += "=" + string(content)
+			}
+			entries = append(entries, entry)
+		}
+		sort.Strings(entries)
+		return strings.Join(entries, ",")
+	}
+	readTarGz := func(b []byte) string {
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("invalid gzip: %v", err)
+		}
+		tr := tar.NewReader(gz)
+		var entries []string
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("invalid tar: %v", err)
+			}
+			entry := h.Name
+			if h.Typeflag == tar.TypeReg {
+				content, _ := ioutil.ReadAll(tr)
+				entry += "=" + string(content)
+			}
+			entries = append(entries, entry)
+		}
+		sort.Strings(entries)
+		return strings.Join(entries, ",")
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		statusCode  int
+		disposition string
+		read        func([]byte) string
+	}{
+		{"zip", "/docs?archive=zip", 200, `attachment; filename=docs.zip`, readZip},
+		{"tar.gz", "/docs/?archive=tar.gz", 200, `attachment; filename=docs.tar.gz`, readTarGz},
+		{"unsupported format", "/docs?archive=rar", 400, "", nil},
+		{"file", "/docs/readme.md?archive=zip", 400, "", nil},
+		{"missing", "/missing?archive=zip", 404, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serve(user1, w, httptest.NewRequest("GET", tt.target, nil), a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+			if tt.read == nil {
+				return
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+				t.Errorf("Content-Disposition = %v, want %v", got, tt.disposition)
+			}
+			if got := tt.read(w.Body.Bytes()); got != want {
+				t.Errorf("entries = %v, want %v", got, want)
+			}
+		})
+	}
+}
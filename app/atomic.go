@@ -0,0 +1,263 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tempPrefix is the name prefix of the temporary files which receive the content of
+// files while they are written.
+const tempPrefix = ".~dave-tmp-"
+
+// maxTempBase is the length of the name of a file which is kept in the names of its
+// temporary files, so that they stay within the 255 bytes file systems allow for a name.
+const maxTempBase = 200
+
+// Values of the Fsync option of the writes.
+const (
+	FsyncNone = "none"
+	FsyncFile = "file"
+	FsyncFull = "full"
+)
+
+// errIncompleteWrite is returned when closing a file whose content hasn't been received
+// completely.
+var errIncompleteWrite = errors.New("incomplete write, keeping the previous content")
+
+// upload tracks the body of a PUT request, so that files written from it aren't moved
+// into place if the body couldn't be read completely or doesn't match the checksums sent
+// by the client.
+type upload struct {
+	io.ReadCloser
+	err       error
+	done      bool
+	expected  map[string]string
+	checksums checksummer
+	mtime     time.Time
+}
+
+// Read delegates to the body, calculates the checksums and remembers any error except
+// io.EOF.
+func (u *upload) Read(p []byte) (int, error) {
+	n, err := u.ReadCloser.Read(p)
+	if u.checksums != nil {
+		u.checksums.Write(p[:n])
+	}
+	switch {
+	case err == io.EOF:
+		u.done = true
+	case err != nil:
+		u.err = err
+	}
+
+	return n, err
+}
+
+// mismatch returns whether the body has been read completely but doesn't match the
+// checksums sent by the client.
+func (u *upload) mismatch() bool {
+	return u.done && len(u.expected) > 0 && !u.checksums.verify(u.expected)
+}
+
+// sums returns the checksums of the body, if it has been read completely.
+func (u *upload) sums() map[string]string {
+	if !u.done || u.err != nil || u.checksums == nil {
+		return nil
+	}
+
+	return u.checksums.sums()
+}
+
+// trackUpload wraps the body of a PUT request and adds it to the context. Requests with
+// invalid checksum or X-OC-Mtime headers are answered with 400 and false is returned.
+func trackUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) (context.Context, http.ResponseWriter, *http.Request, bool) {
+	if req.Method != http.MethodPut || req.Body == nil {
+		return ctx, w, req, true
+	}
+
+	expected, err := parseChecksums(req.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ctx, w, req, false
+	}
+	mtime, err := parseMtime(req.Header.Get("X-OC-Mtime"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ctx, w, req, false
+	}
+	if !mtime.IsZero() {
+		w.Header().Set("X-OC-MTime", "accepted")
+	}
+	var algorithms []string
+	for algorithm := range expected {
+		algorithms = append(algorithms, algorithm)
+	}
+	if _, ok := expected[defaultChecksum]; !ok && a.Config.Metadata.Dir != "" {
+		algorithms = append(algorithms, defaultChecksum)
+	}
+
+	u := &upload{ReadCloser: req.Body, expected: expected, mtime: mtime}
+	if len(algorithms) > 0 {
+		u.checksums = newChecksummer(algorithms...)
+	}
+	req.Body = u
+	if len(expected) > 0 {
+		w = &checksumResponseWriter{ResponseWriter: w, upload: u}
+	}
+
+	return context.WithValue(ctx, uploadKey, u), w, req, true
+}
+
+// uploadFromContext returns the body of the current PUT request.
+func uploadFromContext(ctx context.Context) *upload {
+	u, _ := ctx.Value(uploadKey).(*upload)
+	return u
+}
+
+// uploadFailed returns whether the body of the current request couldn't be read or
+// doesn't match its checksums.
+func uploadFailed(ctx context.Context) bool {
+	u := uploadFromContext(ctx)
+	return u != nil && (u.err != nil || u.mismatch())
+}
+
+// isTemp returns whether the physical path is a temporary file of a write.
+func isTemp(physical string) bool {
+	return strings.HasPrefix(filepath.Base(physical), tempPrefix)
+}
+
+// isInternal returns whether the physical path is a file which dave uses to write files.
+func isInternal(physical string) bool {
+	return isTemp(physical) || isPartial(physical)
+}
+
+// internalName returns whether any element of a slash separated name is the name of an
+// internal file.
+func internalName(name string) bool {
+	for _, element := range strings.Split(name, "/") {
+		if isInternal(element) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createTemp creates a temporary file next to the physical path, which replaces it once
+// it has been written. The temporary file receives the permissions of an existing file.
+func (d Dir) createTemp(ctx context.Context, physical string, existing os.FileInfo, perm os.FileMode) (*os.File, error) {
+	tmp := tempName(physical)
+	f, err := d.openFile(ctx, tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := f.Chmod(existing.Mode().Perm()); err != nil {
+			f.Close()
+			d.remove(ctx, tmp)
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// tempName returns a random name of a temporary file next to the physical path.
+func tempName(physical string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+
+	return filepath.Join(filepath.Dir(physical), tempPrefix+tempBase(filepath.Base(physical))+"-"+hex.EncodeToString(b))
+}
+
+// tempBase returns the name of a file as used in the names of its temporary files. Long
+// names are cut at maxTempBase and get a hash of the whole name, so that temporary files
+// of different files still don't share a name.
+func tempBase(base string) string {
+	if len(base) <= maxTempBase {
+		return base
+	}
+	sum := sha256.Sum256([]byte(base))
+	suffix := "-" + hex.EncodeToString(sum[:8])
+	cut := maxTempBase - len(suffix)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+
+	return base[:cut] + suffix
+}
+
+// replace moves a written temporary file to its target. If exclusive is set, an existing
+// target isn't replaced.
+func (d Dir) replace(ctx context.Context, tmp, physical string, exclusive bool) error {
+	var err error
+	if exclusive {
+		if err = d.link(ctx, tmp, physical); err == nil {
+			d.remove(ctx, tmp)
+		}
+	} else {
+		err = d.rename(ctx, tmp, ctx, physical)
+	}
+	if err != nil {
+		return err
+	}
+
+	if d.Config.Writes.Fsync == FsyncFull {
+		return syncDir(filepath.Dir(physical))
+	}
+
+	return nil
+}
+
+// syncDir commits the entries of a directory to stable storage.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+
+	return nil
+}
+
+// CleanupTempFiles removes the temporary files of writes which have been interrupted by
+// a shutdown and incomplete uploads which haven't been resumed for a day.
+func CleanupTempFiles(config *Config) (int, error) {
+	dir := config.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	removed := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if isTemp(path) || (isPartial(path) && time.Since(info.ModTime()) > uploadSessionMaxAge) {
+			if err := os.Remove(path); err != nil {
+				log.WithField("path", path).WithError(err).Warn("Can't remove temporary file")
+				return nil
+			}
+			removed++
+		}
+		return nil
+	})
+
+	return removed, err
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/webdav"
+)
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestHandleAtomicPut(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	config.Writes.Fsync = FsyncFull
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	target := filepath.Join(tmpDir, "file")
+	ioutil.WriteFile(target, []byte("previous"), 0640)
+
+	tests := []struct {
+		name        string
+		body        io.Reader
+		wantContent string
+	}{
+		{"interrupted upload", io.MultiReader(strings.NewReader("partial"), brokenReader{}), "previous"},
+		{"complete upload", strings.NewReader("current"), "current"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PUT", "/file", tt.body)
+			r.SetBasicAuth("admin", "password")
+			handle(context.Background(), httptest.NewRecorder(), r, a)
+
+			if b, _ := ioutil.ReadFile(target); string(b) != tt.wantContent {
+				t.Errorf("content = %q, want %q", b, tt.wantContent)
+			}
+			if infos, _ := ioutil.ReadDir(tmpDir); len(infos) != 1 {
+				t.Errorf("base dir contains %d files, want the target only", len(infos))
+			}
+		})
+	}
+
+	if fi, err := os.Stat(target); err != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("permissions of replaced file = %v, %v, want %v", fi.Mode().Perm(), err, os.FileMode(0640))
+	}
+
+	long := strings.Repeat("l", 255)
+	r := httptest.NewRequest("PUT", "/"+long, strings.NewReader("long"))
+	r.SetBasicAuth("admin", "password")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, r, a)
+	if b, err := ioutil.ReadFile(filepath.Join(tmpDir, long)); w.Code != 201 || string(b) != "long" {
+		t.Errorf("upload of a name with 255 bytes = %v, %q, %v, want 201", w.Code, b, err)
+	}
+}
+
+func TestTempNames(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	tests := []struct {
+		name string
+		base string
+	}{
+		{"short", "file.txt"},
+		{"longest kept", strings.Repeat("a", maxTempBase)},
+		{"too long", long},
+		{"too long with other extension", long[:250] + ".mkv"},
+		{"multibyte at the cut", strings.Repeat("a", maxTempBase-18) + strings.Repeat("ä", 20)},
+	}
+	bases := make(map[string]bool)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, tmp := range []string{filepath.Base(tempName(filepath.Join("/dir", tt.base))), path.Base(partialName("/dir/"+tt.base, "key"))} {
+				if len(tmp) > 255 || !utf8.ValidString(tmp) || !isInternal(tmp) {
+					t.Errorf("temporary name %q (%d bytes) isn't a valid internal name", tmp, len(tmp))
+				}
+			}
+			if len(tt.base) <= maxTempBase && tempBase(tt.base) != tt.base {
+				t.Errorf("tempBase(%q) = %q, want the name unchanged", tt.base, tempBase(tt.base))
+			}
+			if bases[tempBase(tt.base)] {
+				t.Errorf("tempBase(%q) = %q is used for another name", tt.base, tempBase(tt.base))
+			}
+			bases[tempBase(tt.base)] = true
+		})
+	}
+}
+
+func TestHandleInternalNames(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	ioutil.WriteFile(filepath.Join(tmpDir, "file"), []byte("content"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, tempPrefix+"file-1234"), []byte("partial"), 0600)
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		destination string
+	}{
+		{"upload temporary file", "PUT", "/" + tempPrefix + "x", ""},
+		{"upload partial file", "PUT", "/" + partialPrefix + "x", ""},
+		{"upload into internal dir", "PUT", "/" + tempPrefix + "x/file", ""},
+		{"create internal dir", "MKCOL", "/" + partialPrefix + "x", ""},
+		{"read temporary file", "GET", "/" + tempPrefix + "file-1234", ""},
+		{"move to internal name", "MOVE", "/file", "/" + tempPrefix + "x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.method == "PUT" {
+				r = httptest.NewRequest(tt.method, tt.path, strings.NewReader("content"))
+			}
+			if tt.destination != "" {
+				r.Header.Set("Destination", "http://localhost"+tt.destination)
+			}
+			r.SetBasicAuth("admin", "password")
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+
+			if w.Code < 400 {
+				t.Errorf("status = %v, want an error", w.Code)
+			}
+		})
+	}
+
+	if infos, _ := ioutil.ReadDir(tmpDir); len(infos) != 2 {
+		t.Errorf("base dir contains %d files, want 2", len(infos))
+	}
+
+	r := httptest.NewRequest("PROPFIND", "/", nil)
+	r.Header.Set("Depth", "1")
+	r.SetBasicAuth("admin", "password")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, r, a)
+	if body := w.Body.String(); !strings.Contains(body, "/file") || strings.Contains(body, tempPrefix) {
+		t.Errorf("PROPFIND listed internal files: %s", body)
+	}
+}
+
+func TestDirOpenFileAtomic(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	os.Mkdir(filepath.Join(tmpDir, "subdir1"), 0700)
+	d := Dir{Config: createTestConfig(tmpDir)}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	ioutil.WriteFile(filepath.Join(tmpDir, "file"), []byte("previous"), 0600)
+
+	f, err := d.OpenFile(ctx, "/file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte("current"))
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file")); string(b) != "previous" {
+		t.Errorf("content before Close() = %q, want %q", b, "previous")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "file")); string(b) != "current" {
+		t.Errorf("content after Close() = %q, want %q", b, "current")
+	}
+
+	if _, err := d.OpenFile(ctx, "/file", os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_EXCL, 0600); !os.IsExist(err) {
+		t.Errorf("exclusive OpenFile() of existing file error = %v, want exists", err)
+	}
+	if _, err := d.OpenFile(ctx, "/subdir1", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600); err == nil {
+		t.Errorf("OpenFile() of directory succeeded")
+	}
+}
+
+func TestCleanupTempFiles(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "a"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	files := map[string]bool{
+		"file":                        true,
+		"a/" + tempPrefix + "file-01": false,
+		"a/" + partialPrefix + "new":  true,
+		"a/" + partialPrefix + "old":  false,
+	}
+	for name := range files {
+		ioutil.WriteFile(filepath.Join(tmpDir, name), nil, 0600)
+	}
+	old := time.Now().Add(-2 * uploadSessionMaxAge)
+	os.Chtimes(filepath.Join(tmpDir, "a", partialPrefix+"old"), old, old)
+
+	removed, err := CleanupTempFiles(&Config{Dir: tmpDir})
+	if err != nil || removed != 2 {
+		t.Errorf("CleanupTempFiles() = %v, %v, want 2, nil", removed, err)
+	}
+	for name, keep := range files {
+		if _, err := os.Stat(filepath.Join(tmpDir, name)); (err == nil) != keep {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, keep)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditMkdir  = "mkdir"
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+	AuditRename = "rename"
+)
+
+// AuditRecord is a single line of the audit log. Each record contains the hash of its
+// predecessor, so that altering, inserting or removing a record breaks the chain.
+type AuditRecord struct {
+	Time        string `json:"time"`
+	User        string `json:"user"`
+	Address     string `json:"address"`
+	Forwarded   string `json:"forwarded,omitempty"`
+	Operation   string `json:"operation"`
+	Path        string `json:"path"`
+	Physical    string `json:"physical"`
+	NewPath     string `json:"newPath,omitempty"`
+	NewPhysical string `json:"newPhysical,omitempty"`
+	Size        *int64 `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Prev        string `json:"prev"`
+	Hash        string `json:"hash,omitempty"`
+}
+
+// digest calculates the hash of the record including the hash of its predecessor.
+func (r AuditRecord) digest() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog is an append-only log of file operations in form of JSON lines.
+type AuditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	last string
+}
+
+// OpenAuditLog opens or creates the audit log at the given path and continues the
+// chain of an already existing log.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	last := ""
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("corrupt audit log %s: %s", path, err)
+		}
+		last = rec.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &AuditLog{file: f, last: last}, nil
+}
+
+// Write completes the record with the time and chain hashes and appends it to the log.
+func (l *AuditLog) Write(rec *AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if rec.Time == "" {
+		rec.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	rec.Prev = l.last
+	hash, err := rec.digest()
+	if err != nil {
+		return err
+	}
+	rec.Hash = hash
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	l.last = hash
+	return nil
+}
+
+// Close closes the underlying file of the audit log.
+func (l *AuditLog) Close() error {
+	return l.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of an audit log and returns the number of valid
+// records. The returned error describes the first record breaking the chain.
+func VerifyAuditLog(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+
+	count, lineNo, prev := 0, 0, ""
+	for scanner.Scan() {
+		lineNo++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return count, fmt.Errorf("line %d: invalid record: %s", lineNo, err)
+		}
+		if rec.Prev != prev {
+			return count, fmt.Errorf("line %d: chain broken, previous hash doesn't match", lineNo)
+		}
+		hash, err := rec.digest()
+		if err != nil {
+			return count, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		if hash != rec.Hash {
+			return count, fmt.Errorf("line %d: record has been modified", lineNo)
+		}
+
+		prev = rec.Hash
+		count++
+	}
+
+	return count, scanner.Err()
+}
+
+// audit completes the record with information about the current user and appends it to
+// the audit log, if one is configured.
+func (d Dir) audit(ctx context.Context, rec *AuditRecord) {
+	if d.Audit == nil {
+		return
+	}
+
+	rec.User = d.resolveUser(ctx)
+	rec.Address = RemoteAddrFromContext(ctx)
+	rec.Forwarded = forwardedAddrFromContext(ctx)
+	if err := d.Audit.Write(rec); err != nil {
+		log.WithError(err).WithField("path", rec.Physical).Error("Error writing audit log")
+	}
+}
+
+// auditFile returns the size and SHA-256 hash of the content of a regular file, which is
+// opened beneath the root of the user without following a symlink at its place.
+func (d Dir) auditFile(ctx context.Context, physical string) (*int64, string) {
+	f, err := d.openFile(ctx, physical, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return nil, ""
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		return nil, ""
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, ""
+	}
+
+	return &size, hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,88 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	logFile := filepath.Join(tmpDir, "audit.log")
+	auditLog, err := OpenAuditLog(logFile)
+	if err != nil {
+		t.Fatalf("OpenAuditLog() error = %v", err)
+	}
+
+	configTmp := createTestConfig(tmpDir)
+	d := Dir{Config: configTmp, Audit: auditLog}
+	ctx := context.Background()
+	admin := context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	admin = context.WithValue(admin, remoteAddrKey, "127.0.0.1")
+
+	if err := d.Mkdir(admin, "a", 0700); err != nil {
+		t.Fatalf("Dir.Mkdir() error = %v", err)
+	}
+	f, err := d.OpenFile(admin, "a/b", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("Dir.OpenFile() error = %v", err)
+	}
+	f.Write([]byte("content"))
+	f.Close()
+	if err := d.Rename(admin, "a/b", "a/c"); err != nil {
+		t.Fatalf("Dir.Rename() error = %v", err)
+	}
+	auditLog.Close()
+
+	// reopening must continue the existing chain
+	auditLog, err = OpenAuditLog(logFile)
+	if err != nil {
+		t.Fatalf("OpenAuditLog() error = %v", err)
+	}
+	d.Audit = auditLog
+	if err := d.RemoveAll(admin, "a"); err != nil {
+		t.Fatalf("Dir.RemoveAll() error = %v", err)
+	}
+	auditLog.Close()
+
+	content, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("error reading audit log. error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+		wantErr bool
+	}{
+		{"valid", content, 4, false},
+		{"modified", bytes.Replace(content, []byte(`"user":"admin"`), []byte(`"user":"other"`), 1), 0, true},
+		{"removed", []byte(strings.SplitN(string(content), "\n", 2)[1]), 0, true},
+		{"empty", []byte{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := VerifyAuditLog(bytes.NewReader(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyAuditLog() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("VerifyAuditLog() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if !strings.Contains(string(content), `"operation":"create","path":"a/b"`) {
+		t.Errorf("audit log doesn't contain the create operation. content = %s", content)
+	}
+}
@@ -0,0 +1,330 @@
+package app
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// Supported checksum algorithms.
+const (
+	ChecksumMD5     = "MD5"
+	ChecksumSHA1    = "SHA1"
+	ChecksumSHA256  = "SHA256"
+	ChecksumAdler32 = "ADLER32"
+)
+
+// defaultChecksum is the algorithm which is calculated for every upload and returned on
+// downloads.
+const defaultChecksum = ChecksumSHA256
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	ChecksumMD5:     md5.New,
+	ChecksumSHA1:    sha1.New,
+	ChecksumSHA256:  sha256.New,
+	ChecksumAdler32: func() hash.Hash { return adler32.New() },
+}
+
+// digestAlgorithms maps the names of the Digest header (RFC 3230) to the algorithms.
+var digestAlgorithms = map[string]string{
+	"MD5":     ChecksumMD5,
+	"SHA":     ChecksumSHA1,
+	"SHA-256": ChecksumSHA256,
+	"ADLER32": ChecksumAdler32,
+}
+
+// checksumsProperty is the dead property which exposes the known checksums of a file.
+var checksumsProperty = xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"}
+
+// errChecksumMismatch is returned when closing an uploaded file whose content doesn't
+// match the checksums sent by the client.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// parseChecksums parses the checksums sent with a request in Content-MD5, Digest or
+// OC-Checksum headers. Checksums are returned as lower case hex strings.
+func parseChecksums(header http.Header) (map[string]string, error) {
+	sums := make(map[string]string)
+	add := func(algorithm, value string, encoded func(string) ([]byte, error)) error {
+		b, err := encoded(value)
+		if err != nil || len(b) != checksumAlgorithms[algorithm]().Size() {
+			return fmt.Errorf("invalid %s checksum %q", algorithm, value)
+		}
+		sums[algorithm] = hex.EncodeToString(b)
+		return nil
+	}
+
+	if v := header.Get("Content-MD5"); v != "" {
+		if err := add(ChecksumMD5, v, base64.StdEncoding.DecodeString); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range strings.Split(header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(v), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		algorithm, ok := digestAlgorithms[strings.ToUpper(parts[0])]
+		if !ok {
+			continue
+		}
+		decode := base64.StdEncoding.DecodeString
+		if algorithm == ChecksumAdler32 {
+			decode = hex.DecodeString
+		}
+		if err := add(algorithm, parts[1], decode); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range strings.Fields(header.Get("OC-Checksum")) {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid checksum %q", v)
+		}
+		algorithm := strings.ToUpper(parts[0])
+		if _, ok := checksumAlgorithms[algorithm]; !ok {
+			return nil, fmt.Errorf("unsupported checksum algorithm %q", parts[0])
+		}
+		if err := add(algorithm, strings.ToLower(parts[1]), hex.DecodeString); err != nil {
+			return nil, err
+		}
+	}
+
+	return sums, nil
+}
+
+// checksummer calculates checksums of the data written to it.
+type checksummer map[string]hash.Hash
+
+func newChecksummer(algorithms ...string) checksummer {
+	c := make(checksummer)
+	for _, algorithm := range algorithms {
+		c[algorithm] = checksumAlgorithms[algorithm]()
+	}
+
+	return c
+}
+
+// Write writes the data to all hashes.
+func (c checksummer) Write(p []byte) (int, error) {
+	for _, h := range c {
+		h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// sums returns the checksums as lower case hex strings.
+func (c checksummer) sums() map[string]string {
+	sums := make(map[string]string)
+	for algorithm, h := range c {
+		sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return sums
+}
+
+// verify returns whether all expected checksums match.
+func (c checksummer) verify(expected map[string]string) bool {
+	sums := c.sums()
+	for algorithm, sum := range expected {
+		if sums[algorithm] != sum {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checksumResponseWriter answers a PUT with 400 instead of the status the webdav handler
+// uses for errors while closing the file, if the checksums didn't match.
+type checksumResponseWriter struct {
+	http.ResponseWriter
+	upload *upload
+}
+
+// WriteHeader replaces the status, if the upload has been rejected.
+func (w *checksumResponseWriter) WriteHeader(statusCode int) {
+	if statusCode >= 400 && w.upload.mismatch() {
+		statusCode = http.StatusBadRequest
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// checksums returns the checksums of the file for the requested algorithms. Missing
+// checksums are calculated and cached, if compute is set. The file is opened beneath the
+// root of the user.
+func (d Dir) checksums(ctx context.Context, physical string, algorithms []string, compute bool) map[string]string {
+	if d.Meta == nil {
+		return nil
+	}
+	f, err := d.openFile(ctx, physical, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+	sums := d.cachedChecksums(physical, fi)
+
+	var missing []string
+	for _, algorithm := range algorithms {
+		if _, ok := sums[algorithm]; !ok {
+			missing = append(missing, algorithm)
+		}
+	}
+	if len(missing) == 0 || !compute {
+		return sums
+	}
+
+	c := newChecksummer(missing...)
+	if _, err := io.Copy(c, f); err != nil {
+		return sums
+	}
+	for algorithm, sum := range c.sums() {
+		sums[algorithm] = sum
+	}
+	d.storeChecksums(physical, sums, fi)
+
+	return sums
+}
+
+// cachedChecksums returns the checksums cached for the file, if they have been
+// calculated for the size and modification time of the file info.
+func (d Dir) cachedChecksums(physical string, fi os.FileInfo) map[string]string {
+	m, err := d.Meta.get(d.relative(physical))
+	if err != nil {
+		log.WithField("path", physical).WithError(err).Warn("Error reading metadata")
+		return nil
+	}
+	sums := make(map[string]string)
+	if m.Size == fi.Size() && m.ModTime.Equal(fi.ModTime()) {
+		for algorithm, sum := range m.Checksums {
+			sums[algorithm] = sum
+		}
+	}
+
+	return sums
+}
+
+// storeChecksums caches the checksums of the file as of the given file info. Cached
+// checksums are dropped if sums is empty.
+func (d Dir) storeChecksums(physical string, sums map[string]string, fi os.FileInfo) {
+	if d.Meta == nil {
+		return
+	}
+
+	err := d.Meta.update(d.relative(physical), func(m *fileMeta) bool {
+		if len(sums) == 0 {
+			if m.Checksums == nil {
+				return false
+			}
+			m.Checksums = nil
+			return true
+		}
+		m.Size, m.ModTime, m.Checksums = fi.Size(), fi.ModTime(), sums
+		return true
+	})
+	if err != nil {
+		log.WithField("path", physical).WithError(err).Warn("Error caching checksums")
+	}
+}
+
+// setChecksumHeaders adds the checksums of a requested file to the response of a GET
+// or HEAD request. Besides the default algorithm, clients can ask for others via the
+// Want-Digest header. Missing checksums are calculated for GET requests of the whole
+// file and if asked for via Want-Digest only, other requests get the cached ones.
+func setChecksumHeaders(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	d, ok := a.Handler.FileSystem.(*Dir)
+	if !ok || d.Meta == nil {
+		return
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return
+	}
+	physical := d.resolve(ctx, name)
+	if physical == "" || d.hidden(physical) || d.checkSymlinks(ctx, physical, true) != nil {
+		return
+	}
+	if _, inBox := d.dropbox(ctx, physical); inBox {
+		return
+	}
+
+	algorithms := []string{defaultChecksum}
+	wanted := false
+	for _, v := range strings.Split(req.Header.Get("Want-Digest"), ",") {
+		name := strings.ToUpper(strings.TrimSpace(strings.SplitN(v, ";", 2)[0]))
+		if algorithm, ok := digestAlgorithms[name]; ok {
+			algorithms = append(algorithms, algorithm)
+			wanted = true
+		}
+	}
+	compute := wanted || (req.Method == http.MethodGet && req.Header.Get("Range") == "")
+
+	sums := d.checksums(ctx, physical, algorithms, compute)
+	if len(sums) == 0 {
+		return
+	}
+	var digests, ocChecksums []string
+	for name, algorithm := range digestAlgorithms {
+		sum, ok := sums[algorithm]
+		if !ok {
+			continue
+		}
+		b, _ := hex.DecodeString(sum)
+		if algorithm == ChecksumAdler32 {
+			digests = append(digests, name+"="+sum)
+		} else {
+			digests = append(digests, name+"="+base64.StdEncoding.EncodeToString(b))
+		}
+		ocChecksums = append(ocChecksums, algorithm+":"+sum)
+	}
+	sort.Strings(digests)
+	sort.Strings(ocChecksums)
+	w.Header().Set("Digest", strings.Join(digests, ","))
+	w.Header().Set("OC-Checksum", strings.Join(ocChecksums, " "))
+}
+
+// checksumsProp returns the dead property which lists the cached checksums of a file.
+func (d Dir) checksumsProp(physical string) (webdav.Property, bool) {
+	if d.Meta == nil {
+		return webdav.Property{}, false
+	}
+	fi, err := os.Stat(physical)
+	if err != nil || !fi.Mode().IsRegular() {
+		return webdav.Property{}, false
+	}
+	sums := d.cachedChecksums(physical, fi)
+	if len(sums) == 0 {
+		return webdav.Property{}, false
+	}
+
+	var values []string
+	for algorithm, sum := range sums {
+		values = append(values, algorithm+":"+sum)
+	}
+	sort.Strings(values)
+
+	return webdav.Property{
+		XMLName:  checksumsProperty,
+		InnerXML: []byte(`<checksum xmlns="` + checksumsProperty.Space + `">` + strings.Join(values, " ") + `</checksum>`),
+	}, true
+}
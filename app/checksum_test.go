@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParseChecksums(t *testing.T) {
+	// checksums of "hello"
+	md5Hex := "5d41402abc4b2a76b9719d911017c592"
+	sha1Hex := "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+	sha256Hex := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"none", nil, map[string]string{}, false},
+		{"content md5", map[string]string{"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg=="}, map[string]string{ChecksumMD5: md5Hex}, false},
+		{"digest", map[string]string{"Digest": "SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=, sha=qvTGHdzF6KLavt4PO0gs2a6pQ00="}, map[string]string{ChecksumSHA256: sha256Hex, ChecksumSHA1: sha1Hex}, false},
+		{"unknown digest", map[string]string{"Digest": "UNIXsum=30"}, map[string]string{}, false},
+		{"oc checksum", map[string]string{"OC-Checksum": "SHA1:" + strings.ToUpper(sha1Hex)}, map[string]string{ChecksumSHA1: sha1Hex}, false},
+		{"adler32", map[string]string{"OC-Checksum": "Adler32:062c0215"}, map[string]string{ChecksumAdler32: "062c0215"}, false},
+		{"invalid content md5", map[string]string{"Content-MD5": "hello"}, nil, true},
+		{"short checksum", map[string]string{"OC-Checksum": "MD5:5d41"}, nil, true},
+		{"unsupported oc checksum", map[string]string{"OC-Checksum": "CRC32:12345678"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			got, err := parseChecksums(header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseChecksums() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseChecksums() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleChecksums(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(filepath.Join(tmpDir, "data"))
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	config.Metadata.Dir = filepath.Join(tmpDir, "meta")
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config, Meta: NewMetaStore(config.Metadata.Dir)}, LockSystem: webdav.NewMemLS()},
+	}
+	target := filepath.Join(tmpDir, "data", "file")
+	ioutil.WriteFile(target, []byte("previous"), 0600)
+
+	tests := []struct {
+		name        string
+		method      string
+		header      map[string]string
+		body        string
+		statusCode  int
+		wantContent string
+		wantHeader  map[string]string
+	}{
+		{"wrong checksum", "PUT", map[string]string{"OC-Checksum": "MD5:00000000000000000000000000000000"}, "hello", 400, "previous", nil},
+		{"invalid checksum", "PUT", map[string]string{"Content-MD5": "hello"}, "hello", 400, "previous", nil},
+		{"matching checksum", "PUT", map[string]string{"Content-MD5": "XUFAKrxLKna5cZ2REBfFkg=="}, "hello", 201, "hello", nil},
+		{"checksums on head", "HEAD", map[string]string{"Want-Digest": "MD5;q=1"}, "", 200, "hello", map[string]string{
+			"Digest":      "MD5=XUFAKrxLKna5cZ2REBfFkg==,SHA-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=",
+			"OC-Checksum": "MD5:5d41402abc4b2a76b9719d911017c592 SHA256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		}},
+		{"checksums on propfind", "PROPFIND", map[string]string{"Depth": "0"}, "", 207, "hello", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/file", strings.NewReader(tt.body))
+			r.SetBasicAuth("admin", "password")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+			if b, _ := ioutil.ReadFile(target); string(b) != tt.wantContent {
+				t.Errorf("content = %q, want %q", b, tt.wantContent)
+			}
+			for k, v := range tt.wantHeader {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("header %s = %q, want %q", k, got, v)
+				}
+			}
+			if tt.method == "PROPFIND" && !strings.Contains(w.Body.String(), "SHA256:2cf24dba") {
+				t.Errorf("PROPFIND response lacks checksum: %s", w.Body.String())
+			}
+		})
+	}
+
+	// files are hashed for GET requests of the whole file or if asked for only
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "other"), []byte("hello"), 0600)
+	requests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   bool
+	}{
+		{"head", "HEAD", nil, false},
+		{"range", "GET", map[string]string{"Range": "bytes=1-2"}, false},
+		{"whole file", "GET", nil, true},
+		{"cached on head", "HEAD", nil, true},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/other", nil)
+			r.SetBasicAuth("admin", "password")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+
+			if got := w.Header().Get("Digest") != ""; got != tt.want {
+				t.Errorf("Digest = %q, want it %v", w.Header().Get("Digest"), tt.want)
+			}
+		})
+	}
+}
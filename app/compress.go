@@ -0,0 +1,244 @@
+package app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings of compressed responses.
+const (
+	EncodingZstd   = "zstd"
+	EncodingBrotli = "br"
+	EncodingGzip   = "gzip"
+)
+
+// defaultCompressionMinSize is the size below which responses aren't compressed, if no
+// other size is configured.
+const defaultCompressionMinSize = 1024
+
+// encodings are the supported content encodings in order of preference.
+var encodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// defaultCompressionTypes are the compressed media types, if no others are configured.
+var defaultCompressionTypes = []string{
+	"text/html", "text/plain", "text/css", "text/csv", "text/markdown", "text/xml",
+	"application/xml", "application/json", "application/javascript", "image/svg+xml",
+}
+
+// compressWriter compresses a response with the negotiated encoding, if its status,
+// media type and size allow it. Responses are buffered until the minimum size is
+// reached, so small ones are sent uncompressed.
+type compressWriter struct {
+	http.ResponseWriter
+	config   Compression
+	encoding string
+	status   int
+	decided  bool
+	compress bool
+	buf      bytes.Buffer
+	enc      io.WriteCloser
+}
+
+// compressResponse wraps the response writer of a request which accepts a supported
+// encoding. The returned writer has to be closed.
+func compressResponse(w http.ResponseWriter, req *http.Request, config Compression) (*compressWriter, bool) {
+	if !config.Enabled || req.Method == http.MethodHead {
+		return nil, false
+	}
+	encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil, false
+	}
+
+	return &compressWriter{ResponseWriter: w, config: config, encoding: encoding}, true
+}
+
+// negotiateEncoding returns the supported encoding with the highest quality of an
+// Accept-Encoding header. Ties are resolved by the order of preference.
+func negotiateEncoding(header string) string {
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name != "" {
+			qualities[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// compressible returns whether responses of the media type are compressed. Configured
+// types ending with a slash or "/*" match all subtypes.
+func (c Compression) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	types := c.Types
+	if len(types) == 0 {
+		types = defaultCompressionTypes
+	}
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSuffix(t, "*"))
+		if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c Compression) minSize() int {
+	if c.MinSize > 0 {
+		return c.MinSize
+	}
+
+	return defaultCompressionMinSize
+}
+
+// WriteHeader decides whether the response can be compressed. Its status is written
+// once enough of the body is known.
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+
+	h := w.Header()
+	eligible := (status == http.StatusOK || status == http.StatusMultiStatus) &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		w.config.compressible(h.Get("Content-Type"))
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < w.config.minSize() {
+		eligible = false
+	}
+	if !eligible {
+		w.decided = true
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case w.decided && w.compress:
+		return w.enc.Write(p)
+	case w.decided:
+		return w.ResponseWriter.Write(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() >= w.config.minSize() {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// start writes the status and the buffered body, compressed or not.
+func (w *compressWriter) start(compress bool) error {
+	w.decided = true
+	w.compress = compress
+	if compress {
+		h := w.Header()
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		w.enc = newEncoder(w.ResponseWriter, w.encoding)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+
+	var err error
+	if compress {
+		_, err = w.enc.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+
+	return err
+}
+
+// Flush sends what has been written so far, compressed if the response is compressed.
+func (w *compressWriter) Flush() {
+	if w.status == 0 {
+		return
+	}
+	if !w.decided {
+		w.start(true)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok && w.compress {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response. Bodies smaller than the minimum size are sent as is.
+func (w *compressWriter) Close() error {
+	if w.status == 0 {
+		return nil
+	}
+	if !w.decided {
+		return w.start(false)
+	}
+	if w.compress {
+		return w.enc.Close()
+	}
+
+	return nil
+}
+
+func newEncoder(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case EncodingZstd:
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return enc
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(w, 4)
+	}
+	enc, _ := gzip.NewWriterLevel(w, gzip.DefaultCompression)
+
+	return enc
+}
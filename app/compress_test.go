@@ -0,0 +1,161 @@
+package app
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/webdav"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"gzip, deflate, br", "br"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"*", "zstd"},
+		{"identity", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := negotiateEncoding(tt.header); got != tt.want {
+				t.Errorf("negotiateEncoding() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	tests := []struct {
+		types       []string
+		contentType string
+		want        bool
+	}{
+		{nil, "text/xml; charset=utf-8", true},
+		{nil, "image/png", false},
+		{nil, "text/event-stream", false},
+		{[]string{"text/"}, "text/x-go", true},
+		{[]string{"application/*"}, "application/pdf", true},
+		{[]string{"application/json"}, "text/plain", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			if got := (Compression{Types: tt.types}).compressible(tt.contentType); got != tt.want {
+				t.Errorf("compressible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCompression(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	large := strings.Repeat("compress me ", 1000)
+	ioutil.WriteFile(filepath.Join(tmpDir, "large.txt"), []byte(large), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "small.txt"), []byte("small"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "large.bin"), append([]byte{0}, large...), 0600)
+	for i := 0; i < 50; i++ {
+		ioutil.WriteFile(filepath.Join(tmpDir, "file"+strconv.Itoa(i)+".txt"), nil, 0600)
+	}
+
+	config := &Config{Dir: tmpDir, Compression: Compression{Enabled: true}}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+
+	decode := func(encoding string, r io.Reader) string {
+		var dr io.Reader
+		switch encoding {
+		case "gzip":
+			gz, err := gzip.NewReader(r)
+			if err != nil {
+				t.Fatalf("invalid gzip: %v", err)
+			}
+			dr = gz
+		case "br":
+			dr = brotli.NewReader(r)
+		case "zstd":
+			zr, err := zstd.NewReader(r)
+			if err != nil {
+				t.Fatalf("invalid zstd: %v", err)
+			}
+			defer zr.Close()
+			dr = zr
+		default:
+			dr = r
+		}
+		b, err := ioutil.ReadAll(dr)
+		if err != nil {
+			t.Fatalf("error decoding %s: %v", encoding, err)
+		}
+		return string(b)
+	}
+
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		acceptEncoding string
+		rangeHeader    string
+		enabled        bool
+		statusCode     int
+		want           string
+		contains       string
+	}{
+		{"gzip", "GET", "/large.txt", "gzip", "", true, 200, "gzip", large},
+		{"brotli", "GET", "/large.txt", "gzip, br", "", true, 200, "br", large},
+		{"zstd", "GET", "/large.txt", "zstd, gzip", "", true, 200, "zstd", large},
+		{"propfind", "PROPFIND", "/", "gzip", "", true, 207, "gzip", "file49.txt"},
+		{"too small", "GET", "/small.txt", "gzip", "", true, 200, "", "small"},
+		{"not compressible", "GET", "/large.bin", "gzip", "", true, 200, "", large},
+		{"range", "GET", "/large.txt", "gzip", "bytes=0-7", true, 206, "", "compress"},
+		{"not accepted", "GET", "/large.txt", "", "", true, 200, "", large},
+		{"disabled", "GET", "/large.txt", "gzip", "", false, 200, "", large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Compression.Enabled = tt.enabled
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			if tt.method == "PROPFIND" {
+				r.Header.Set("Depth", "1")
+			}
+			if tt.rangeHeader != "" {
+				r.Header.Set("Range", tt.rangeHeader)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+			encoding := w.Header().Get("Content-Encoding")
+			if encoding != tt.want {
+				t.Fatalf("Content-Encoding = %q, want %q", encoding, tt.want)
+			}
+			if encoding != "" && w.Header().Get("Content-Length") != "" {
+				t.Errorf("Content-Length = %v, want none", w.Header().Get("Content-Length"))
+			}
+			if got := decode(encoding, w.Body); !strings.Contains(got, tt.contains) {
+				t.Errorf("body doesn't contain %.20q", tt.contains)
+			}
+		})
+	}
+}
@@ -7,20 +7,40 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 )
 
 // Config represents the configuration of the server application.
 type Config struct {
-	Address string
-	Port    string
-	Prefix  string
-	Dir     string
-	TLS     *TLS
-	Log     Logging
-	Realm   string
-	Users   map[string]*UserInfo
-	Cors    Cors
+	Address        string
+	Port           string
+	Prefix         string
+	Dir            string
+	TLS            *TLS
+	Log            Logging
+	Realm          string
+	TrustedProxies []string
+	Users          map[string]*UserInfo
+	Cors           Cors
+	Audit          Audit
+	Webhooks       Webhooks
+	Events         Events
+	UI             UI
+	Shares         Shares
+	Anonymous      Anonymous
+	Dropboxes      []*Dropbox
+	Uploads        Uploads
+	Writes         Writes
+	Metadata       Metadata
+	Search         Search
+	Previews       Previews
+	Compression    Compression
+	Bandwidth      Bandwidth
+	Limits         Limits
+	Symlinks       string
+	Hidden         Hidden
 }
 
 // Logging allows definition for logging each CRUD method.
@@ -32,16 +52,153 @@ type Logging struct {
 	Delete bool
 }
 
+// Audit allows definition of a file which receives a tamper-evident log of all
+// modifying file operations.
+type Audit struct {
+	File string
+}
+
+// Anonymous allows unauthenticated requests read-only access to a subdirectory of the
+// base dir, while users are configured.
+type Anonymous struct {
+	Enabled bool
+	Subdir  string
+}
+
+// valid returns whether the subdir of anonymous access is set. The whole base dir is
+// never published.
+func (a Anonymous) valid() bool {
+	return path.Clean("/"+filepath.ToSlash(a.Subdir)) != "/"
+}
+
+// Dropbox allows definition of a directory, relative to the base dir, where new files can
+// be uploaded but nothing can be listed, read, overwritten or deleted. Owners aren't
+// restricted.
+type Dropbox struct {
+	Path   string
+	Owners []string
+}
+
+// Hidden allows definition of glob patterns of files which are hidden from clients, like
+// ".git" or "*.tmp". Uploads of hidden files are rejected by default or, with Uploads set
+// to "discard", accepted and dropped.
+type Hidden struct {
+	Patterns []string
+	Uploads  string
+}
+
+// Search allows enabling the index of the base dir which answers SEARCH requests. The
+// index watches the base dir for changes which aren't made through dave. FullText adds
+// the content of text, Markdown, PDF and office documents to the index.
+type Search struct {
+	Enabled  bool
+	FullText bool
+}
+
+// Metadata allows definition of the directory which keeps metadata of files, like cached
+// checksums and dead properties. Metadata isn't kept if not set.
+type Metadata struct {
+	Dir string
+}
+
+// Writes allows definition of how written files are committed to stable storage before
+// they replace the previous content: "none" (default), "file" syncs the content and
+// "full" additionally syncs the directory.
+type Writes struct {
+	Fsync string
+}
+
+// Uploads allows definition of the directory which keeps the chunks of unfinished
+// chunked uploads. The temp dir of the system is used by default.
+type Uploads struct {
+	Dir string
+}
+
+// Limits allows definition of request limits per client address and per user.
+type Limits struct {
+	PerIP   Limit
+	PerUser Limit
+}
+
+// Limit allows definition of a rate of requests per second with bursts of up to Burst
+// requests (the rate by default) and a maximum of concurrent requests. 0 means unlimited.
+type Limit struct {
+	Rate       float64
+	Burst      int
+	Concurrent int
+}
+
+// Bandwidth allows definition of upload and download rate limits in bytes per second,
+// globally or per user. 0 means unlimited.
+type Bandwidth struct {
+	Upload   int64
+	Download int64
+}
+
+// Compression allows enabling the compression of responses with zstd, brotli or gzip,
+// as accepted by the client. Types lists the compressed media types, where entries
+// ending with a slash match all subtypes, and MinSize the size in bytes below which
+// responses are sent as is. Both have reasonable defaults.
+type Compression struct {
+	Enabled bool
+	Types   []string
+	MinSize int
+}
+
+// Previews allows definition of the directory which caches the thumbnails of images.
+// The temp dir of the system is used by default.
+type Previews struct {
+	Dir string
+}
+
+// Shares allows definition of the file which stores the share links.
+type Shares struct {
+	File string
+}
+
+// UI allows disabling the web interface which is served to browsers requesting a
+// directory.
+type UI struct {
+	Disabled bool
+}
+
+// Events allows watching the base dir for changes which aren't made through dave.
+type Events struct {
+	Watch bool
+}
+
+// Webhooks contains the webhooks which are notified about file events and the settings
+// for their delivery.
+type Webhooks struct {
+	Queue   string
+	Retries int
+	Size    int
+	Hooks   []*Webhook
+}
+
+// Webhook allows definition of an URL which receives file events. Events and Paths
+// restrict the notifications to the given event types and path globs.
+type Webhook struct {
+	URL    string
+	Secret string
+	Events []string
+	Paths  []string
+}
+
 // TLS allows specification of a certificate and private key file.
 type TLS struct {
 	CertFile string
 	KeyFile  string
 }
 
-// UserInfo allows storing of a password and user directory.
+// UserInfo allows storing of a password and user directory. Quota limits the size of
+// the users tree in bytes when archives are extracted or chunks are uploaded; 0 means
+// unlimited. Bandwidth limits the transfers of the user in addition to the global limits.
 type UserInfo struct {
-	Password string
-	Subdir   *string
+	Password  string
+	Subdir    *string
+	Quota     int64
+	Bandwidth Bandwidth
 }
 
 // Cors contains settings related to Cross-Origin Resource Sharing (CORS)
@@ -84,6 +241,13 @@ func ParseConfig(path string) *Config {
 		}
 	}
 
+	if cfg.Anonymous.Enabled && !cfg.Anonymous.valid() {
+		log.Fatal("Anonymous access requires a subdir other than the base dir")
+	}
+	if !validSymlinks(cfg.Symlinks) {
+		log.Fatal(fmt.Errorf("Unknown symlink policy %q, use follow, deny or confine", cfg.Symlinks))
+	}
+
 	viper.WatchConfig()
 	viper.OnConfigChange(cfg.handleConfigUpdate)
 
@@ -107,6 +271,26 @@ func setDefaults() {
 	viper.SetDefault("Log.Update", false)
 	viper.SetDefault("Log.Delete", false)
 	viper.SetDefault("Cors.Credentials", false)
+	viper.SetDefault("Audit.File", "")
+	viper.SetDefault("Webhooks.Queue", "")
+	viper.SetDefault("Events.Watch", false)
+	viper.SetDefault("UI.Disabled", false)
+	viper.SetDefault("Shares.File", "")
+	viper.SetDefault("Anonymous.Enabled", false)
+	viper.SetDefault("Uploads.Dir", "")
+	viper.SetDefault("Writes.Fsync", "")
+	viper.SetDefault("Metadata.Dir", "")
+	viper.SetDefault("Search.Enabled", false)
+	viper.SetDefault("Search.FullText", false)
+	viper.SetDefault("Previews.Dir", "")
+	viper.SetDefault("Compression.Enabled", false)
+	viper.SetDefault("Compression.MinSize", 0)
+	viper.SetDefault("Bandwidth.Upload", 0)
+	viper.SetDefault("Bandwidth.Download", 0)
+	viper.SetDefault("Limits.PerIP.Rate", 0)
+	viper.SetDefault("Limits.PerUser.Rate", 0)
+	viper.SetDefault("Symlinks", "")
+	viper.SetDefault("Hidden.Uploads", "")
 }
 
 // AuthenticationNeeded returns whether users are defined and authentication is required
@@ -160,9 +344,62 @@ func updateConfig(cfg *Config, updatedCfg *Config) {
 				log.WithField("user", username).Info("Updated subdir of user")
 				cfg.Users[username].Subdir = v.Subdir
 			}
+			if cfg.Users[username].Quota != v.Quota {
+				log.WithField("user", username).Info("Updated quota of user")
+				cfg.Users[username].Quota = v.Quota
+			}
+			if cfg.Users[username].Bandwidth != v.Bandwidth {
+				log.WithField("user", username).Info("Updated bandwidth of user")
+				cfg.Users[username].Bandwidth = v.Bandwidth
+			}
 		}
 	}
 	cfg.ensureUserDirs()
+	if !reflect.DeepEqual(cfg.Webhooks.Hooks, updatedCfg.Webhooks.Hooks) {
+		cfg.Webhooks.Hooks = updatedCfg.Webhooks.Hooks
+		log.WithField("count", len(cfg.Webhooks.Hooks)).Info("Updated webhooks")
+	}
+	if updatedCfg.Anonymous.Enabled && !updatedCfg.Anonymous.valid() {
+		log.Warn("Anonymous access requires a subdir other than the base dir, disabling it")
+		updatedCfg.Anonymous = Anonymous{}
+	}
+	if cfg.Anonymous != updatedCfg.Anonymous {
+		cfg.Anonymous = updatedCfg.Anonymous
+		log.WithField("enabled", cfg.Anonymous.Enabled).WithField("subdir", cfg.Anonymous.Subdir).Info("Updated anonymous access")
+		cfg.ensureUserDirs()
+	}
+	if !reflect.DeepEqual(cfg.Dropboxes, updatedCfg.Dropboxes) {
+		cfg.Dropboxes = updatedCfg.Dropboxes
+		log.WithField("count", len(cfg.Dropboxes)).Info("Updated drop boxes")
+	}
+	if !reflect.DeepEqual(cfg.Compression, updatedCfg.Compression) {
+		cfg.Compression = updatedCfg.Compression
+		log.WithField("enabled", cfg.Compression.Enabled).Info("Updated compression of responses")
+	}
+	if cfg.Limits != updatedCfg.Limits {
+		cfg.Limits = updatedCfg.Limits
+		log.Info("Updated request limits")
+	}
+	if cfg.Bandwidth != updatedCfg.Bandwidth {
+		cfg.Bandwidth = updatedCfg.Bandwidth
+		log.WithField("upload", cfg.Bandwidth.Upload).WithField("download", cfg.Bandwidth.Download).Info("Updated bandwidth limits")
+	}
+	if !validSymlinks(updatedCfg.Symlinks) {
+		log.WithField("symlinks", updatedCfg.Symlinks).Warn("Unknown symlink policy, keeping the current one")
+		updatedCfg.Symlinks = cfg.Symlinks
+	}
+	if cfg.Symlinks != updatedCfg.Symlinks {
+		cfg.Symlinks = updatedCfg.Symlinks
+		log.WithField("symlinks", cfg.Symlinks).Info("Updated symlink policy")
+	}
+	if !reflect.DeepEqual(cfg.Hidden, updatedCfg.Hidden) {
+		cfg.Hidden = updatedCfg.Hidden
+		log.WithField("count", len(cfg.Hidden.Patterns)).Info("Updated hidden files")
+	}
+	if cfg.Writes != updatedCfg.Writes {
+		cfg.Writes = updatedCfg.Writes
+		log.WithField("fsync", cfg.Writes.Fsync).Info("Updated fsync of writes")
+	}
 	if cfg.Log.Create != updatedCfg.Log.Create {
 		cfg.Log.Create = updatedCfg.Log.Create
 		log.WithField("enabled", cfg.Log.Create).Info("Set logging for create operations")
@@ -191,6 +428,14 @@ func (cfg *Config) ensureUserDirs() {
 		log.WithField("path", cfg.Dir).Info("Created base dir")
 	}
 
+	if cfg.Anonymous.Enabled && cfg.Anonymous.valid() {
+		path := filepath.Join(cfg.Dir, cfg.Anonymous.Subdir)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			os.MkdirAll(path, os.ModePerm)
+			log.WithField("path", path).Info("Created anonymous dir")
+		}
+	}
+
 	for _, user := range cfg.Users {
 		if user.Subdir != nil {
 			path := filepath.Join(cfg.Dir, *user.Subdir)
@@ -124,3 +124,54 @@ func TestSetDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateConfigAnonymous(t *testing.T) {
+	tests := []struct {
+		name    string
+		updated Anonymous
+		want    Anonymous
+	}{
+		{"enabled", Anonymous{Enabled: true, Subdir: "/public"}, Anonymous{Enabled: true, Subdir: "/public"}},
+		{"without subdir", Anonymous{Enabled: true}, Anonymous{}},
+		{"base dir", Anonymous{Enabled: true, Subdir: "/"}, Anonymous{}},
+		{"disabled", Anonymous{Subdir: "/"}, Anonymous{Subdir: "/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+			os.Mkdir(tmpDir, 0700)
+			defer os.RemoveAll(tmpDir)
+
+			cfg := &Config{Dir: tmpDir, Anonymous: Anonymous{Enabled: true, Subdir: "/old"}}
+			updateConfig(cfg, &Config{Dir: tmpDir, Anonymous: tt.updated})
+			if cfg.Anonymous != tt.want {
+				t.Errorf("Anonymous = %+v, want %+v", cfg.Anonymous, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateConfigSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		updated string
+		want    string
+	}{
+		{"deny", SymlinksDeny, SymlinksDeny},
+		{"default", "", ""},
+		{"unknown", "confined", SymlinksConfine},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+			os.Mkdir(tmpDir, 0700)
+			defer os.RemoveAll(tmpDir)
+
+			cfg := &Config{Dir: tmpDir, Symlinks: SymlinksConfine}
+			updateConfig(cfg, &Config{Dir: tmpDir, Symlinks: tt.updated})
+			if cfg.Symlinks != tt.want {
+				t.Errorf("Symlinks = %q, want %q", cfg.Symlinks, tt.want)
+			}
+		})
+	}
+}
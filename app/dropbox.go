@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+// dropbox returns the physical root of the drop box which contains the physical path.
+// Drop boxes don't apply to their owners.
+func (d Dir) dropbox(ctx context.Context, physical string) (string, bool) {
+	username := d.resolveUser(ctx)
+	for _, box := range d.Config.Dropboxes {
+		if box == nil || (username != "" && containsString(box.Owners, username)) {
+			continue
+		}
+
+		root := d.physical(box.Path)
+		if physical == root || strings.HasPrefix(physical, root+string(filepath.Separator)) {
+			return root, true
+		}
+	}
+
+	return "", false
+}
+
+// containsDropbox returns whether the physical path is or contains a drop box which
+// applies to the current user.
+func (d Dir) containsDropbox(ctx context.Context, physical string) bool {
+	if _, ok := d.dropbox(ctx, physical); ok {
+		return true
+	}
+
+	username := d.resolveUser(ctx)
+	for _, box := range d.Config.Dropboxes {
+		if box == nil || (username != "" && containsString(box.Owners, username)) {
+			continue
+		}
+		if strings.HasPrefix(d.physical(box.Path), physical+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsUpload returns whether the name points to a new file within a drop box.
+func (d Dir) acceptsUpload(ctx context.Context, name string) bool {
+	physical := d.resolve(ctx, name)
+	if physical == "" {
+		return false
+	}
+	root, ok := d.dropbox(ctx, physical)
+
+	return ok && physical != root
+}
+
+// dropboxDir hides the content of a drop box directory.
+type dropboxDir struct {
+	webdav.File
+}
+
+// Readdir always returns an empty directory.
+func (dropboxDir) Readdir(count int) ([]os.FileInfo, error) {
+	if count > 0 {
+		return nil, io.EOF
+	}
+
+	return []os.FileInfo{}, nil
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestDirDropbox(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/a/inbox", Owners: []string{"admin"}}}
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "a", "inbox"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "a", "inbox", "existing"), []byte("content"), 0600)
+
+	ctx := context.Background()
+	admin := context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	user1 := context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	d := Dir{Config: config}
+
+	tests := []struct {
+		name    string
+		op      func() error
+		wantErr bool
+	}{
+		{"create new file", func() error {
+			return openClose(d.OpenFile(user1, "/a/inbox/new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600))
+		}, false},
+		{"overwrite file", func() error {
+			return openClose(d.OpenFile(user1, "/a/inbox/new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600))
+		}, true},
+		{"read file", func() error { return openClose(d.OpenFile(user1, "/a/inbox/existing", os.O_RDONLY, 0)) }, true},
+		{"stat file", func() error { _, err := d.Stat(user1, "/a/inbox/existing"); return err }, true},
+		{"stat drop box", func() error { _, err := d.Stat(user1, "/a/inbox"); return err }, false},
+		{"mkdir", func() error { return d.Mkdir(user1, "/a/inbox/dir", 0700) }, true},
+		{"delete file", func() error { return d.RemoveAll(user1, "/a/inbox/existing") }, true},
+		{"delete parent", func() error { return d.RemoveAll(user1, "/a") }, true},
+		{"rename out", func() error { return d.Rename(user1, "/a/inbox/existing", "/stolen") }, true},
+		{"owner reads", func() error { return openClose(d.OpenFile(admin, "/subdir1/a/inbox/existing", os.O_RDONLY, 0)) }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op(); (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	f, err := d.OpenFile(user1, "/a/inbox", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Dir.OpenFile() error = %v", err)
+	}
+	defer f.Close()
+	if infos, err := f.Readdir(0); err != nil || len(infos) != 0 {
+		t.Errorf("Readdir() = %v, %v, want empty directory", infos, err)
+	}
+}
+
+func TestHandleAnonymousDropbox(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Anonymous = Anonymous{Enabled: true, Subdir: "/public"}
+	config.Dropboxes = []*Dropbox{{Path: "/public/inbox"}}
+	os.MkdirAll(filepath.Join(tmpDir, "public", "inbox"), 0700)
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		statusCode int
+	}{
+		{"upload into drop box", "PUT", "/inbox/report.log", 201},
+		{"upload outside drop box", "PUT", "/report.log", 401},
+		{"download from drop box", "GET", "/inbox/report.log", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, httptest.NewRequest(tt.method, tt.path, strings.NewReader("log")), a)
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+		})
+	}
+}
+
+func openClose(f webdav.File, err error) error {
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
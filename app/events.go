@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of file events.
+const (
+	EventCreate    = "create"
+	EventOverwrite = "overwrite"
+	EventDelete    = "delete"
+	EventRename    = "rename"
+	EventMkdir     = "mkdir"
+)
+
+// Event describes a change of a file or directory. Paths are slash separated and
+// relative to the base dir of the configuration.
+type Event struct {
+	Type     string    `json:"event"`
+	Path     string    `json:"path"`
+	NewPath  string    `json:"newPath,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Size     *int64    `json:"size,omitempty"`
+	IsDir    bool      `json:"isDir"`
+	Time     time.Time `json:"time"`
+	External bool      `json:"external,omitempty"`
+}
+
+// EventBus distributes file events to all of its subscribers.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[int]func(Event)
+	next        int
+}
+
+// NewEventBus creates an event bus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]func(Event))}
+}
+
+// Subscribe registers a function receiving all published events. Subscribers are called
+// synchronously and must not block. The returned function removes the subscription.
+func (b *EventBus) Subscribe(fn func(Event)) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Publish hands the event to all subscribers.
+func (b *EventBus) Publish(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, fn := range b.subscribers {
+		fn(e)
+	}
+}
+
+// ForUser translates the paths of the event to the view of the given user. The second
+// return value is false if the user can't see the affected files. Like in listings and
+// search results, hidden files and the content of drop boxes are never visible. Without
+// a username, all drop boxes apply.
+func (e Event) ForUser(config *Config, username string) (Event, bool) {
+	oldPath, oldOk := config.userPath(username, e.Path)
+	oldOk = oldOk && config.visible(username, e.Path)
+	newPath, newOk := "", false
+	if e.NewPath != "" {
+		newPath, newOk = config.userPath(username, e.NewPath)
+		newOk = newOk && config.visible(username, e.NewPath)
+	}
+
+	switch {
+	case e.NewPath == "" || (oldOk && newOk):
+		e.Path, e.NewPath = oldPath, newPath
+		return e, oldOk
+	case oldOk:
+		// moved out of the users view
+		e.Type, e.Path, e.NewPath = EventDelete, oldPath, ""
+		return e, true
+	case newOk:
+		// moved into the users view
+		e.Type, e.Path, e.NewPath = EventCreate, newPath, ""
+		return e, true
+	}
+
+	return e, false
+}
+
+// userPath translates a path relative to the base dir to the path seen by the user.
+func (cfg *Config) userPath(username, rel string) (string, bool) {
+	userInfo := cfg.Users[username]
+	if userInfo == nil || userInfo.Subdir == nil {
+		return rel, true
+	}
+
+	root := path.Clean("/" + *userInfo.Subdir)
+	switch {
+	case root == "/":
+		return rel, true
+	case rel == root:
+		return "/", true
+	case strings.HasPrefix(rel, root+"/"):
+		return strings.TrimPrefix(rel, root), true
+	}
+
+	return "", false
+}
+
+// visible returns whether a user may see a path relative to the base dir. Hidden files
+// and files within drop boxes which the user doesn't own aren't visible.
+func (cfg *Config) visible(username, rel string) bool {
+	if hiddenPath(cfg.Hidden.Patterns, rel) {
+		return false
+	}
+	for _, box := range cfg.Dropboxes {
+		if box == nil || (username != "" && containsString(box.Owners, username)) {
+			continue
+		}
+		root := path.Clean("/" + box.Path)
+		if rel != root && strings.HasPrefix(rel, strings.TrimSuffix(root, "/")+"/") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// publish completes the event with the current user and time and publishes it, if an
+// event bus is configured.
+func (d Dir) publish(ctx context.Context, e Event) {
+	if d.Events == nil {
+		return
+	}
+
+	e.User = d.resolveUser(ctx)
+	e.Time = time.Now()
+	d.Events.Publish(e)
+}
+
+// relative converts a physical path to a slash separated path relative to the base dir.
+func (d Dir) relative(physical string) string {
+	dir := d.Config.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	rel, err := filepath.Rel(dir, physical)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	if rel == "." {
+		return "/"
+	}
+
+	return "/" + filepath.ToSlash(rel)
+}
+
+// physical converts a slash separated path relative to the base dir to a physical path.
+func (d Dir) physical(rel string) string {
+	dir := d.Config.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+rel)))
+}
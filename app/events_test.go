@@ -0,0 +1,46 @@
+package app
+
+import (
+	"testing"
+)
+
+func TestEventForUser(t *testing.T) {
+	config := createTestConfig("/tmp")
+	config.Hidden.Patterns = []string{".git"}
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox", Owners: []string{"admin"}}}
+
+	tests := []struct {
+		name        string
+		event       Event
+		user        string
+		want        Event
+		wantVisible bool
+	}{
+		{"admin sees all", Event{Type: EventCreate, Path: "/subdir1/a"}, "admin", Event{Type: EventCreate, Path: "/subdir1/a"}, true},
+		{"user sees own", Event{Type: EventCreate, Path: "/subdir1/a"}, "user1", Event{Type: EventCreate, Path: "/a"}, true},
+		{"user root", Event{Type: EventMkdir, Path: "/subdir1"}, "user1", Event{Type: EventMkdir, Path: "/"}, true},
+		{"user doesn't see others", Event{Type: EventCreate, Path: "/subdir2/a"}, "user1", Event{}, false},
+		{"prefix of other dir", Event{Type: EventCreate, Path: "/subdir10/a"}, "user1", Event{}, false},
+		{"rename within", Event{Type: EventRename, Path: "/subdir1/a", NewPath: "/subdir1/b"}, "user1", Event{Type: EventRename, Path: "/a", NewPath: "/b"}, true},
+		{"rename out of view", Event{Type: EventRename, Path: "/subdir1/a", NewPath: "/subdir2/b"}, "user1", Event{Type: EventDelete, Path: "/a"}, true},
+		{"rename into view", Event{Type: EventRename, Path: "/subdir2/a", NewPath: "/subdir1/b"}, "user1", Event{Type: EventCreate, Path: "/b"}, true},
+		{"hidden file", Event{Type: EventCreate, Path: "/subdir1/.git/config"}, "admin", Event{}, false},
+		{"rename to hidden file", Event{Type: EventRename, Path: "/subdir1/a", NewPath: "/subdir1/.git"}, "user1", Event{Type: EventDelete, Path: "/a"}, true},
+		{"drop box upload", Event{Type: EventCreate, Path: "/subdir1/inbox/a"}, "user1", Event{}, false},
+		{"drop box root", Event{Type: EventMkdir, Path: "/subdir1/inbox"}, "user1", Event{Type: EventMkdir, Path: "/inbox"}, true},
+		{"drop box owner", Event{Type: EventCreate, Path: "/subdir1/inbox/a"}, "admin", Event{Type: EventCreate, Path: "/subdir1/inbox/a"}, true},
+		{"drop box without user", Event{Type: EventCreate, Path: "/subdir1/inbox/a"}, "", Event{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, visible := tt.event.ForUser(config, tt.user)
+			if visible != tt.wantVisible {
+				t.Errorf("Event.ForUser() visible = %v, want %v", visible, tt.wantVisible)
+				return
+			}
+			if visible && (got.Type != tt.want.Type || got.Path != tt.want.Path || got.NewPath != tt.want.NewPath) {
+				t.Errorf("Event.ForUser() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// extractHeader requests the extraction of an uploaded archive like the extract parameter.
+	extractHeader = "X-Dave-Extract"
+	// archiveHeadroom is the size which an archive may exceed the remaining quota of the
+	// user by, for the headers and directories of the archive.
+	archiveHeadroom = 1 << 20
+)
+
+var (
+	errUnsafeArchive  = errors.New("archive contains paths outside of the target")
+	errCorruptArchive = errors.New("archive contains entries which don't match their declared size")
+)
+
+// errQuotaExceeded is returned when a write doesn't fit into the quota of the user.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// archiveEntry is a file or directory of an uploaded archive.
+type archiveEntry struct {
+	Name    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// extractResult summarizes an extracted archive.
+type extractResult struct {
+	Files       int   `json:"files"`
+	Directories int   `json:"directories"`
+	Size        int64 `json:"size"`
+}
+
+// extractRequested returns whether a PUT request uploads an archive to be extracted.
+func extractRequested(req *http.Request) bool {
+	if _, ok := req.URL.Query()["extract"]; ok {
+		return true
+	}
+
+	return strings.EqualFold(req.Header.Get(extractHeader), "true")
+}
+
+// serveExtract extracts a zip, tar or tar.gz archive uploaded with PUT into the requested
+// collection, which is created if missing. The archive is checked before anything is
+// written: paths leaving the collection are rejected, every entry has to have its declared
+// size and the extracted size has to fit into the quota of the user. Files are written
+// like uploads of single files, but moved into place only once all of them have been
+// written, so that a failed extraction leaves the collection as it was.
+func serveExtract(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, name string) {
+	d, ok := a.Handler.FileSystem.(*Dir)
+	if !ok {
+		http.Error(w, "extraction is not supported", http.StatusNotImplemented)
+		return
+	}
+	if fi, err := d.Stat(ctx, name); err == nil && !fi.IsDir() {
+		http.Error(w, "archives can be extracted into collections only", http.StatusConflict)
+		return
+	}
+
+	quota := userQuota(ctx, d.Config)
+	var used int64
+	spoolLimit := int64(-1)
+	if quota > 0 {
+		var err error
+		if used, err = d.usage(ctx); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithError(err).Error("Error computing usage")
+			return
+		}
+		spoolLimit = archiveHeadroom
+		if used < quota {
+			spoolLimit += quota - used
+		}
+	}
+
+	spool, err := spoolArchive(d.Config, req.Body, spoolLimit)
+	if err == errQuotaExceeded {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithError(err).Error("Error receiving archive")
+		return
+	}
+	defer os.Remove(spool)
+	if uploadFailed(ctx) {
+		http.Error(w, "invalid archive upload", http.StatusBadRequest)
+		return
+	}
+	// the checksums and modification time of the upload belong to the archive
+	ctx = context.WithValue(ctx, uploadKey, (*upload)(nil))
+
+	walk, err := openArchive(spool)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// the entries are read completely, so that their sizes are known before anything is
+	// written, reading stops once the declared sizes exceed the quota
+	var total int64
+	err = walk(func(e archiveEntry, r io.Reader) error {
+		if _, err := cleanArchivePath(e.Name); err != nil {
+			return err
+		}
+		if e.IsDir {
+			return nil
+		}
+		if e.Size < 0 {
+			return errCorruptArchive
+		}
+		total += e.Size
+		if quota > 0 && used+total > quota {
+			return errQuotaExceeded
+		}
+		n, err := io.Copy(ioutil.Discard, io.LimitReader(r, e.Size+1))
+		if err == nil && n != e.Size {
+			err = errCorruptArchive
+		}
+		return err
+	})
+	switch {
+	case err == errQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	target := path.Clean("/" + name)
+	x := &extraction{dir: *d, ctx: ctx}
+	var result extractResult
+	err = x.mkdirAll(target)
+	if err == nil {
+		err = walk(func(e archiveEntry, r io.Reader) error {
+			rel, _ := cleanArchivePath(e.Name)
+			if rel == "/" || internalName(rel) {
+				return nil
+			}
+			entryName := path.Join(target, rel)
+			if d.hidden(d.resolve(ctx, entryName)) {
+				return nil
+			}
+			if e.IsDir {
+				result.Directories++
+				return x.mkdirAll(entryName)
+			}
+			if err := x.mkdirAll(path.Dir(entryName)); err != nil {
+				return err
+			}
+			if err := x.writeFile(entryName, e, r); err != nil {
+				return err
+			}
+			result.Files++
+			result.Size += e.Size
+			return nil
+		})
+	}
+	if err == nil {
+		err = x.commit()
+	}
+	if err != nil {
+		x.rollback()
+		writeFileError(w, err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"path":  target,
+		"user":  d.resolveUser(ctx),
+		"files": result.Files,
+	}).Info("Extracted archive")
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// spoolArchive stores an uploaded archive in the uploads dir, because zip archives can't
+// be read as a stream and archives are read twice. Archives longer than a limit of 0 or
+// more are rejected with errQuotaExceeded.
+func spoolArchive(config *Config, r io.Reader, limit int64) (string, error) {
+	dir := uploadsDir(config)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, "extract-")
+	if err != nil {
+		return "", err
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && limit >= 0 && n > limit {
+		err = errQuotaExceeded
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+// archiveWalker calls fn for every entry of an archive. The reader returns the content
+// of files.
+type archiveWalker func(fn func(e archiveEntry, r io.Reader) error) error
+
+// openArchive detects the format of a spooled archive and returns a walker of its
+// entries. Links and special files are skipped.
+func openArchive(name string) (archiveWalker, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	head = head[:n]
+
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return walkZip(name), nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return walkTar(name, true), nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return walkTar(name, false), nil
+	}
+
+	return nil, fmt.Errorf("unsupported archive format")
+}
+
+func walkZip(name string) archiveWalker {
+	return func(fn func(e archiveEntry, r io.Reader) error) error {
+		zr, err := zip.OpenReader(name)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, f := range zr.File {
+			mode := f.Mode()
+			if !mode.IsDir() && !mode.IsRegular() {
+				continue
+			}
+			e := archiveEntry{Name: f.Name, IsDir: mode.IsDir(), Size: int64(f.UncompressedSize64), ModTime: f.Modified}
+			if e.IsDir {
+				if err := fn(e, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(e, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func walkTar(name string, gzipped bool) archiveWalker {
+	return func(fn func(e archiveEntry, r io.Reader) error) error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		var r io.Reader = f
+		if gzipped {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+
+		tr := tar.NewReader(r)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			switch h.Typeflag {
+			case tar.TypeDir:
+				err = fn(archiveEntry{Name: h.Name, IsDir: true, ModTime: h.ModTime}, nil)
+			case tar.TypeReg, tar.TypeRegA:
+				err = fn(archiveEntry{Name: h.Name, Size: h.Size, ModTime: h.ModTime}, tr)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// cleanArchivePath cleans the name of an archive entry like Dir.resolve cleans names,
+// but rejects names which would leave the target instead of clamping them to it.
+func cleanArchivePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.Contains(name, "\x00") || path.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", errUnsafeArchive
+	}
+	if clean := path.Clean(name); clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", errUnsafeArchive
+	}
+
+	return path.Clean("/" + name), nil
+}
+
+// extraction writes the entries of an archive. Files are written to temporary files,
+// which are moved into place by commit. rollback removes the temporary files and the
+// directories which have been created.
+type extraction struct {
+	dir     Dir
+	ctx     context.Context
+	created []string
+	staged  []stagedFile
+}
+
+// stagedFile is a file of an archive which has been written to a temporary file.
+type stagedFile struct {
+	f       *file
+	name    string
+	modTime time.Time
+}
+
+// mkdirAll creates a directory and its missing parents.
+func (x *extraction) mkdirAll(name string) error {
+	current := "/"
+	for _, element := range strings.Split(strings.Trim(name, "/"), "/") {
+		if element == "" {
+			continue
+		}
+		current = path.Join(current, element)
+		err := x.dir.Mkdir(x.ctx, current, 0755)
+		if err == nil {
+			x.created = append(x.created, current)
+			continue
+		}
+		if fi, serr := x.dir.Stat(x.ctx, current); serr != nil || !fi.IsDir() {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes a file of an archive to a temporary file next to it.
+func (x *extraction) writeFile(name string, e archiveEntry, r io.Reader) error {
+	f, err := x.dir.OpenFile(x.ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, e.Size))
+	if err == nil && n != e.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	wf, ok := f.(*file)
+	if err != nil {
+		// a failed write leaves the previous file in place
+		if ok {
+			wf.failed = true
+		}
+		f.Close()
+		return err
+	}
+	if !ok || wf.tmp == "" {
+		return f.Close()
+	}
+	if err := wf.finish(); err != nil {
+		return err
+	}
+	x.staged = append(x.staged, stagedFile{f: wf, name: name, modTime: e.ModTime})
+
+	return nil
+}
+
+// commit moves the written files into place and applies their modification times.
+func (x *extraction) commit() error {
+	for len(x.staged) > 0 {
+		s := x.staged[0]
+		x.staged = x.staged[1:]
+		if err := s.f.commit(); err != nil {
+			return err
+		}
+		if !s.modTime.IsZero() {
+			if err := x.dir.setModTime(x.ctx, x.dir.resolve(x.ctx, s.name), s.modTime); err != nil {
+				log.WithField("path", s.name).WithError(err).Warn("Error setting modification time")
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollback removes the files which haven't been moved into place and the directories
+// which have been created and are still empty.
+func (x *extraction) rollback() {
+	for _, s := range x.staged {
+		x.dir.remove(x.ctx, s.f.tmp)
+	}
+	x.staged = nil
+	for i := len(x.created) - 1; i >= 0; i-- {
+		if physical := x.dir.resolve(x.ctx, x.created[i]); physical != "" {
+			x.dir.remove(x.ctx, physical)
+		}
+	}
+	x.created = nil
+}
+
+// userQuota returns the quota of the user of a request in bytes, 0 if unlimited.
+func userQuota(ctx context.Context, config *Config) int64 {
+	authInfo := AuthFromContext(ctx)
+	if authInfo == nil || !authInfo.Authenticated {
+		return 0
+	}
+	if userInfo := config.Users[authInfo.Username]; userInfo != nil {
+		return userInfo.Quota
+	}
+
+	return 0
+}
+
+// usage returns the size of the files in the tree of the user.
+func (d Dir) usage(ctx context.Context) (int64, error) {
+	var size int64
+	err := filepath.Walk(d.resolve(ctx, "/"), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !isInternal(p) {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
@@ -0,0 +1,224 @@
+package app
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestCleanArchivePath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"docs/readme.md", "/docs/readme.md", false},
+		{"./docs//a/../readme.md", "/docs/readme.md", false},
+		{"docs/", "/docs", false},
+		{"../etc/passwd", "", true},
+		{"docs/../../etc/passwd", "", true},
+		{"..\\etc\\passwd", "", true},
+		{"/etc/passwd", "", true},
+		{"a\x00b", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanArchivePath(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cleanArchivePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("cleanArchivePath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeExtract(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "file.txt"), []byte("file"), 0600)
+
+	modified := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	zipArchive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, content := range files {
+			fw, _ := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+			fw.Write([]byte(content))
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+	tarArchive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		tw.WriteHeader(&tar.Header{Name: "docs/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modified})
+		tw.WriteHeader(&tar.Header{Name: "docs/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"})
+		for name, content := range files {
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), ModTime: modified})
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	config := createTestConfig(tmpDir)
+	config.Uploads.Dir = filepath.Join(tmpDir, "uploads")
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox"}}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		name       string
+		target     string
+		body       []byte
+		header     bool
+		quota      int64
+		statusCode int
+		want       map[string]string
+	}{
+		{"zip", "/import?extract", zipArchive(map[string]string{"a.txt": "a", "docs/b.txt": "bb"}), false, 0, 201,
+			map[string]string{"import/a.txt": "a", "import/docs/b.txt": "bb"}},
+		{"tar.gz", "/import/tar", tarArchive(map[string]string{"docs/c.txt": "ccc"}), true, 0, 201,
+			map[string]string{"import/tar/docs/c.txt": "ccc"}},
+		{"zip slip", "/slip?extract", zipArchive(map[string]string{"ok.txt": "ok", "../../evil.txt": "evil"}), false, 0, 400, nil},
+		{"quota exceeded", "/quota?extract", zipArchive(map[string]string{"big.txt": "0123456789"}), false, 15, 507, nil},
+		{"within quota", "/quota?extract", zipArchive(map[string]string{"small.txt": "0"}), false, 1000, 201,
+			map[string]string{"quota/small.txt": "0"}},
+		{"no archive", "/plain?extract", []byte("just text"), false, 0, 415, nil},
+		{"into file", "/file.txt?extract", zipArchive(map[string]string{"a.txt": "a"}), false, 0, 409, nil},
+		{"into drop box", "/inbox?extract", zipArchive(map[string]string{"a.txt": "a"}), false, 0, 201, nil},
+		{"overwrite in drop box", "/inbox?extract", zipArchive(map[string]string{"a.txt": "b"}), false, 0, 409, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Users["user1"].Quota = tt.quota
+			r := httptest.NewRequest("PUT", tt.target, bytes.NewReader(tt.body))
+			if tt.header {
+				r.Header.Set(extractHeader, "true")
+			}
+			w := httptest.NewRecorder()
+			serve(user1, w, r, a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+			for name, content := range tt.want {
+				physical := filepath.Join(tmpDir, "subdir1", filepath.FromSlash(name))
+				got, err := ioutil.ReadFile(physical)
+				if err != nil || string(got) != content {
+					t.Errorf("%s = %q (%v), want %q", name, got, err, content)
+				}
+				if fi, err := os.Stat(physical); err != nil || !fi.ModTime().Equal(modified) {
+					t.Errorf("mtime of %s = %v, want %v", name, fi.ModTime(), modified)
+				}
+			}
+		})
+	}
+
+	for _, name := range []string{"evil.txt", "slip", "quota/big.txt", "import/tar/docs/link"} {
+		if _, err := os.Lstat(filepath.Join(tmpDir, "subdir1", name)); err == nil {
+			t.Errorf("%s exists, want it not to be extracted", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "evil.txt")); err == nil {
+		t.Errorf("evil.txt exists outside of the users tree")
+	}
+	if infos, _ := ioutil.ReadDir(config.Uploads.Dir); len(infos) != 0 {
+		t.Errorf("%d spooled archives left, want 0", len(infos))
+	}
+}
+
+func TestServeExtractFailures(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "target"), 0700)
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "target", "keep.txt"), []byte("old"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "target", "blocker"), []byte("file"), 0600)
+
+	type entry struct {
+		name, content string
+		size          uint64
+	}
+	zipArchive := func(entries ...entry) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			fw, _ := zw.CreateRaw(&zip.FileHeader{
+				Name:               e.name,
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE([]byte(e.content)),
+				CompressedSize64:   uint64(len(e.content)),
+				UncompressedSize64: e.size,
+			})
+			fw.Write([]byte(e.content))
+		}
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	config := createTestConfig(tmpDir)
+	config.Uploads.Dir = filepath.Join(tmpDir, "uploads")
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		name       string
+		body       []byte
+		quota      int64
+		statusCode int
+	}{
+		{"entry longer than declared", zipArchive(entry{"a.txt", "0123456789", 1}), 100, 400},
+		{"entry shorter than declared", zipArchive(entry{"a.txt", "abc", 1000}), 0, 400},
+		{"spool exceeding quota", bytes.Repeat([]byte("x"), archiveHeadroom+100), 50, 507},
+		{"failure after written files", zipArchive(entry{"keep.txt", "new", 3}, entry{"new/a.txt", "a", 1}, entry{"blocker/b.txt", "b", 1}), 0, 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Users["user1"].Quota = tt.quota
+			r := httptest.NewRequest("PUT", "/target?extract", bytes.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			serve(user1, w, r, a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+
+			infos, _ := ioutil.ReadDir(filepath.Join(tmpDir, "subdir1", "target"))
+			var names []string
+			for _, fi := range infos {
+				names = append(names, fi.Name())
+			}
+			if len(names) != 2 || names[0] != "blocker" || names[1] != "keep.txt" {
+				t.Errorf("target contains %v, want [blocker keep.txt]", names)
+			}
+			if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "target", "keep.txt")); string(b) != "old" {
+				t.Errorf("keep.txt = %q, want %q", b, "old")
+			}
+		})
+	}
+
+	if infos, _ := ioutil.ReadDir(config.Uploads.Dir); len(infos) != 0 {
+		t.Errorf("%d spooled archives left, want 0", len(infos))
+	}
+}
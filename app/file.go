@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"encoding/xml"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// file wraps the *os.File returned by Dir.OpenFile for writing, so that the Dir is able
+// to complete the operation once the client closes the file. If tmp is set, the content
+// is written to that temporary file, which replaces the file at path on Close.
+type file struct {
+	f         *os.File
+	dir       Dir
+	ctx       context.Context
+	name      string
+	path      string
+	tmp       string
+	exclusive bool
+	created   bool
+	written   bool
+	failed    bool
+	mtimeSet  bool
+}
+
+// Close closes the file and notifies the Dir if the content has been modified. A
+// temporary file is moved into place unless writing it failed.
+func (f *file) Close() error {
+	if err := f.finish(); err != nil {
+		return err
+	}
+
+	return f.commit()
+}
+
+// finish closes the file. A temporary file is removed if writing it failed, otherwise
+// it's kept until commit moves it into place.
+func (f *file) finish() error {
+	f.applyMtime()
+	var err error
+	if f.written && f.dir.Config.Writes.Fsync != "" && f.dir.Config.Writes.Fsync != FsyncNone {
+		err = f.f.Sync()
+	}
+	if closeErr := f.f.Close(); err == nil {
+		err = closeErr
+	}
+	if f.tmp != "" {
+		if u := uploadFromContext(f.ctx); err == nil && u != nil && u.mismatch() {
+			err = errChecksumMismatch
+		}
+		if err == nil && (f.failed || uploadFailed(f.ctx)) {
+			err = errIncompleteWrite
+		}
+		if err != nil {
+			f.dir.remove(f.ctx, f.tmp)
+		}
+	}
+
+	return err
+}
+
+// commit moves the temporary file of a finished file into place and notifies the Dir if
+// the content has been modified.
+func (f *file) commit() error {
+	if f.tmp != "" {
+		if err := f.dir.replace(f.ctx, f.tmp, f.path, f.exclusive); err != nil {
+			f.dir.remove(f.ctx, f.tmp)
+			return err
+		}
+	}
+
+	if f.written {
+		// the checksums of an upload are known if it replaced the whole file
+		var sums map[string]string
+		if u := uploadFromContext(f.ctx); u != nil && f.tmp != "" {
+			sums = u.sums()
+		}
+		f.dir.fileWritten(f.ctx, f.name, f.path, f.created, sums)
+	}
+
+	return nil
+}
+
+// Read delegates to os.File.Read
+func (f *file) Read(p []byte) (int, error) {
+	return f.f.Read(p)
+}
+
+// Seek delegates to os.File.Seek
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	return f.f.Seek(offset, whence)
+}
+
+// Readdir delegates to os.File.Readdir
+func (f *file) Readdir(count int) ([]os.FileInfo, error) {
+	return f.f.Readdir(count)
+}
+
+// Stat delegates to os.File.Stat. The modification time of an upload is applied first,
+// since the webdav handler answers uploads with the ETag of this stat.
+func (f *file) Stat() (os.FileInfo, error) {
+	f.applyMtime()
+	return f.f.Stat()
+}
+
+// applyMtime sets the modification time sent with the upload on the written file.
+func (f *file) applyMtime() {
+	u := uploadFromContext(f.ctx)
+	if f.mtimeSet || !f.written || isInternal(f.path) || u == nil || u.mtime.IsZero() {
+		return
+	}
+	f.mtimeSet = true
+	if err := setFileTimes(f.f, time.Now(), u.mtime); err != nil {
+		log.WithField("path", f.path).WithError(err).Warn("Can't set modification time")
+	}
+}
+
+// Write delegates to os.File.Write and marks the file as modified.
+func (f *file) Write(p []byte) (int, error) {
+	f.written, f.mtimeSet = true, false
+	n, err := f.f.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+
+	return n, err
+}
+
+// DeadProps returns the dead properties of the file.
+func (f *file) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.dir.deadProps(f.path)
+}
+
+// Patch modifies the dead properties of the file.
+func (f *file) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	return f.dir.patchProps(f.f, f.path, patches)
+}
+
+// metaFile wraps the *os.File returned by Dir.OpenFile for reading, so that the metadata
+// kept in the store is available as dead properties. Directories are returned as
+// writable metaFile when opened for writing, so that their properties can be patched.
+type metaFile struct {
+	*os.File
+	dir      Dir
+	ctx      context.Context
+	path     string
+	writable bool
+}
+
+// Readdir delegates to os.File.Readdir and drops the hidden entries like filteredDir.
+func (f *metaFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	return f.dir.visible(f.ctx, f.path, infos), err
+}
+
+// DeadProps returns the dead properties of the file.
+func (f *metaFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	return f.dir.deadProps(f.path)
+}
+
+// Patch modifies the dead properties of a writable file and rejects all changes
+// otherwise.
+func (f *metaFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	if !f.writable {
+		return forbidProps(patches), nil
+	}
+
+	return f.dir.patchProps(f.File, f.path, patches)
+}
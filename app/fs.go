@@ -8,6 +8,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 // This file is an extension of golang.org/x/net/webdav/file.go.
@@ -15,7 +16,11 @@ import (
 // Dir is specialization of webdav.Dir with respect of an authenticated
 // user to allow configuration access.
 type Dir struct {
-	Config *Config
+	Config   *Config
+	Audit    *AuditLog
+	Events   *EventBus
+	Meta     *MetaStore
+	Throttle *Throttle
 }
 
 func (d Dir) resolveUser(ctx context.Context) string {
@@ -29,8 +34,18 @@ func (d Dir) resolveUser(ctx context.Context) string {
 
 // resolve tries to gain authentication information and suffixes the BaseDir with the
 // username of the authentication information. If none authentication information can
-// achieved during the process, the BaseDir is used
+// achieved during the process, the BaseDir is used. Names of the internal files of dave
+// can't be resolved, so clients can't read or write them.
 func (d Dir) resolve(ctx context.Context, name string) string {
+	if internalName(name) {
+		return ""
+	}
+
+	return d.resolveInternal(ctx, name)
+}
+
+// resolveInternal resolves a name like resolve, including the internal files of dave.
+func (d Dir) resolveInternal(ctx context.Context, name string) string {
 	// This implementation is based on Dir.Open's code in the standard net/http package.
 	if filepath.Separator != '/' && strings.IndexRune(name, filepath.Separator) >= 0 ||
 		strings.Contains(name, "\x00") {
@@ -41,6 +56,13 @@ func (d Dir) resolve(ctx context.Context, name string) string {
 		dir = "."
 	}
 
+	if isAnonymous(ctx) {
+		if !d.Config.Anonymous.valid() {
+			return ""
+		}
+		return filepath.Join(dir, d.Config.Anonymous.Subdir, filepath.FromSlash(path.Clean("/"+name)))
+	}
+
 	// Second barrier after basic auth process
 	authInfo := AuthFromContext(ctx)
 	if authInfo != nil && authInfo.Authenticated {
@@ -53,15 +75,34 @@ func (d Dir) resolve(ctx context.Context, name string) string {
 	return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+name)))
 }
 
+// readOnly returns whether the current request must not modify any files.
+func (d Dir) readOnly(ctx context.Context) bool {
+	return isAnonymous(ctx)
+}
+
 // Mkdir resolves the physical file and delegates this to an os.Mkdir execution
 func (d Dir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	virtual := name
 	if name = d.resolve(ctx, name); name == "" {
 		return os.ErrNotExist
 	}
-	err := os.Mkdir(name, perm)
+	if _, inBox := d.dropbox(ctx, name); inBox || d.readOnly(ctx) {
+		return os.ErrPermission
+	}
+	if err := d.checkSymlinks(ctx, name, false); err != nil {
+		return err
+	}
+	if d.hidden(name) {
+		if d.discardHidden() {
+			return nil
+		}
+		return os.ErrPermission
+	}
+	err := d.mkdir(ctx, name, perm)
 	if err != nil {
 		return err
 	}
+	d.removeMeta(name)
 
 	if d.Config.Log.Create {
 		log.WithFields(log.Fields{
@@ -70,15 +111,73 @@ func (d Dir) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
 		}).Info("Created directory")
 	}
 
+	d.audit(ctx, &AuditRecord{Operation: AuditMkdir, Path: virtual, Physical: name})
+	d.publish(ctx, Event{Type: EventMkdir, Path: d.relative(name), IsDir: true})
+
 	return err
 }
 
 // OpenFile resolves the physical file and delegates this to an os.OpenFile execution
 func (d Dir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	virtual := name
 	if name = d.resolve(ctx, name); name == "" {
 		return nil, os.ErrNotExist
 	}
-	f, err := os.OpenFile(name, flag, perm)
+	if err := d.checkSymlinks(ctx, name, true); err != nil {
+		return nil, err
+	}
+
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	creating := flag&os.O_CREATE != 0
+	box, inBox := d.dropbox(ctx, name)
+	switch {
+	case inBox && name == box:
+		// the drop box itself can be opened for reading only and appears empty
+		if writing || creating {
+			return nil, os.ErrPermission
+		}
+	case inBox:
+		// within a drop box, new files can be created only
+		if !writing || !creating {
+			return nil, os.ErrPermission
+		}
+		flag |= os.O_EXCL
+	case (writing || creating) && d.readOnly(ctx):
+		return nil, os.ErrPermission
+	}
+	if d.hidden(name) {
+		switch {
+		case !writing || !creating:
+			return nil, os.ErrNotExist
+		case d.discardHidden():
+			return &discardFile{name: virtual}, nil
+		}
+		return nil, os.ErrPermission
+	}
+	var existing os.FileInfo
+	if writing {
+		existing, _ = d.stat(ctx, name)
+	}
+
+	// files which are replaced completely are written to a temporary file, which is
+	// moved into place once it has been closed
+	atomic := writing && flag&os.O_TRUNC != 0 && !isInternal(name)
+	// directories are opened for writing to patch their dead properties only
+	dirProps := writing && !creating && existing != nil && existing.IsDir() && d.Meta != nil
+	var f *os.File
+	var err error
+	switch {
+	case dirProps:
+		f, err = d.openFile(ctx, name, os.O_RDONLY, 0)
+	case atomic && existing != nil && existing.IsDir():
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	case atomic && existing != nil && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case atomic:
+		f, err = d.createTemp(ctx, name, existing, perm)
+	default:
+		f, err = d.openFile(ctx, name, flag, perm)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -90,52 +189,190 @@ func (d Dir) OpenFile(ctx context.Context, name string, flag int, perm os.FileMo
 		}).Info("Opened file")
 	}
 
-	return f, nil
+	if inBox && name == box {
+		return dropboxDir{f}, nil
+	}
+	if dirProps {
+		return &metaFile{File: f, dir: d, ctx: ctx, path: name, writable: true}, nil
+	}
+	if creating && existing == nil {
+		// drop metadata left behind by files removed outside of dave
+		d.removeMeta(name)
+	}
+
+	if writing {
+		wf := &file{
+			f:       f,
+			dir:     d,
+			ctx:     ctx,
+			name:    virtual,
+			path:    name,
+			created: existing == nil,
+			written: existing == nil || flag&os.O_TRUNC != 0,
+		}
+		if atomic {
+			wf.tmp, wf.exclusive = f.Name(), flag&os.O_EXCL != 0
+		}
+		return wf, nil
+	}
+
+	if d.Meta != nil {
+		return &metaFile{File: f, dir: d, ctx: ctx, path: name}, nil
+	}
+
+	return filteredDir{File: f, dir: d, ctx: ctx, path: name}, nil
+}
+
+// fileWritten is called after a file opened for writing has been modified and closed.
+// Temporary files are ignored until they are moved into place. The checksums of the new
+// content are cached, if known. The file is examined beneath the root of the user and a
+// symlink which replaced it isn't followed.
+func (d Dir) fileWritten(ctx context.Context, name, physical string, created bool, sums map[string]string) {
+	if isInternal(physical) {
+		return
+	}
+
+	fi, err := d.lstat(ctx, physical)
+	if err != nil || !fi.Mode().IsRegular() {
+		fi = nil
+	}
+	if d.Meta != nil && fi != nil {
+		d.storeChecksums(physical, sums, fi)
+	}
+	d.removePreviews(physical)
+
+	op, eventType := AuditUpdate, EventOverwrite
+	if created {
+		op, eventType = AuditCreate, EventCreate
+	}
+
+	if d.Audit != nil {
+		size, hash := d.auditFile(ctx, physical)
+		d.audit(ctx, &AuditRecord{Operation: op, Path: name, Physical: physical, Size: size, SHA256: hash})
+	}
+
+	if d.Events != nil {
+		var size *int64
+		if fi != nil {
+			s := fi.Size()
+			size = &s
+		}
+		d.publish(ctx, Event{Type: eventType, Path: d.relative(physical), Size: size})
+	}
 }
 
 // RemoveAll resolves the physical file and delegates this to an os.RemoveAll execution
 func (d Dir) RemoveAll(ctx context.Context, name string) error {
+	virtual := name
 	if name = d.resolve(ctx, name); name == "" {
 		return os.ErrNotExist
 	}
-	if name == filepath.Clean(string(d.Config.Dir)) {
-		// Prohibit removing the virtual root directory.
-		return os.ErrInvalid
+	if err := d.removable(ctx, name); err != nil {
+		return err
+	}
+
+	// a symlink is removed itself, so its target isn't examined
+	var size *int64
+	isDir := false
+	if fi, err := d.lstat(ctx, name); err == nil {
+		isDir = fi.IsDir()
+		if !isDir {
+			s := fi.Size()
+			size = &s
+		}
 	}
 
-	err := os.RemoveAll(name)
+	err := d.removeAll(ctx, name)
 	if err != nil {
 		return err
 	}
+	d.removeMeta(name)
+	d.removePreviews(name)
+	d.removed(ctx, virtual, name, size, isDir)
+
+	return nil
+}
+
+// removable returns nil if the user may remove the physical path.
+func (d Dir) removable(ctx context.Context, physical string) error {
+	if physical == filepath.Clean(string(d.Config.Dir)) {
+		// Prohibit removing the virtual root directory.
+		return os.ErrInvalid
+	}
+	if d.hidden(physical) {
+		return os.ErrNotExist
+	}
+	if d.readOnly(ctx) || d.containsDropbox(ctx, physical) {
+		return os.ErrPermission
+	}
 
+	return d.checkSymlinks(ctx, physical, false)
+}
+
+// removed logs, audits and publishes the removal of a file or directory.
+func (d Dir) removed(ctx context.Context, virtual, physical string, size *int64, isDir bool) {
 	if d.Config.Log.Delete {
 		log.WithFields(log.Fields{
-			"path": name,
+			"path": physical,
 			"user": d.resolveUser(ctx),
 		}).Info("Deleted file or directory")
 	}
 
-	return nil
+	d.audit(ctx, &AuditRecord{Operation: AuditDelete, Path: virtual, Physical: physical, Size: size})
+	d.publish(ctx, Event{Type: EventDelete, Path: d.relative(physical), Size: size, IsDir: isDir})
 }
 
-// Rename resolves the physical file and delegates this to an os.Rename execution
+// Rename resolves the physical file and delegates this to an os.Rename execution, which
+// falls back to a copy if the paths are on different file systems
 func (d Dir) Rename(ctx context.Context, oldName, newName string) error {
+	oldVirtual, newVirtual := oldName, newName
 	if oldName = d.resolve(ctx, oldName); oldName == "" {
 		return os.ErrNotExist
 	}
 	if newName = d.resolve(ctx, newName); newName == "" {
 		return os.ErrNotExist
 	}
+	if err := d.renamable(ctx, oldName, ctx, newName); err != nil {
+		return err
+	}
+
+	err := d.renamePhysical(ctx, oldName, ctx, newName)
+	if err != nil {
+		return err
+	}
+	d.renamed(ctx, oldName, ctx, newName, oldVirtual, newVirtual)
+
+	return nil
+}
+
+// renamable returns nil if the user of oldCtx may rename the physical path oldName to the
+// physical path newName of the user of newCtx.
+func (d Dir) renamable(oldCtx context.Context, oldName string, newCtx context.Context, newName string) error {
 	if root := filepath.Clean(string(d.Config.Dir)); root == oldName || root == newName {
 		// Prohibit renaming from or to the virtual root directory.
 		return os.ErrInvalid
 	}
-
-	err := os.Rename(oldName, newName)
-	if err != nil {
+	if d.hidden(oldName) {
+		return os.ErrNotExist
+	}
+	if d.readOnly(oldCtx) || d.readOnly(newCtx) || d.hidden(newName) ||
+		d.containsDropbox(oldCtx, oldName) || d.containsDropbox(newCtx, newName) {
+		return os.ErrPermission
+	}
+	if err := d.checkSymlinks(oldCtx, oldName, false); err != nil {
 		return err
 	}
 
+	return d.checkSymlinks(newCtx, newName, false)
+}
+
+// renamed updates the metadata, previews, logs, audit trail and events of a file or
+// directory which the user of ctx renamed to newName of the user of newCtx.
+func (d Dir) renamed(ctx context.Context, oldName string, newCtx context.Context, newName, oldVirtual, newVirtual string) {
+	d.moveMeta(oldName, newName)
+	d.removePreviews(oldName)
+	d.removePreviews(newName)
+
 	if d.Config.Log.Update {
 		log.WithFields(log.Fields{
 			"oldPath": oldName,
@@ -144,7 +381,23 @@ func (d Dir) Rename(ctx context.Context, oldName, newName string) error {
 		}).Info("Renamed file or directory")
 	}
 
-	return nil
+	d.audit(ctx, &AuditRecord{
+		Operation:   AuditRename,
+		Path:        oldVirtual,
+		Physical:    oldName,
+		NewPath:     newVirtual,
+		NewPhysical: newName,
+	})
+
+	if d.Events != nil {
+		fi, err := d.lstat(newCtx, newName)
+		d.publish(ctx, Event{
+			Type:    EventRename,
+			Path:    d.relative(oldName),
+			NewPath: d.relative(newName),
+			IsDir:   err == nil && fi.IsDir(),
+		})
+	}
 }
 
 // Stat resolves the physical file and delegates this to an os.Stat execution
@@ -152,5 +405,12 @@ func (d Dir) Stat(ctx context.Context, name string) (os.FileInfo, error) {
 	if name = d.resolve(ctx, name); name == "" {
 		return nil, os.ErrNotExist
 	}
-	return os.Stat(name)
+	if box, inBox := d.dropbox(ctx, name); (inBox && name != box) || d.hidden(name) {
+		// Hide the content of drop boxes and hidden files.
+		return nil, os.ErrNotExist
+	}
+	if err := d.checkSymlinks(ctx, name, true); err != nil {
+		return nil, err
+	}
+	return d.stat(ctx, name)
 }
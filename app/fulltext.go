@@ -0,0 +1,268 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxFullTextSize is the size up to which the content of files is indexed.
+	maxFullTextSize = 20 << 20
+	// maxTokenLength is the length of the longest indexed word.
+	maxTokenLength = 64
+)
+
+// textExtensions are the extensions of files which are indexed as plain text.
+var textExtensions = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".adoc": true, ".csv": true,
+	".tsv": true, ".json": true, ".xml": true, ".yaml": true, ".yml": true, ".html": true,
+	".htm": true, ".log": true, ".ini": true, ".conf": true, ".tex": true,
+}
+
+// officeParts lists the members of the zip based office formats which hold their text.
+var officeParts = map[string]*regexp.Regexp{
+	".docx": regexp.MustCompile(`^word/(document|header\d*|footer\d*|footnotes)\.xml$`),
+	".xlsx": regexp.MustCompile(`^xl/sharedStrings\.xml$`),
+	".pptx": regexp.MustCompile(`^ppt/slides/slide\d+\.xml$`),
+	".odt":  regexp.MustCompile(`^content\.xml$`),
+	".ods":  regexp.MustCompile(`^content\.xml$`),
+	".odp":  regexp.MustCompile(`^content\.xml$`),
+}
+
+// officeBreaks are the xml elements of office documents which separate words.
+var officeBreaks = map[string]bool{
+	"p": true, "h": true, "si": true, "tab": true, "br": true, "tc": true, "s": true,
+	"table-cell": true, "line-break": true,
+}
+
+// extractText returns the text content of a file, if its format is supported. The file
+// is opened beneath the root of the context, so the symlink policy applies.
+func (d Dir) extractText(ctx context.Context, physical string) (string, bool) {
+	f, err := d.openFile(ctx, physical, os.O_RDONLY, 0)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > maxFullTextSize {
+		return "", false
+	}
+	ext := strings.ToLower(path.Ext(physical))
+
+	switch {
+	case textExtensions[ext]:
+		b, err := ioutil.ReadAll(f)
+		return string(b), err == nil
+	case officeParts[ext] != nil:
+		return extractOffice(f, fi.Size(), officeParts[ext])
+	case ext == ".pdf":
+		b, err := ioutil.ReadAll(f)
+		if err != nil {
+			return "", false
+		}
+		return extractPDF(b), true
+	}
+
+	// files without a known extension are indexed if they look like text
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if !strings.HasPrefix(http.DetectContentType(head[:n]), "text/plain") {
+		return "", false
+	}
+	b, err := ioutil.ReadAll(io.MultiReader(bytes.NewReader(head[:n]), f))
+
+	return string(b), err == nil
+}
+
+// extractOffice returns the text of the xml members of a zip based office document.
+func extractOffice(f io.ReaderAt, size int64, parts *regexp.Regexp) (string, bool) {
+	r, err := zip.NewReader(f, size)
+	if err != nil {
+		return "", false
+	}
+
+	var text strings.Builder
+	for _, f := range r.File {
+		if !parts.MatchString(f.Name) || f.UncompressedSize64 > maxFullTextSize {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			continue
+		}
+		extractXMLText(rc, &text)
+		rc.Close()
+		text.WriteString(" ")
+	}
+
+	return text.String(), true
+}
+
+// extractXMLText writes the character data of an xml document to the builder.
+func extractXMLText(r io.Reader, text *strings.Builder) {
+	d := xml.NewDecoder(r)
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return
+		}
+		switch t := t.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if officeBreaks[t.Name.Local] {
+				text.WriteString(" ")
+			}
+		case xml.StartElement:
+			if officeBreaks[t.Name.Local] {
+				text.WriteString(" ")
+			}
+		}
+	}
+}
+
+var (
+	pdfStream     = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfTextObject = regexp.MustCompile(`(?s)BT(.*?)ET`)
+)
+
+// extractPDF returns the text shown by the content streams of a PDF document. Only
+// uncompressed and deflate compressed streams are supported and text is expected in
+// a single byte encoding, which covers documents generated by most office suites.
+func extractPDF(b []byte) string {
+	var text strings.Builder
+	for _, m := range pdfStream.FindAllSubmatchIndex(b, -1) {
+		dict := b[m[2]:m[3]]
+		start := m[1]
+		end := bytes.Index(b[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		data := b[start : start+end]
+
+		if bytes.Contains(dict, []byte("/Filter")) {
+			if !bytes.Contains(dict, []byte("/FlateDecode")) || bytes.Contains(dict, []byte("/DCTDecode")) {
+				continue
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			data, _ = ioutil.ReadAll(io.LimitReader(zr, maxFullTextSize))
+			zr.Close()
+		}
+
+		for _, obj := range pdfTextObject.FindAll(data, -1) {
+			extractPDFStrings(obj, &text)
+			text.WriteString(" ")
+		}
+	}
+
+	return text.String()
+}
+
+// extractPDFStrings writes the literal and hex strings of a text object to the builder.
+// Large negative offsets within TJ arrays are treated as spaces.
+func extractPDFStrings(obj []byte, text *strings.Builder) {
+	for i := 0; i < len(obj); i++ {
+		switch c := obj[i]; {
+		case c == '(':
+			depth := 1
+			for i++; i < len(obj) && depth > 0; i++ {
+				c := obj[i]
+				switch {
+				case c == '\\' && i+1 < len(obj):
+					i++
+					switch e := obj[i]; e {
+					case 'n', 'r', 't':
+						text.WriteByte(' ')
+					case '0', '1', '2', '3', '4', '5', '6', '7':
+						v := int(e - '0')
+						for k := 0; k < 2 && i+1 < len(obj) && obj[i+1] >= '0' && obj[i+1] <= '7'; k++ {
+							i++
+							v = v*8 + int(obj[i]-'0')
+						}
+						text.WriteRune(rune(v & 0xff))
+					default:
+						text.WriteByte(e)
+					}
+				case c == '(':
+					depth++
+					text.WriteByte(c)
+				case c == ')':
+					depth--
+					if depth > 0 {
+						text.WriteByte(c)
+					}
+				default:
+					text.WriteRune(rune(c))
+				}
+			}
+			i--
+		case c == '<' && i+1 < len(obj) && obj[i+1] != '<':
+			end := bytes.IndexByte(obj[i:], '>')
+			if end < 0 {
+				return
+			}
+			if s, err := hex.DecodeString(string(bytes.Join(bytes.Fields(obj[i+1:i+end]), nil))); err == nil && isPrintable(s) {
+				text.Write(s)
+			}
+			i += end
+		case c == '-' && i+1 < len(obj) && obj[i+1] >= '0' && obj[i+1] <= '9':
+			// a kerning offset in a TJ array, large ones separate words
+			j := i + 1
+			for j < len(obj) && (obj[j] >= '0' && obj[j] <= '9' || obj[j] == '.') {
+				j++
+			}
+			if j-i > 3 {
+				text.WriteByte(' ')
+			}
+			i = j - 1
+		case c == 'T' && i+1 < len(obj) && (obj[i+1] == '*' || obj[i+1] == 'd' || obj[i+1] == 'D'):
+			text.WriteByte(' ')
+		case c == '\'' || c == '"':
+			text.WriteByte(' ')
+		}
+	}
+}
+
+func isPrintable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// tokenize splits a text into the distinct lower case words used by the full-text index.
+func tokenize(text string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, f := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len([]rune(f)) < 2 || len(f) > maxTokenLength || seen[f] {
+			continue
+		}
+		seen[f] = true
+		tokens = append(tokens, f)
+	}
+	sort.Strings(tokens)
+
+	return tokens
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"# Spec\n\nThe *API* spec, v2.", []string{"api", "spec", "the", "v2"}},
+		{"Größe: 10 kB", []string{"10", "größe", "kb"}},
+		{"a b", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := tokenize(tt.text); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("tokenize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	var docx bytes.Buffer
+	zw := zip.NewWriter(&docx)
+	part, _ := zw.Create("word/document.xml")
+	part.Write([]byte(`<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Rel</w:t></w:r><w:r><w:t>ease plan</w:t></w:r></w:p><w:p><w:r><w:t>draft</w:t></w:r></w:p></w:body></w:document>`))
+	part, _ = zw.Create("word/styles.xml")
+	part.Write([]byte(`<styles>ignored</styles>`))
+	zw.Close()
+
+	var content bytes.Buffer
+	zlw := zlib.NewWriter(&content)
+	zlw.Write([]byte(`BT /F1 12 Tf (Quarterly) Tj T* [(rep) 10 (ort) -250 (\(final\))] TJ ET`))
+	zlw.Close()
+	pdf := "%PDF-1.4\n1 0 obj\n<< /Length " + strconv.Itoa(content.Len()) + " /Filter /FlateDecode >>\nstream\n" +
+		content.String() + "\nendstream\nendobj\n2 0 obj\n<< /Length 20 >>\nstream\nBT (plain) Tj ET\nendstream\nendobj\n%%EOF\n"
+
+	files := map[string][]byte{
+		"notes.md":   []byte("# Notes\nSee the *spec*."),
+		"plan.docx":  docx.Bytes(),
+		"report.pdf": []byte(pdf),
+		"README":     []byte("just some text"),
+		"image.bin":  {0x89, 'P', 'N', 'G', 0, 0, 0, 0},
+	}
+	for name, data := range files {
+		ioutil.WriteFile(filepath.Join(tmpDir, name), data, 0600)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+		want []string
+	}{
+		{"notes.md", true, []string{"notes", "see", "spec", "the"}},
+		{"plan.docx", true, []string{"draft", "plan", "release"}},
+		{"report.pdf", true, []string{"final", "plain", "quarterly", "report"}},
+		{"README", true, []string{"just", "some", "text"}},
+		{"image.bin", false, nil},
+		{"missing.txt", false, nil},
+	}
+	d := Dir{Config: createTestConfig(tmpDir)}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, ok := d.extractText(context.Background(), filepath.Join(tmpDir, tt.name))
+			if ok != tt.ok {
+				t.Fatalf("extractText() ok = %v, want %v", ok, tt.ok)
+			}
+			if got := tokenize(text); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("words = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
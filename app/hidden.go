@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// Values of the Uploads option of hidden files.
+const (
+	HiddenReject  = "reject"
+	HiddenDiscard = "discard"
+)
+
+// hidden returns whether a physical path matches a pattern of the hidden files. The
+// internal files of partial and atomic writes are never hidden.
+func (d Dir) hidden(physical string) bool {
+	if len(d.Config.Hidden.Patterns) == 0 || isInternal(physical) {
+		return false
+	}
+	rel := d.relative(physical)
+
+	return rel != "" && hiddenPath(d.Config.Hidden.Patterns, rel)
+}
+
+// discardHidden returns whether writes to hidden files are accepted and dropped instead
+// of being rejected.
+func (d Dir) discardHidden() bool {
+	return d.Config.Hidden.Uploads == HiddenDiscard
+}
+
+// hiddenPath returns whether a path relative to the base dir is hidden. Patterns without
+// a slash match the name of the file or of any of its parents, like ".git" or "*.tmp".
+// Patterns with a slash match the path relative to the base dir or any of its parents.
+func hiddenPath(patterns []string, rel string) bool {
+	rel = path.Clean("/" + rel)
+	if rel == "/" {
+		return false
+	}
+	elements := strings.Split(strings.TrimPrefix(rel, "/"), "/")
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			for _, element := range elements {
+				if ok, _ := path.Match(pattern, element); ok {
+					return true
+				}
+			}
+			continue
+		}
+		pattern = path.Clean("/" + pattern)
+		for p := rel; p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// rejectHidden answers uploads and new collections at hidden paths with 403 Forbidden,
+// unless they are discarded. The webdav handler would answer them with 404 or 405.
+func rejectHidden(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) bool {
+	if req.Method != http.MethodPut && req.Method != "MKCOL" {
+		return false
+	}
+	d, ok := a.Handler.FileSystem.(*Dir)
+	if !ok || d.discardHidden() {
+		return false
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+	if physical := d.resolve(ctx, name); physical == "" || !d.hidden(physical) {
+		return false
+	}
+
+	http.Error(w, "hidden files can't be uploaded", http.StatusForbidden)
+	return true
+}
+
+// filteredDir hides the entries of a directory which aren't visible. Files with dead
+// properties are wrapped by metaFile instead, which filters its entries the same way.
+type filteredDir struct {
+	webdav.File
+	dir  Dir
+	ctx  context.Context
+	path string
+}
+
+// Readdir drops the hidden entries.
+func (f filteredDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	return f.dir.visible(f.ctx, f.path, infos), err
+}
+
+// visible drops the entries of a directory which are internal files of dave, match the
+// patterns of the hidden files or are symlinks forbidden by the symlink policy.
+func (d Dir) visible(ctx context.Context, dir string, infos []os.FileInfo) []os.FileInfo {
+	visible := infos[:0]
+	for _, info := range infos {
+		physical := filepath.Join(dir, info.Name())
+		if isInternal(physical) || d.hidden(physical) {
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 && d.checkSymlinks(ctx, physical, true) != nil {
+			continue
+		}
+		visible = append(visible, info)
+	}
+
+	return visible
+}
+
+// discardFile accepts the content of a hidden file and drops it.
+type discardFile struct {
+	name string
+	size int64
+}
+
+func (f *discardFile) Write(p []byte) (int, error) {
+	f.size += int64(len(p))
+	return len(p), nil
+}
+
+func (f *discardFile) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (f *discardFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (f *discardFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *discardFile) Stat() (os.FileInfo, error) {
+	return discardInfo{name: path.Base(f.name), size: f.size}, nil
+}
+
+func (f *discardFile) Close() error {
+	return nil
+}
+
+// discardInfo describes a discarded file as if it had been written.
+type discardInfo struct {
+	name string
+	size int64
+}
+
+func (i discardInfo) Name() string       { return i.name }
+func (i discardInfo) Size() int64        { return i.size }
+func (i discardInfo) Mode() os.FileMode  { return 0644 }
+func (i discardInfo) ModTime() time.Time { return time.Now() }
+func (i discardInfo) IsDir() bool        { return false }
+func (i discardInfo) Sys() interface{}   { return nil }
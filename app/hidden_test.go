@@ -0,0 +1,118 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestHiddenPath(t *testing.T) {
+	patterns := []string{".git", ".DS_Store", "*.tmp", "/subdir1/private"}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/", false},
+		{"/.git", true},
+		{"/project/.git/config", true},
+		{"/project/.gitignore", false},
+		{"/docs/.DS_Store", true},
+		{"/upload.tmp", true},
+		{"/upload.tmp/file", true},
+		{"/upload.tmpl", false},
+		{"/subdir1/private", true},
+		{"/subdir1/private/file", true},
+		{"/subdir2/private", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := hiddenPath(patterns, tt.path); got != tt.want {
+				t.Errorf("hiddenPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleHidden(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["user1"].Password = GenHash([]byte("password"))
+	config.Hidden.Patterns = []string{".DS_Store", "*.tmp", ".git"}
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs", ".git"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "file"), []byte("content"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", ".DS_Store"), []byte("junk"), 0600)
+
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+
+	tests := []struct {
+		name       string
+		uploads    string
+		method     string
+		path       string
+		statusCode int
+	}{
+		{"download hidden", "", "GET", "/docs/.DS_Store", 404},
+		{"propfind hidden", "", "PROPFIND", "/docs/.git", 404},
+		{"delete hidden", "", "DELETE", "/docs/.DS_Store", 404},
+		{"upload rejected", "", "PUT", "/docs/upload.tmp", 403},
+		{"mkcol rejected", "", "MKCOL", "/.git", 403},
+		{"upload into hidden rejected", "reject", "PUT", "/docs/.git/config", 403},
+		{"upload discarded", "discard", "PUT", "/docs/upload.tmp", 201},
+		{"mkcol discarded", "discard", "MKCOL", "/.git", 201},
+		{"upload visible", "discard", "PUT", "/docs/new", 201},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Hidden.Uploads = tt.uploads
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.method == "PUT" {
+				r = httptest.NewRequest(tt.method, tt.path, strings.NewReader("content"))
+			}
+			r.SetBasicAuth("user1", "password")
+
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(tmpDir, "subdir1", "docs", "upload.tmp")); !os.IsNotExist(err) {
+		t.Errorf("discarded file exists, err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "subdir1", ".git")); !os.IsNotExist(err) {
+		t.Errorf("discarded collection exists, err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "subdir1", "docs", ".DS_Store")); err != nil {
+		t.Errorf("hidden file has been deleted, err = %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PROPFIND", "/docs/", nil)
+	r.Header.Set("Depth", "1")
+	r.SetBasicAuth("user1", "password")
+	handle(context.Background(), w, r, a)
+	if w.Code != 207 {
+		t.Fatalf("PROPFIND status = %v, want 207", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "/docs/file") || strings.Contains(body, ".DS_Store") || strings.Contains(body, ".git") {
+		t.Errorf("PROPFIND listed hidden files: %s", body)
+	}
+}
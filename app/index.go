@@ -0,0 +1,302 @@
+package app
+
+import (
+	"context"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// indexEntry is a file or directory known to the index. Paths are slash separated and
+// relative to the base dir.
+type indexEntry struct {
+	Path    string
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// ContentType returns the content type derived from the name of the entry.
+func (e *indexEntry) ContentType() string {
+	if e.IsDir {
+		return ""
+	}
+	if t := mime.TypeByExtension(path.Ext(e.Name)); t != "" {
+		return t
+	}
+
+	return "application/octet-stream"
+}
+
+// Index keeps the files and directories of the base dir in memory for searches. It is
+// built when Run is called and updated by the file events of the event bus afterwards.
+// With full-text search enabled, the words of supported documents are indexed as well.
+type Index struct {
+	dir      Dir
+	fullText bool
+	mu       sync.RWMutex
+	entries  map[string]*indexEntry
+	words    map[string][]string
+	postings map[string]map[string]struct{}
+	pending  []Event
+	queueMu  sync.Mutex
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+// NewIndex creates an empty index of the base dir.
+func NewIndex(config *Config) *Index {
+	return &Index{
+		dir:      Dir{Config: config},
+		fullText: config.Search.FullText,
+		entries:  make(map[string]*indexEntry),
+		words:    make(map[string][]string),
+		postings: make(map[string]map[string]struct{}),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Notify enqueues a file event. It is meant to be subscribed to the event bus.
+func (x *Index) Notify(e Event) {
+	x.queueMu.Lock()
+	x.pending = append(x.pending, e)
+	x.queueMu.Unlock()
+
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run builds the index and applies file events until Close is called.
+func (x *Index) Run() {
+	start := time.Now()
+	x.addTree("/")
+	log.WithField("entries", x.Len()).WithField("duration", time.Since(start)).Info("Built search index")
+
+	for {
+		x.queueMu.Lock()
+		pending := x.pending
+		x.pending = nil
+		x.queueMu.Unlock()
+
+		for _, e := range pending {
+			x.apply(e)
+		}
+
+		select {
+		case <-x.done:
+			return
+		case <-x.wake:
+		}
+	}
+}
+
+// Close stops Run.
+func (x *Index) Close() {
+	close(x.done)
+}
+
+// Len returns the number of indexed files and directories.
+func (x *Index) Len() int {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	return len(x.entries)
+}
+
+// apply updates the index according to a file event.
+func (x *Index) apply(e Event) {
+	switch e.Type {
+	case EventCreate, EventOverwrite:
+		x.addTree(e.Path)
+	case EventMkdir:
+		// directories created outside of dave may have been moved in with content
+		x.addTree(e.Path)
+	case EventDelete:
+		x.remove(e.Path)
+	case EventRename:
+		x.remove(e.Path)
+		x.addTree(e.NewPath)
+	}
+}
+
+// addTree adds a path and everything below it to the index. Symlinks are indexed like
+// their targets if the symlink policy allows to follow them within the base dir, other
+// special files are skipped.
+func (x *Index) addTree(rel string) {
+	ctx := context.Background()
+	root := x.dir.physical(rel)
+	if x.dir.checkSymlinks(ctx, root, true) != nil {
+		return
+	}
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isInternal(p) {
+			return nil
+		}
+		entryPath := x.dir.relative(p)
+		if entryPath == "" || entryPath == "/" {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if x.dir.checkSymlinks(ctx, p, true) != nil {
+				return nil
+			}
+			if info, err = x.dir.stat(ctx, p); err != nil {
+				return nil
+			}
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil
+		}
+
+		e := &indexEntry{
+			Path:    entryPath,
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		}
+		if !x.fullText || e.IsDir || x.unchanged(e) {
+			x.put(e, nil, false)
+			return nil
+		}
+		text, _ := x.dir.extractText(ctx, p)
+		x.put(e, tokenize(text), true)
+		return nil
+	})
+}
+
+// unchanged reports whether an entry is indexed with the same size and modification time.
+func (x *Index) unchanged(e *indexEntry) bool {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	old, ok := x.entries[e.Path]
+	return ok && !old.IsDir && old.Size == e.Size && old.ModTime.Equal(e.ModTime)
+}
+
+// put adds an entry and replaces its words, if content is true.
+func (x *Index) put(e *indexEntry, words []string, content bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.entries[e.Path] = e
+	if content || e.IsDir {
+		x.dropWords(e.Path)
+	}
+	if len(words) > 0 {
+		x.words[e.Path] = words
+		for _, w := range words {
+			paths, ok := x.postings[w]
+			if !ok {
+				paths = make(map[string]struct{})
+				x.postings[w] = paths
+			}
+			paths[e.Path] = struct{}{}
+		}
+	}
+}
+
+// dropWords removes the words of a path from the full-text index. The caller must hold
+// the write lock.
+func (x *Index) dropWords(p string) {
+	for _, w := range x.words[p] {
+		delete(x.postings[w], p)
+		if len(x.postings[w]) == 0 {
+			delete(x.postings, w)
+		}
+	}
+	delete(x.words, p)
+}
+
+// matchText returns the paths of the files containing all words of a query. Words of the
+// query match indexed words starting with them.
+func (x *Index) matchText(query string) map[string]bool {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	var result map[string]bool
+	for _, term := range terms {
+		found := make(map[string]bool)
+		for w, paths := range x.postings {
+			if !strings.HasPrefix(w, term) {
+				continue
+			}
+			for p := range paths {
+				if result == nil || result[p] {
+					found[p] = true
+				}
+			}
+		}
+		if len(found) == 0 {
+			return nil
+		}
+		result = found
+	}
+
+	return result
+}
+
+// remove drops a path and everything below it from the index.
+func (x *Index) remove(rel string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.entries, rel)
+	x.dropWords(rel)
+	prefix := strings.TrimSuffix(rel, "/") + "/"
+	for p := range x.entries {
+		if strings.HasPrefix(p, prefix) {
+			delete(x.entries, p)
+			x.dropWords(p)
+		}
+	}
+}
+
+// find returns the entries below root up to the given depth (0, 1 or -1 for infinity),
+// for which match returns true, ordered by path. The root itself is included with a
+// depth of 0 or 1.
+func (x *Index) find(root string, depth int, match func(*indexEntry) bool) []*indexEntry {
+	root = path.Clean("/" + root)
+	prefix := strings.TrimSuffix(root, "/") + "/"
+
+	x.mu.RLock()
+	var result []*indexEntry
+	for p, e := range x.entries {
+		if p != root && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		if depth == 0 && p != root {
+			continue
+		}
+		if depth == 1 && p != root && strings.Contains(strings.TrimPrefix(p, prefix), "/") {
+			continue
+		}
+		if match(e) {
+			result = append(result, e)
+		}
+	}
+	x.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+
+	return result
+}
@@ -0,0 +1,47 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIndex(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "a", "b"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "a", "b", "file"), []byte("content"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "a", tempPrefix+"file-01"), nil, 0600)
+
+	x := NewIndex(&Config{Dir: tmpDir})
+	go x.Run()
+	defer x.Close()
+
+	waitFor := func(want int) {
+		t.Helper()
+		for i := 0; i < 100 && x.Len() != want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := x.Len(); got != want {
+			t.Fatalf("Len() = %v, want %v", got, want)
+		}
+	}
+	waitFor(3)
+
+	// a directory moved into the base dir is indexed with its content
+	os.MkdirAll(filepath.Join(tmpDir, "c", "d"), 0700)
+	x.Notify(Event{Type: EventMkdir, Path: "/c", IsDir: true})
+	waitFor(5)
+
+	os.RemoveAll(filepath.Join(tmpDir, "a"))
+	x.Notify(Event{Type: EventDelete, Path: "/a", IsDir: true})
+	waitFor(2)
+
+	if got := x.find("/", -1, func(e *indexEntry) bool { return true }); len(got) != 2 || got[0].Path != "/c" || got[1].Path != "/c/d" {
+		t.Errorf("find() = %v, want /c and /c/d", got)
+	}
+}
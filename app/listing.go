@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var listingTemplate = template.Must(template.ParseFS(uiFiles, "ui/listing.html"))
+
+// listingEntry is a single file or directory of a directory listing.
+type listingEntry struct {
+	Name     string    `json:"name"`
+	Href     string    `json:"href"`
+	IsDir    bool      `json:"isDir"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// listing is the model of the directory listing template.
+type listing struct {
+	Path    string
+	Sort    string
+	Order   string
+	Entries []listingEntry
+}
+
+// NextOrder returns the sort order of a column link in the listing.
+func (l listing) NextOrder(column string) string {
+	if l.Sort == column && l.Order == "asc" {
+		return "desc"
+	}
+
+	return "asc"
+}
+
+// serveListing answers a GET request on a directory with a listing of its entries as HTML
+// or as JSON if requested via ?format=json. It returns false if the request doesn't
+// target a directory.
+func serveListing(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+	f, err := a.Handler.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || !fi.IsDir() {
+		return false
+	}
+
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		target := req.URL.Path + "/"
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+		return true
+	}
+
+	infos, err := f.Readdir(0)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithField("path", name).WithError(err).Error("Error reading directory")
+		return true
+	}
+
+	query := req.URL.Query()
+	l := listing{
+		Path:    "/" + strings.Trim(name, "/"),
+		Sort:    query.Get("sort"),
+		Order:   query.Get("order"),
+		Entries: make([]listingEntry, 0, len(infos)),
+	}
+	if l.Path != "/" {
+		l.Path += "/"
+	}
+	for _, fi := range infos {
+		href := (&url.URL{Path: fi.Name()}).EscapedPath()
+		if fi.IsDir() {
+			href += "/"
+		}
+		l.Entries = append(l.Entries, listingEntry{
+			Name:     fi.Name(),
+			Href:     "./" + href,
+			IsDir:    fi.IsDir(),
+			Size:     fi.Size(),
+			Modified: fi.ModTime(),
+		})
+	}
+	sortListing(l.Entries, l.Sort, l.Order == "desc")
+
+	if query.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		if req.Method == http.MethodGet {
+			json.NewEncoder(w).Encode(l.Entries)
+		}
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if req.Method == http.MethodGet {
+		if err := listingTemplate.Execute(w, l); err != nil {
+			log.WithError(err).Error("Error rendering directory listing")
+		}
+	}
+
+	return true
+}
+
+// sortListing sorts the entries by name, size or modification time. Directories are
+// always listed first.
+func sortListing(entries []listingEntry, by string, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if desc {
+			a, b = b, a
+		}
+
+		switch by {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "modified":
+			if !a.Modified.Equal(b.Modified) {
+				return a.Modified.Before(b.Modified)
+			}
+		}
+
+		return a.Name < b.Name
+	})
+}
@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeListing(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "dir"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "small"), []byte("a"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "big"), []byte("abc"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "outside"), []byte("a"), 0600)
+
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{"by name", "?format=json", []string{"dir", "big", "small"}},
+		{"by name desc", "?format=json&order=desc", []string{"dir", "small", "big"}},
+		{"by size", "?format=json&sort=size", []string{"dir", "small", "big"}},
+		{"by size desc", "?format=json&sort=size&order=desc", []string{"dir", "big", "small"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if !serveListing(user1, w, httptest.NewRequest("GET", "/"+tt.query, nil), a) {
+				t.Fatal("serveListing() = false, want true")
+			}
+
+			var entries []listingEntry
+			if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+				t.Fatalf("error decoding listing. error = %v", err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serveListing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if serveListing(user1, httptest.NewRecorder(), httptest.NewRequest("GET", "/small", nil), a) {
+		t.Error("serveListing() of a file = true, want false")
+	}
+}
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// metaFileName is the name of the file which holds the metadata of a path in the store.
+const metaFileName = "meta.json"
+
+// fileMeta is the metadata kept for a file or directory. Checksums are valid as long as
+// the size and modification time of the file match.
+type fileMeta struct {
+	Size      int64             `json:"size,omitempty"`
+	ModTime   time.Time         `json:"modTime,omitempty"`
+	Checksums map[string]string `json:"checksums,omitempty"`
+	Props     []deadProp        `json:"props,omitempty"`
+}
+
+// MetaStore keeps metadata of the files of the base dir in a separate directory tree. Each
+// path of the base dir is mapped to a directory of the store, whose elements are suffixed
+// with ".d", so that the metadata of a directory and all of its content can be moved or
+// removed at once.
+type MetaStore struct {
+	root string
+	mu   sync.Mutex
+}
+
+// NewMetaStore creates a store which keeps its files below the given directory.
+func NewMetaStore(root string) *MetaStore {
+	return &MetaStore{root: root}
+}
+
+// location returns the directory of the store which holds the metadata of a slash
+// separated path relative to the base dir.
+func (s *MetaStore) location(rel string) string {
+	elems := []string{s.root}
+	for _, e := range strings.Split(path.Clean("/"+rel), "/") {
+		if e != "" {
+			elems = append(elems, e+".d")
+		}
+	}
+
+	return filepath.Join(elems...)
+}
+
+// load returns the metadata of a path, which is empty if nothing has been stored.
+func (s *MetaStore) load(rel string) (*fileMeta, error) {
+	m := &fileMeta{}
+	b, err := ioutil.ReadFile(filepath.Join(s.location(rel), metaFileName))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// save replaces the metadata of a path.
+func (s *MetaStore) save(rel string, m *fileMeta) error {
+	dir := s.location(rel)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, metaFileName+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, metaFileName))
+}
+
+// update loads the metadata of a path, hands it to fn and saves it, if fn returns true.
+func (s *MetaStore) update(rel string, fn func(m *fileMeta) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, err := s.load(rel)
+	if err != nil {
+		return err
+	}
+	if !fn(m) {
+		return nil
+	}
+
+	return s.save(rel, m)
+}
+
+// get returns the metadata of a path.
+func (s *MetaStore) get(rel string) (*fileMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.load(rel)
+}
+
+// Move moves the metadata of a path and of everything below it to a new path.
+func (s *MetaStore) Move(oldRel, newRel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldLoc, newLoc := s.location(oldRel), s.location(newRel)
+	if err := os.RemoveAll(newLoc); err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldLoc); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(newLoc), 0700); err != nil {
+		return err
+	}
+
+	return os.Rename(oldLoc, newLoc)
+}
+
+// Remove removes the metadata of a path and of everything below it.
+func (s *MetaStore) Remove(rel string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return os.RemoveAll(s.location(rel))
+}
+
+// moveMeta moves the metadata of a renamed file, if a store is configured.
+func (d Dir) moveMeta(oldPhysical, newPhysical string) {
+	if d.Meta == nil {
+		return
+	}
+	if err := d.Meta.Move(d.relative(oldPhysical), d.relative(newPhysical)); err != nil {
+		log.WithField("path", newPhysical).WithError(err).Error("Error moving metadata")
+	}
+}
+
+// removeMeta removes the metadata of a deleted file, if a store is configured.
+func (d Dir) removeMeta(physical string) {
+	if d.Meta == nil {
+		return
+	}
+	if err := d.Meta.Remove(d.relative(physical)); err != nil {
+		log.WithField("path", physical).WithError(err).Error("Error removing metadata")
+	}
+}
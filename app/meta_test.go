@@ -0,0 +1,84 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMetaStore(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	s := NewMetaStore(tmpDir)
+	for _, rel := range []string{"/a", "/a/b", "/a/b/c", "/d.d"} {
+		if err := s.update(rel, func(m *fileMeta) bool { m.Size = int64(len(rel)); return true }); err != nil {
+			t.Fatalf("update(%s) error = %v", rel, err)
+		}
+	}
+
+	if err := s.Move("/a/b", "/x"); err != nil {
+		t.Fatalf("Move() error = %v", err)
+	}
+	if err := s.Remove("/d.d"); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+
+	tests := []struct {
+		rel      string
+		wantSize int64
+	}{
+		{"/a", 2},
+		{"/a/b", 0},
+		{"/a/b/c", 0},
+		{"/x", 4},
+		{"/x/c", 6},
+		{"/d.d", 0},
+		{"/d", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			m, err := s.get(tt.rel)
+			if err != nil || m.Size != tt.wantSize {
+				t.Errorf("get() = %v, %v, want size %v", m, err, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestDirMeta(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "a"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	d := Dir{Config: createTestConfig(filepath.Join(tmpDir, "data")), Meta: NewMetaStore(filepath.Join(tmpDir, "meta"))}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "a", "file"), []byte("hello"), 0600)
+
+	if sums := d.checksums(context.Background(), filepath.Join(tmpDir, "data", "a", "file"), []string{ChecksumMD5}, true); sums[ChecksumMD5] != "5d41402abc4b2a76b9719d911017c592" {
+		t.Fatalf("checksums() = %v", sums)
+	}
+	if err := d.Rename(ctx, "/a", "/b"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	if sums := d.checksums(context.Background(), filepath.Join(tmpDir, "data", "b", "file"), nil, false); sums[ChecksumMD5] == "" {
+		t.Errorf("checksums haven't been moved with the file")
+	}
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "b", "file"), []byte("hello world"), 0600)
+	if sums := d.checksums(context.Background(), filepath.Join(tmpDir, "data", "b", "file"), nil, false); len(sums) != 0 {
+		t.Errorf("checksums of modified file = %v, want none", sums)
+	}
+
+	if err := d.RemoveAll(ctx, "/b"); err != nil {
+		t.Fatalf("RemoveAll() error = %v", err)
+	}
+	if _, err := os.Stat(d.Meta.location("/b")); !os.IsNotExist(err) {
+		t.Errorf("metadata hasn't been removed with the file")
+	}
+}
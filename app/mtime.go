@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// win32LastModifiedTime is the property Windows clients set to the modification time of
+// uploaded files.
+var win32LastModifiedTime = xml.Name{Space: "urn:schemas-microsoft-com:", Local: "Win32LastModifiedTime"}
+
+// parseMtime parses the X-OC-Mtime header, which holds the modification time of an
+// upload in seconds since the epoch.
+func parseMtime(header string) (time.Time, error) {
+	if header == "" {
+		return time.Time{}, nil
+	}
+	secs, err := strconv.ParseFloat(strings.TrimSpace(header), 64)
+	if err != nil || secs < 0 {
+		return time.Time{}, fmt.Errorf("invalid X-OC-Mtime %q", header)
+	}
+
+	return time.Unix(0, int64(secs*float64(time.Second))), nil
+}
+
+// setModTime changes the modification time of a file, which is opened beneath the root
+// of the user. Cached checksums stay valid, if they have been valid before.
+func (d Dir) setModTime(ctx context.Context, physical string, t time.Time) error {
+	f, err := d.openFile(ctx, physical, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return d.setFileModTime(f, physical, t)
+}
+
+// setFileModTime changes the modification time of an open file like setModTime.
+func (d Dir) setFileModTime(f *os.File, physical string, t time.Time) error {
+	before, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := setFileTimes(f, time.Now(), t); err != nil {
+		return err
+	}
+	if d.Meta == nil {
+		return nil
+	}
+
+	after, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return d.Meta.update(d.relative(physical), func(m *fileMeta) bool {
+		if m.Checksums == nil || m.Size != before.Size() || !m.ModTime.Equal(before.ModTime()) {
+			return false
+		}
+		m.ModTime = after.ModTime()
+		return true
+	})
+}
+
+// patchModTime sets the modification time of the open file, if the patches set the
+// Win32LastModifiedTime property, and returns the patches for the remaining properties.
+func (d Dir) patchModTime(f *os.File, physical string, patches []webdav.Proppatch) ([]webdav.Proppatch, *webdav.Propstat) {
+	var rest []webdav.Proppatch
+	var pstat *webdav.Propstat
+	for _, patch := range patches {
+		var props []webdav.Property
+		for _, p := range patch.Props {
+			if p.XMLName != win32LastModifiedTime || patch.Remove {
+				props = append(props, p)
+				continue
+			}
+			status := http.StatusOK
+			t, err := http.ParseTime(strings.TrimSpace(string(p.InnerXML)))
+			if err == nil {
+				err = d.setFileModTime(f, physical, t)
+			}
+			if err != nil {
+				log.WithField("path", physical).WithError(err).Warn("Can't set modification time")
+				status = http.StatusConflict
+			}
+			pstat = &webdav.Propstat{Status: status, Props: []webdav.Property{{XMLName: p.XMLName}}}
+		}
+		if len(props) > 0 {
+			rest = append(rest, webdav.Proppatch{Remove: patch.Remove, Props: props})
+		}
+	}
+
+	return rest, pstat
+}
@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package app
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setFileTimes sets the access and modification times of an open file on its
+// descriptor, so a path replaced in between isn't affected.
+func setFileTimes(f *os.File, atime, mtime time.Time) error {
+	tv := []unix.Timeval{unix.NsecToTimeval(atime.UnixNano()), unix.NsecToTimeval(mtime.UnixNano())}
+	if err := unix.Futimes(int(f.Fd()), tv); err != nil {
+		return &os.PathError{Op: "chtimes", Path: f.Name(), Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import (
+	"os"
+	"time"
+)
+
+// setFileTimes sets the access and modification times of an open file by its name.
+func setFileTimes(f *os.File, atime, mtime time.Time) error {
+	return os.Chtimes(f.Name(), atime, mtime)
+}
@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParseMtime(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"1445412480", time.Unix(1445412480, 0), false},
+		{"1445412480.5", time.Unix(1445412480, 5e8), false},
+		{"-1", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseMtime(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMtime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseMtime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleMtime(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(filepath.Join(tmpDir, "data"))
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	dir := &Dir{Config: config}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: dir, LockSystem: webdav.NewMemLS()},
+	}
+	target := filepath.Join(tmpDir, "data", "file")
+	mtime := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	patch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:set><D:prop>` +
+		`<Z:Win32LastModifiedTime>Wed, 21 Oct 2015 07:28:00 GMT</Z:Win32LastModifiedTime></D:prop></D:set></D:propertyupdate>`
+
+	tests := []struct {
+		name       string
+		method     string
+		header     map[string]string
+		body       string
+		statusCode int
+	}{
+		{"invalid mtime", "PUT", map[string]string{"X-OC-Mtime": "now"}, "content", 400},
+		{"upload with mtime", "PUT", map[string]string{"X-OC-Mtime": strconv.FormatInt(mtime.Unix(), 10)}, "content", 201},
+		{"touch", "PUT", nil, "content", 201},
+		{"patch mtime", "PROPPATCH", nil, patch, 207},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/file", strings.NewReader(tt.body))
+			r.SetBasicAuth("admin", "password")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+			if tt.statusCode >= 300 && tt.statusCode != 207 {
+				return
+			}
+			fi, err := os.Stat(target)
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			// the ETag of the response matches the one of later requests
+			if etag := fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size()); tt.method == "PUT" && w.Header().Get("ETag") != etag {
+				t.Errorf("ETag = %s, want %s", w.Header().Get("ETag"), etag)
+			}
+			if tt.header != nil || tt.method == "PROPPATCH" {
+				if !fi.ModTime().Equal(mtime) {
+					t.Errorf("mtime = %v, want %v", fi.ModTime(), mtime)
+				}
+			} else if time.Since(fi.ModTime()) > time.Minute {
+				t.Errorf("mtime = %v, want now", fi.ModTime())
+			}
+			if tt.method == "PROPPATCH" && !strings.Contains(w.Body.String(), "200 OK") {
+				t.Errorf("PROPPATCH response = %s, want success", w.Body.String())
+			}
+		})
+	}
+
+	// cached checksums stay valid when only the modification time changes
+	dir.Meta = NewMetaStore(filepath.Join(tmpDir, "meta"))
+	ioutil.WriteFile(target, []byte("content"), 0600)
+	dir.checksums(context.Background(), target, []string{ChecksumMD5}, true)
+	if err := dir.setModTime(context.Background(), target, mtime); err != nil {
+		t.Fatalf("setModTime() error = %v", err)
+	}
+	if sums := dir.checksums(context.Background(), target, nil, false); sums[ChecksumMD5] == "" {
+		t.Errorf("checksums have been invalidated by setModTime()")
+	}
+}
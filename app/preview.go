@@ -0,0 +1,262 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register the decoder for previews
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// maxPreviewSize is the largest width and height of a preview.
+	maxPreviewSize = 1024
+	// maxPreviewPixels is the largest number of pixels of images which are previewed.
+	maxPreviewPixels = 50 * 1000 * 1000
+	// previewQuality is the quality of JPEG previews.
+	previewQuality = 80
+)
+
+var errNoPreview = errors.New("no preview available")
+
+// servePreview answers GET and HEAD requests with a preview parameter, like
+// ?preview=256x256 or ?preview=256, with a thumbnail of the requested image which fits
+// into the given size. Thumbnails are cached outside of the base dir and regenerated
+// when the image changes. It returns false if the request doesn't ask for a preview.
+func servePreview(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	size := req.URL.Query().Get("preview")
+	if size == "" {
+		return false
+	}
+	d, ok := a.Handler.FileSystem.(*Dir)
+	if !ok {
+		return false
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+
+	width, height, err := parsePreviewSize(size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+
+	f, err := d.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		writeFileError(w, err)
+		return true
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeFileError(w, err)
+		return true
+	}
+	if fi.IsDir() {
+		http.Error(w, errNoPreview.Error(), http.StatusUnsupportedMediaType)
+		return true
+	}
+
+	cached, err := d.preview(d.resolve(ctx, name), f, fi, width, height)
+	if errors.Is(err, errNoPreview) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return true
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithField("path", name).WithError(err).Error("Error creating preview")
+		return true
+	}
+
+	p, err := os.Open(cached)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithField("path", name).WithError(err).Error("Error reading preview")
+		return true
+	}
+	defer p.Close()
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+	http.ServeContent(w, req, filepath.Base(cached), fi.ModTime(), p)
+
+	return true
+}
+
+// parsePreviewSize parses a size like 256x128 or 256 for a square.
+func parsePreviewSize(size string) (int, int, error) {
+	parts := strings.SplitN(size, "x", 2)
+	if len(parts) == 1 {
+		parts = append(parts, parts[0])
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil || width < 1 || width > maxPreviewSize {
+		return 0, 0, fmt.Errorf("invalid preview size %s", size)
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil || height < 1 || height > maxPreviewSize {
+		return 0, 0, fmt.Errorf("invalid preview size %s", size)
+	}
+
+	return width, height, nil
+}
+
+// previewsDir returns the directory which keeps the cached previews.
+func previewsDir(config *Config) string {
+	if config.Previews.Dir != "" {
+		return config.Previews.Dir
+	}
+
+	return filepath.Join(os.TempDir(), "dave-previews")
+}
+
+// previewLocation returns the directory which keeps the previews of a file.
+func (d Dir) previewLocation(physical string) string {
+	sum := sha256.Sum256([]byte(physical))
+	return filepath.Join(previewsDir(d.Config), hex.EncodeToString(sum[:]))
+}
+
+// preview returns the cached preview of an image, which is created if it is missing or
+// older than the image. The modification time of a preview is the one of its image.
+func (d Dir) preview(physical string, r io.Reader, fi os.FileInfo, width, height int) (string, error) {
+	location := d.previewLocation(physical)
+	base := filepath.Join(location, strconv.Itoa(width)+"x"+strconv.Itoa(height))
+	for _, ext := range []string{".jpg", ".png"} {
+		if cached, err := os.Stat(base + ext); err == nil && cached.ModTime().Equal(fi.ModTime()) {
+			return base + ext, nil
+		}
+	}
+
+	img, format, err := decodePreviewImage(r)
+	if err != nil {
+		return "", err
+	}
+	thumb := scaleImage(img, width, height)
+
+	if err := os.MkdirAll(location, 0700); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(location, tempPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	target := base + ".jpg"
+	if format == "png" || format == "gif" {
+		target = base + ".png"
+		err = png.Encode(tmp, thumb)
+	} else {
+		err = jpeg.Encode(tmp, thumb, &jpeg.Options{Quality: previewQuality})
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chtimes(tmp.Name(), fi.ModTime(), fi.ModTime()); err != nil {
+		return "", err
+	}
+	// a preview of the other format may be left from an earlier version of the file
+	os.Remove(base + ".jpg")
+	os.Remove(base + ".png")
+
+	return target, os.Rename(tmp.Name(), target)
+}
+
+// decodePreviewImage decodes a JPEG, PNG or GIF image, unless it has too many pixels.
+func decodePreviewImage(r io.Reader) (image.Image, string, error) {
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(r, &header))
+	if err != nil || int64(config.Width)*int64(config.Height) > maxPreviewPixels {
+		return nil, "", errNoPreview
+	}
+	img, _, err := image.Decode(io.MultiReader(&header, r))
+	if err != nil {
+		return nil, "", errNoPreview
+	}
+
+	return img, format, nil
+}
+
+// scaleImage shrinks an image to fit into the given size, keeping its aspect ratio, by
+// averaging the pixels covered by each pixel of the result. Images aren't enlarged.
+func scaleImage(src image.Image, width, height int) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	tw, th := sw, sh
+	if tw > width {
+		tw, th = width, sh*width/sw
+	}
+	if th > height {
+		tw, th = tw*height/th, height
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	rgba := image.NewRGBA(b)
+	draw.Draw(rgba, b, src, b.Min, draw.Src)
+	if tw == sw && th == sh {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := y*sh/th, (y+1)*sh/th
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := x*sw/tw, (x+1)*sw/tw
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, al, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(b.Min.X+x0, b.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					bl += uint64(rgba.Pix[i+2])
+					al += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(bl / n), A: uint8(al / n)})
+		}
+	}
+
+	return dst
+}
+
+// removePreviews removes the cached previews of a file.
+func (d Dir) removePreviews(physical string) {
+	if err := os.RemoveAll(d.previewLocation(physical)); err != nil {
+		log.WithField("path", physical).WithError(err).Error("Error removing previews")
+	}
+}
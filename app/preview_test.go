@@ -0,0 +1,137 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParsePreviewSize(t *testing.T) {
+	tests := []struct {
+		size          string
+		width, height int
+		wantErr       bool
+	}{
+		{"256x128", 256, 128, false},
+		{"64", 64, 64, false},
+		{"0x10", 0, 0, true},
+		{"4096", 0, 0, true},
+		{"big", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			width, height, err := parsePreviewSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePreviewSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if width != tt.width || height != tt.height {
+				t.Errorf("parsePreviewSize() = %vx%v, want %vx%v", width, height, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestServePreview(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	encode := func(width, height int, asPNG bool) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.RGBA{R: 200, A: 255})
+			}
+		}
+		var buf bytes.Buffer
+		if asPNG {
+			png.Encode(&buf, img)
+		} else {
+			jpeg.Encode(&buf, img, nil)
+		}
+		return buf.Bytes()
+	}
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "wide.png"), encode(100, 50, true), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "photo.jpg"), encode(40, 80, false), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "small.png"), encode(8, 8, true), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "notes.txt"), []byte("text"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "inbox", "secret.png"), encode(10, 10, true), 0600)
+
+	config := createTestConfig(tmpDir)
+	config.Previews.Dir = filepath.Join(tmpDir, "previews")
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox"}}
+	dir := &Dir{Config: config}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: dir, LockSystem: webdav.NewMemLS()},
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		name        string
+		target      string
+		statusCode  int
+		contentType string
+		width       int
+		height      int
+	}{
+		{"png", "/wide.png?preview=20", 200, "image/png", 20, 10},
+		{"jpeg", "/photo.jpg?preview=32x32", 200, "image/jpeg", 16, 32},
+		{"not enlarged", "/small.png?preview=64", 200, "image/png", 8, 8},
+		{"no image", "/notes.txt?preview=64", 415, "", 0, 0},
+		{"directory", "/inbox?preview=64", 415, "", 0, 0},
+		{"drop box", "/inbox/secret.png?preview=64", 403, "", 0, 0},
+		{"missing", "/missing.png?preview=64", 404, "", 0, 0},
+		{"invalid size", "/wide.png?preview=0", 400, "", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serve(user1, w, httptest.NewRequest("GET", tt.target, nil), a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+			if tt.statusCode != 200 {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %v, want %v", got, tt.contentType)
+			}
+			img, _, err := image.DecodeConfig(w.Body)
+			if err != nil {
+				t.Fatalf("invalid preview: %v", err)
+			}
+			if img.Width != tt.width || img.Height != tt.height {
+				t.Errorf("size = %vx%v, want %vx%v", img.Width, img.Height, tt.width, tt.height)
+			}
+		})
+	}
+
+	// overwriting an image invalidates its previews
+	if _, err := os.Stat(dir.previewLocation(filepath.Join(tmpDir, "subdir1", "wide.png"))); err != nil {
+		t.Fatalf("preview not cached: %v", err)
+	}
+	f, err := dir.OpenFile(user1, "/wide.png", os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write(encode(50, 100, true))
+	f.Close()
+	w := httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("GET", "/wide.png?preview=20", nil), a)
+	if img, _, err := image.DecodeConfig(w.Body); err != nil || img.Width != 10 || img.Height != 20 {
+		t.Errorf("preview after overwrite = %vx%v (%v), want 10x20", img.Width, img.Height, err)
+	}
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// deadProp is a dead property as kept in the metadata store.
+type deadProp struct {
+	Space    string `json:"space"`
+	Local    string `json:"local"`
+	Lang     string `json:"lang,omitempty"`
+	InnerXML string `json:"innerXML,omitempty"`
+}
+
+// deadProps returns the properties stored for the file and its cached checksums.
+func (d Dir) deadProps(physical string) (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	if d.Meta == nil {
+		return props, nil
+	}
+
+	m, err := d.Meta.get(d.relative(physical))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range m.Props {
+		name := xml.Name{Space: p.Space, Local: p.Local}
+		props[name] = webdav.Property{XMLName: name, Lang: p.Lang, InnerXML: []byte(p.InnerXML)}
+	}
+	if prop, ok := d.checksumsProp(physical); ok {
+		props[prop.XMLName] = prop
+	}
+
+	return props, nil
+}
+
+// patchProps sets and removes properties of the file. Changes of the checksums are
+// ignored, as they are calculated from the content. Win32LastModifiedTime changes the
+// modification time of the file and is accepted without a metadata store, too.
+func (d Dir) patchProps(f *os.File, physical string, patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	patches, pstatModTime := d.patchModTime(f, physical, patches)
+	var pstats []webdav.Propstat
+	if pstatModTime != nil {
+		pstats = append(pstats, *pstatModTime)
+	}
+	if len(patches) == 0 {
+		return pstats, nil
+	}
+	if d.Meta == nil {
+		return append(pstats, forbidProps(patches)...), nil
+	}
+
+	pstat := webdav.Propstat{Status: http.StatusOK}
+	err := d.Meta.update(d.relative(physical), func(m *fileMeta) bool {
+		for _, patch := range patches {
+			for _, p := range patch.Props {
+				pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+				if p.XMLName == checksumsProperty {
+					continue
+				}
+				m.removeProp(p.XMLName)
+				if !patch.Remove {
+					m.Props = append(m.Props, deadProp{
+						Space:    p.XMLName.Space,
+						Local:    p.XMLName.Local,
+						Lang:     p.Lang,
+						InnerXML: string(p.InnerXML),
+					})
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.WithField("path", physical).WithError(err).Error("Error storing properties")
+		return nil, err
+	}
+
+	return append(pstats, pstat), nil
+}
+
+// removeProp removes a property from the metadata.
+func (m *fileMeta) removeProp(name xml.Name) {
+	props := m.Props[:0]
+	for _, p := range m.Props {
+		if p.Space != name.Space || p.Local != name.Local {
+			props = append(props, p)
+		}
+	}
+	m.Props = props
+}
+
+// forbidProps rejects all patches.
+func forbidProps(patches []webdav.Proppatch) []webdav.Propstat {
+	pstat := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			pstat.Props = append(pstat.Props, webdav.Property{XMLName: p.XMLName})
+		}
+	}
+
+	return []webdav.Propstat{pstat}
+}
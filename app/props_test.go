@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestHandleDeadProps(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "dir"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(filepath.Join(tmpDir, "data"))
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "file"), []byte("content"), 0600)
+
+	withMeta := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config, Meta: NewMetaStore(filepath.Join(tmpDir, "meta"))}, LockSystem: webdav.NewMemLS()},
+	}
+	confined := createTestConfig(filepath.Join(tmpDir, "data"))
+	confined.Users["admin"].Password = config.Users["admin"].Password
+	confined.Symlinks = SymlinksConfine
+	withSymlinks := &App{
+		Config:  confined,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: confined, Meta: NewMetaStore(filepath.Join(tmpDir, "meta"))}, LockSystem: webdav.NewMemLS()},
+	}
+	hidden := createTestConfig(filepath.Join(tmpDir, "data"))
+	hidden.Users["admin"].Password = config.Users["admin"].Password
+	hidden.Hidden.Patterns = []string{"*.tmp"}
+	withHidden := &App{
+		Config:  hidden,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: hidden, Meta: NewMetaStore(filepath.Join(tmpDir, "meta"))}, LockSystem: webdav.NewMemLS()},
+	}
+	withoutMeta := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+
+	setProp := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:set><D:prop><Z:Win32FileAttributes>00000020</Z:Win32FileAttributes></D:prop></D:set></D:propertyupdate>`
+	otherProp := strings.Replace(setProp, "00000020", "00000080", 1)
+	removeProp := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:schemas-microsoft-com:"><D:remove><D:prop><Z:Win32FileAttributes/></D:prop></D:remove></D:propertyupdate>`
+
+	tests := []struct {
+		name     string
+		a        *App
+		method   string
+		path     string
+		header   map[string]string
+		body     string
+		wantBody string
+	}{
+		{"patch without store", withoutMeta, "PROPPATCH", "/file", nil, setProp, "403 Forbidden"},
+		{"patch file", withMeta, "PROPPATCH", "/file", nil, setProp, "200 OK"},
+		{"patch directory", withMeta, "PROPPATCH", "/dir", nil, setProp, "200 OK"},
+		{"find file property", withMeta, "PROPFIND", "/file", map[string]string{"Depth": "0"}, "", "00000020"},
+		{"find directory property", withMeta, "PROPFIND", "/dir", map[string]string{"Depth": "0"}, "", "00000020"},
+		{"copy file", withMeta, "COPY", "/file", map[string]string{"Destination": "http://example.com/copy"}, "", ""},
+		{"find copied property", withMeta, "PROPFIND", "/copy", map[string]string{"Depth": "0"}, "", "00000020"},
+		{"move file", withMeta, "MOVE", "/file", map[string]string{"Destination": "http://example.com/moved"}, "", ""},
+		{"find moved property", withMeta, "PROPFIND", "/moved", map[string]string{"Depth": "0"}, "", "00000020"},
+		{"patch with symlink policy", withSymlinks, "PROPPATCH", "/copy", nil, setProp, "200 OK"},
+		{"find property with symlink policy", withSymlinks, "PROPFIND", "/moved", map[string]string{"Depth": "0"}, "", "00000020"},
+		{"patch with hidden files", withHidden, "PROPPATCH", "/dir", nil, otherProp, "200 OK"},
+		{"find patched property with hidden files", withHidden, "PROPFIND", "/dir", map[string]string{"Depth": "0"}, "", "00000080"},
+		{"remove property", withMeta, "PROPPATCH", "/moved", nil, removeProp, "200 OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.SetBasicAuth("admin", "password")
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, tt.a)
+
+			if w.Code >= 300 && w.Code != 207 {
+				t.Fatalf("status = %v, body %s", w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+
+	r := httptest.NewRequest("PROPFIND", "/moved", nil)
+	r.SetBasicAuth("admin", "password")
+	r.Header.Set("Depth", "0")
+	w := httptest.NewRecorder()
+	handle(context.Background(), w, r, withMeta)
+	if strings.Contains(w.Body.String(), "00000020") {
+		t.Errorf("removed property is still listed: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// limiterIdle is the time after which the state of an idle client is dropped.
+const limiterIdle = 10 * time.Minute
+
+// limiterState is the request rate and the number of running requests of a client.
+type limiterState struct {
+	rate     float64
+	tokens   float64
+	last     time.Time
+	inflight int
+}
+
+// Limiter limits the rate of requests and the number of concurrent requests per client
+// address and per user. The limits are read from the configuration on every request, so
+// they follow hot reloads.
+type Limiter struct {
+	config    *Config
+	mu        sync.Mutex
+	clients   map[string]*limiterState
+	lastPrune time.Time
+}
+
+// NewLimiter creates a limiter of the configured limits.
+func NewLimiter(config *Config) *Limiter {
+	return &Limiter{config: config, clients: make(map[string]*limiterState), lastPrune: time.Now()}
+}
+
+// Wrap applies the limits per client address to a handler. Requests over the limits
+// are answered with 429 Too Many Requests. Event streams are long-running and don't
+// count as concurrent requests.
+func (l *Limiter) Wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.config.Limits.PerIP
+		if endpoint, ok := apiEndpoint(l.config, r.URL.Path); ok && endpoint == "events" {
+			limit.Concurrent = 0
+		}
+		addr := clientAddr(l.config, r)
+		release, ok := l.acquire(w, "ip:"+addr, limit)
+		if !ok {
+			log.WithField("address", addr).Debug("Rejected request over the limits of the address")
+			return
+		}
+		defer release()
+
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// limitUser applies the limits per user to a request of an authenticated user. It
+// returns false if the request has been rejected.
+func (l *Limiter) limitUser(ctx context.Context, w http.ResponseWriter, req *http.Request) (func(), bool) {
+	authInfo := AuthFromContext(ctx)
+	if l == nil || authInfo == nil || !authInfo.Authenticated {
+		return func() {}, true
+	}
+	limit := l.config.Limits.PerUser
+	if endpoint, ok := apiEndpoint(l.config, req.URL.Path); ok && endpoint == "events" {
+		limit.Concurrent = 0
+	}
+	release, ok := l.acquire(w, "user:"+authInfo.Username, limit)
+	if !ok {
+		log.WithField("user", authInfo.Username).Debug("Rejected request over the limits of the user")
+	}
+
+	return release, ok
+}
+
+// acquire takes a request of the rate and a slot of the concurrent requests of a client.
+// If either is exhausted, the request is answered with 429 and a Retry-After header.
+func (l *Limiter) acquire(w http.ResponseWriter, key string, limit Limit) (func(), bool) {
+	if limit.Rate <= 0 && limit.Concurrent <= 0 {
+		return func() {}, true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.prune(now)
+	s, ok := l.clients[key]
+	if !ok {
+		s = &limiterState{last: now}
+		l.clients[key] = s
+	}
+
+	var retryAfter time.Duration
+	if limit.Rate > 0 {
+		burst := float64(limit.Burst)
+		if burst < 1 {
+			burst = math.Max(1, limit.Rate)
+		}
+		if s.rate != limit.Rate {
+			s.rate, s.tokens = limit.Rate, burst
+		}
+		s.tokens = math.Min(burst, s.tokens+now.Sub(s.last).Seconds()*limit.Rate)
+		if s.tokens < 1 {
+			retryAfter = time.Duration((1 - s.tokens) / limit.Rate * float64(time.Second))
+		}
+	}
+	s.last = now
+	if retryAfter == 0 && limit.Concurrent > 0 && s.inflight >= limit.Concurrent {
+		retryAfter = time.Second
+	}
+	if retryAfter > 0 {
+		l.mu.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return nil, false
+	}
+	if limit.Rate > 0 {
+		s.tokens--
+	}
+	if limit.Concurrent > 0 {
+		s.inflight++
+	}
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if limit.Concurrent <= 0 {
+				return
+			}
+			l.mu.Lock()
+			s.inflight--
+			l.mu.Unlock()
+		})
+	}, true
+}
+
+// prune drops the state of clients which have been idle for a while. The caller must
+// hold the lock.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for key, s := range l.clients {
+		if s.inflight == 0 && now.Sub(s.last) > limiterIdle {
+			delete(l.clients, key)
+		}
+	}
+}
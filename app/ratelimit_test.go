@@ -0,0 +1,129 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestLimiterWrap(t *testing.T) {
+	config := &Config{Limits: Limits{PerIP: Limit{Rate: 1, Burst: 2}}, TrustedProxies: []string{"10.0.0.9"}}
+	l := NewLimiter(config)
+	block := make(chan struct{})
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-block
+		}
+	}))
+
+	request := func(addr, target string, forwardedFor ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PROPFIND", target, nil)
+		r.RemoteAddr = addr + ":1234"
+		for _, value := range forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// the burst is available at once, then the rate applies
+	for i, want := range []int{200, 200, 429} {
+		if w := request("10.0.0.1", "/"); w.Code != want {
+			t.Errorf("request %d: status = %v, want %v", i, w.Code, want)
+		} else if want == 429 && w.Header().Get("Retry-After") != "1" {
+			t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+		}
+	}
+	if w := request("10.0.0.2", "/"); w.Code != 200 {
+		t.Errorf("other address: status = %v, want 200", w.Code)
+	}
+	if w := request("10.0.0.1", "/", "1.2.3.4"); w.Code != 429 {
+		t.Errorf("forged X-Forwarded-For: status = %v, want 429", w.Code)
+	}
+	for i, want := range []int{200, 200, 429} {
+		if w := request("10.0.0.9", "/", "1.2.3.4"); w.Code != want {
+			t.Errorf("request %d via proxy: status = %v, want %v", i, w.Code, want)
+		}
+	}
+	if w := request("10.0.0.9", "/", "5.6.7.8"); w.Code != 200 {
+		t.Errorf("other address via proxy: status = %v, want 200", w.Code)
+	}
+
+	// concurrent requests are capped
+	config.Limits.PerIP = Limit{Concurrent: 1}
+	done := make(chan struct{})
+	go func() {
+		request("10.0.0.3", "/slow")
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		l.mu.Lock()
+		s := l.clients["ip:10.0.0.3"]
+		running := s != nil && s.inflight == 1
+		l.mu.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if w := request("10.0.0.3", "/"); w.Code != 429 || w.Header().Get("Retry-After") == "" {
+		t.Errorf("concurrent request: status = %v, Retry-After = %q, want 429 with Retry-After", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := request("10.0.0.3", "/.dave/events"); w.Code != 200 {
+		t.Errorf("event stream: status = %v, want 200", w.Code)
+	}
+	close(block)
+	<-done
+	if w := request("10.0.0.3", "/"); w.Code != 200 {
+		t.Errorf("after release: status = %v, want 200", w.Code)
+	}
+}
+
+func TestHandleLimitUser(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir2"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["user1"].Password = GenHash([]byte("password"))
+	config.Users["user2"].Password = GenHash([]byte("password"))
+	// the token of the rate isn't refilled while the passwords are checked
+	config.Limits.PerUser = Limit{Rate: 0.001}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+		Limiter: NewLimiter(config),
+	}
+
+	tests := []struct {
+		name       string
+		user       string
+		password   string
+		statusCode int
+	}{
+		{"first request", "user1", "password", 207},
+		{"over the rate", "user1", "password", 429},
+		{"other user", "user2", "password", 207},
+		{"failed login isn't limited per user", "user2", "wrong", 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("PROPFIND", "/", nil)
+			r.SetBasicAuth(tt.user, tt.password)
+			w := httptest.NewRecorder()
+			handle(context.Background(), w, r, a)
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+		})
+	}
+}
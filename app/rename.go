@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// renamePhysical renames a file or directory beneath the roots of the users of the
+// contexts. If the paths are on different file systems, e.g. because the directory of a
+// user is a separate mount, the tree is copied and the source is removed afterwards.
+func (d Dir) renamePhysical(oldCtx context.Context, oldName string, newCtx context.Context, newName string) error {
+	err := d.rename(oldCtx, oldName, newCtx, newName)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	return d.moveAcrossDevices(oldCtx, oldName, newCtx, newName)
+}
+
+// moveAcrossDevices copies a file or directory preserving modes and modification times
+// to a temporary name next to the destination, which replaces the destination once the
+// copy is complete, and removes the source. A failed copy is removed again and leaves
+// the source and the destination intact. All paths are resolved beneath the roots of
+// the users like the rename.
+func (d Dir) moveAcrossDevices(oldCtx context.Context, oldName string, newCtx context.Context, newName string) error {
+	fi, err := d.lstat(oldCtx, oldName)
+	if err != nil {
+		return err
+	}
+	if dst, err := d.lstat(newCtx, newName); err == nil && dst.IsDir() != fi.IsDir() {
+		// os.Rename replaces files and empty directories only
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: syscall.EEXIST}
+	}
+
+	tmp := tempName(newName)
+	if err := d.copyTree(oldCtx, oldName, newCtx, tmp, fi); err != nil {
+		d.removeAll(newCtx, tmp)
+		return err
+	}
+	if err := d.rename(newCtx, tmp, newCtx, newName); err != nil {
+		d.removeAll(newCtx, tmp)
+		return err
+	}
+
+	return d.removeAll(oldCtx, oldName)
+}
+
+// copyTree copies a file, symlink or directory and its content. The modification times
+// of directories are set after their content has been written.
+func (d Dir) copyTree(srcCtx context.Context, src string, dstCtx context.Context, dst string, fi os.FileInfo) error {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := d.readlink(srcCtx, src)
+		if err != nil {
+			return err
+		}
+		return d.symlink(dstCtx, target, dst)
+	case fi.IsDir():
+		if err := d.mkdir(dstCtx, dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		f, err := d.openFile(srcCtx, src, os.O_RDONLY|oNoFollow, 0)
+		if err != nil {
+			return err
+		}
+		children, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := d.copyTree(srcCtx, filepath.Join(src, child.Name()), dstCtx, filepath.Join(dst, child.Name()), child); err != nil {
+				return err
+			}
+		}
+		// the mode is applied again, because the umask applies on creation
+		f, err = d.openFile(dstCtx, dst, os.O_RDONLY|oNoFollow, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Chmod(fi.Mode().Perm())
+		f.Close()
+		if err != nil {
+			return err
+		}
+	case fi.Mode().IsRegular():
+		if err := d.copyRegular(srcCtx, src, dstCtx, dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("can't move special file %s across file systems", src)
+	}
+
+	return d.chtimes(dstCtx, dst, time.Now(), fi.ModTime())
+}
+
+func (d Dir) copyRegular(srcCtx context.Context, src string, dstCtx context.Context, dst string, perm os.FileMode) error {
+	r, err := d.openFile(srcCtx, src, os.O_RDONLY|oNoFollow, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := d.openFile(dstCtx, dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	// the mode is applied again, because the umask applies on creation
+	if err := w.Chmod(perm); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMoveAcrossDevices(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := filepath.Join(tmpDir, "src")
+	os.MkdirAll(filepath.Join(src, "sub"), 0750)
+	ioutil.WriteFile(filepath.Join(src, "file"), []byte("content"), 0640)
+	ioutil.WriteFile(filepath.Join(src, "sub", "nested"), []byte("nested"), 0600)
+	os.Symlink("file", filepath.Join(src, "link"))
+	os.Chtimes(filepath.Join(src, "file"), mtime, mtime)
+	os.Chtimes(filepath.Join(src, "sub"), mtime, mtime)
+	ioutil.WriteFile(filepath.Join(tmpDir, "single"), []byte("single"), 0604)
+	ioutil.WriteFile(filepath.Join(tmpDir, "existing"), []byte("existing"), 0600)
+	os.Mkdir(filepath.Join(tmpDir, "dir"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "kept"), []byte("kept"), 0600)
+	l, err := net.Listen("unix", filepath.Join(tmpDir, "socket"))
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	defer l.Close()
+
+	tests := []struct {
+		name    string
+		oldName string
+		newName string
+		wantErr bool
+	}{
+		{"tree", "src", "dst", false},
+		{"file over file", "single", "existing", false},
+		{"file over directory", "existing", "dir", true},
+		{"missing source", "missing", "new", true},
+		{"failed copy", "socket", "kept", true},
+	}
+	config := createTestConfig(tmpDir)
+	config.Symlinks = SymlinksConfine
+	d := Dir{Config: config}
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.moveAcrossDevices(ctx, filepath.Join(tmpDir, tt.oldName), ctx, filepath.Join(tmpDir, tt.newName))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("moveAcrossDevices() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, serr := os.Lstat(filepath.Join(tmpDir, tt.oldName)); err == nil && !os.IsNotExist(serr) {
+				t.Errorf("source exists after move, err = %v", serr)
+			}
+		})
+	}
+
+	dst := filepath.Join(tmpDir, "dst")
+	modes := map[string]os.FileMode{"": 0750, "file": 0640, "sub": 0750, "sub/nested": 0600}
+	for name, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("Stat(%s) error = %v", name, err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Errorf("mode of %s = %v, want %v", name, fi.Mode().Perm(), mode)
+		}
+	}
+	for _, name := range []string{"file", "sub"} {
+		if fi, _ := os.Stat(filepath.Join(dst, name)); !fi.ModTime().Equal(mtime) {
+			t.Errorf("mtime of %s = %v, want %v", name, fi.ModTime(), mtime)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "link")); err != nil || target != "file" {
+		t.Errorf("link = %s, %v, want file", target, err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "existing")); string(b) != "single" {
+		t.Errorf("content of replaced file = %s, want single", b)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "kept")); string(b) != "kept" {
+		t.Errorf("content of destination of a failed copy = %s, want kept", b)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(tmpDir, tempPrefix+"*")); len(temps) > 0 {
+		t.Errorf("temporary files left behind: %v", temps)
+	}
+}
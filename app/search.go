@@ -0,0 +1,564 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchRequest is the body of a SEARCH request with a basic search as defined by
+// RFC 5323.
+type searchRequest struct {
+	XMLName     xml.Name `xml:"DAV: searchrequest"`
+	BasicSearch *struct {
+		Select struct {
+			AllProp *struct{}   `xml:"DAV: allprop"`
+			Prop    *searchProp `xml:"DAV: prop"`
+		} `xml:"DAV: select"`
+		From struct {
+			Scopes []struct {
+				Href  string `xml:"DAV: href"`
+				Depth string `xml:"DAV: depth"`
+			} `xml:"DAV: scope"`
+		} `xml:"DAV: from"`
+		Where   *searchExpr `xml:"DAV: where"`
+		OrderBy struct {
+			Orders []struct {
+				Prop       searchProp `xml:"DAV: prop"`
+				Descending *struct{}  `xml:"DAV: descending"`
+			} `xml:"DAV: order"`
+		} `xml:"DAV: orderby"`
+		Limit struct {
+			NResults int `xml:"DAV: nresults"`
+		} `xml:"DAV: limit"`
+	} `xml:"DAV: basicsearch"`
+}
+
+// searchProp is a list of property names.
+type searchProp struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// searchExpr is an element of the where clause of a basic search.
+type searchExpr struct {
+	XMLName  xml.Name
+	Caseless string       `xml:"caseless,attr"`
+	Prop     *searchProp  `xml:"DAV: prop"`
+	Literal  *string      `xml:"DAV: literal"`
+	Text     string       `xml:",chardata"`
+	Operands []searchExpr `xml:",any"`
+}
+
+// searchProps are the properties which can be selected, compared and ordered by.
+var searchProps = []string{"displayname", "getcontentlength", "getlastmodified", "getcontenttype", "resourcetype"}
+
+// searchMatcher decides whether an index entry matches a search condition.
+type searchMatcher func(e *indexEntry) bool
+
+// serveSearch answers a SEARCH request with the matching files of the users tree.
+func serveSearch(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	if a.Index == nil {
+		http.Error(w, "search is not enabled", http.StatusNotImplemented)
+		return
+	}
+
+	var sr searchRequest
+	if err := xml.NewDecoder(req.Body).Decode(&sr); err != nil || sr.BasicSearch == nil {
+		http.Error(w, "unsupported search request", http.StatusBadRequest)
+		return
+	}
+	bs := sr.BasicSearch
+
+	match := searchMatcher(func(*indexEntry) bool { return true })
+	if bs.Where != nil {
+		if len(bs.Where.Operands) != 1 {
+			http.Error(w, "invalid where clause", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if match, err = compileSearch(bs.Where.Operands[0], a.Index); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	scopes := bs.From.Scopes
+	if len(scopes) == 0 {
+		http.Error(w, "missing scope", http.StatusBadRequest)
+		return
+	}
+	var results []*indexEntry
+	view := searchView(ctx, a)
+	for _, scope := range scopes {
+		u, err := url.Parse(scope.Href)
+		if err != nil {
+			http.Error(w, "invalid scope", http.StatusBadRequest)
+			return
+		}
+		name, ok := a.webdavPath(u.Path)
+		if !ok {
+			http.Error(w, "invalid scope", http.StatusBadRequest)
+			return
+		}
+		depth := -1
+		switch scope.Depth {
+		case "0":
+			depth = 0
+		case "1":
+			depth = 1
+		}
+		results = append(results, view.find(a.Index, name, depth, match)...)
+	}
+
+	for i := len(bs.OrderBy.Orders) - 1; i >= 0; i-- {
+		order := bs.OrderBy.Orders[i]
+		if len(order.Prop.Names) != 1 {
+			http.Error(w, "invalid order", http.StatusBadRequest)
+			return
+		}
+		less, err := searchLess(order.Prop.Names[0].XMLName)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		descending := order.Descending != nil
+		sort.SliceStable(results, func(i, j int) bool {
+			if descending {
+				return less(results[j], results[i])
+			}
+			return less(results[i], results[j])
+		})
+	}
+	if bs.Limit.NResults > 0 && len(results) > bs.Limit.NResults {
+		results = results[:bs.Limit.NResults]
+	}
+
+	var props []xml.Name
+	if bs.Select.Prop != nil && bs.Select.AllProp == nil {
+		for _, n := range bs.Select.Prop.Names {
+			props = append(props, n.XMLName)
+		}
+	} else {
+		for _, p := range searchProps {
+			props = append(props, xml.Name{Space: "DAV:", Local: p})
+		}
+	}
+
+	writeSearchResults(w, a, view, results, props)
+}
+
+// searchResultLimit is the default number of results of the search endpoint.
+const searchResultLimit = 100
+
+// searchResult is a file found by the search endpoint.
+type searchResult struct {
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// serveSearchAPI answers full-text queries of the search endpoint with the files of the
+// users tree containing all words of the q parameter. The optional path parameter
+// restricts the search to a directory and limit to a number of results.
+func serveSearchAPI(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Index == nil || !a.Index.fullText {
+		http.Error(w, "full-text search is not enabled", http.StatusNotImplemented)
+		return
+	}
+	query := req.URL.Query()
+	if strings.TrimSpace(query.Get("q")) == "" {
+		http.Error(w, "missing query", http.StatusBadRequest)
+		return
+	}
+	limit := searchResultLimit
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	paths := a.Index.matchText(query.Get("q"))
+	view := searchView(ctx, a)
+	found := view.find(a.Index, query.Get("path"), -1, func(e *indexEntry) bool { return paths[e.Path] })
+	if len(found) > limit {
+		found = found[:limit]
+	}
+
+	results := make([]searchResult, 0, len(found))
+	for _, e := range found {
+		results = append(results, searchResult{
+			Path:     view.userPath(e),
+			Name:     e.Name,
+			Size:     e.Size,
+			Modified: e.ModTime,
+		})
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+// searchScope restricts searches to the files a request is allowed to see.
+type searchScope struct {
+	dir  Dir
+	ctx  context.Context
+	root string
+}
+
+func searchView(ctx context.Context, a *App) searchScope {
+	d := Dir{Config: a.Config}
+	if fs, ok := a.Handler.FileSystem.(*Dir); ok {
+		d = *fs
+	}
+
+	return searchScope{dir: d, ctx: ctx, root: d.relative(d.resolve(ctx, "/"))}
+}
+
+// find searches below a path of the users view and skips the content of drop boxes,
+// hidden files and paths with symlinks forbidden for the user by the symlink policy.
+func (s searchScope) find(index *Index, name string, depth int, match searchMatcher) []*indexEntry {
+	if s.root == "" {
+		return nil
+	}
+	root := path.Join(s.root, path.Clean("/"+name))
+
+	return index.find(root, depth, func(e *indexEntry) bool {
+		if box, inBox := s.dir.dropbox(s.ctx, s.dir.physical(e.Path)); inBox && s.dir.physical(e.Path) != box {
+			return false
+		}
+		if internalName(e.Path) || hiddenPath(s.dir.Config.Hidden.Patterns, e.Path) {
+			return false
+		}
+		return match(e) && s.dir.checkSymlinks(s.ctx, s.dir.physical(e.Path), true) == nil
+	})
+}
+
+// userPath returns the path of an entry as seen by the user.
+func (s searchScope) userPath(e *indexEntry) string {
+	p := strings.TrimPrefix(e.Path, strings.TrimSuffix(s.root, "/"))
+	if e.IsDir {
+		p += "/"
+	}
+
+	return p
+}
+
+// compileSearch translates an expression of the where clause into a matcher. The
+// contains operator is answered by the full-text index.
+func compileSearch(expr searchExpr, index *Index) (searchMatcher, error) {
+	if expr.XMLName.Space != "DAV:" {
+		return nil, fmt.Errorf("unsupported operator %s", expr.XMLName.Local)
+	}
+
+	switch op := expr.XMLName.Local; op {
+	case "and", "or":
+		var operands []searchMatcher
+		for _, o := range expr.Operands {
+			m, err := compileSearch(o, index)
+			if err != nil {
+				return nil, err
+			}
+			operands = append(operands, m)
+		}
+		if op == "and" {
+			return func(e *indexEntry) bool {
+				for _, m := range operands {
+					if !m(e) {
+						return false
+					}
+				}
+				return true
+			}, nil
+		}
+		return func(e *indexEntry) bool {
+			for _, m := range operands {
+				if m(e) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case "not":
+		if len(expr.Operands) != 1 {
+			return nil, fmt.Errorf("not requires exactly one operand")
+		}
+		m, err := compileSearch(expr.Operands[0], index)
+		if err != nil {
+			return nil, err
+		}
+		return func(e *indexEntry) bool { return !m(e) }, nil
+	case "is-collection":
+		return func(e *indexEntry) bool { return e.IsDir }, nil
+	case "contains":
+		if index == nil || !index.fullText {
+			return nil, fmt.Errorf("full-text search is not enabled")
+		}
+		paths := index.matchText(expr.Text)
+		return func(e *indexEntry) bool { return paths[e.Path] }, nil
+	case "eq", "lt", "lte", "gt", "gte", "like":
+		if expr.Prop == nil || len(expr.Prop.Names) != 1 || expr.Literal == nil {
+			return nil, fmt.Errorf("%s requires a property and a literal", op)
+		}
+		return compileComparison(op, expr.Prop.Names[0].XMLName, *expr.Literal, expr.Caseless != "no")
+	}
+
+	return nil, fmt.Errorf("unsupported operator %s", expr.XMLName.Local)
+}
+
+// compileComparison compares a property with a literal. Strings are compared without
+// regard to case, unless caseless is false.
+func compileComparison(op string, prop xml.Name, literal string, caseless bool) (searchMatcher, error) {
+	if prop.Space != "DAV:" {
+		return nil, fmt.Errorf("unsupported property %s", prop.Local)
+	}
+
+	var cmp func(e *indexEntry) (int, bool)
+	switch prop.Local {
+	case "displayname", "getcontenttype":
+		if op == "like" {
+			re, err := likePattern(literal, caseless)
+			if err != nil {
+				return nil, err
+			}
+			value := searchString(prop.Local)
+			return func(e *indexEntry) bool { return re.MatchString(value(e)) }, nil
+		}
+		value := searchString(prop.Local)
+		cmp = func(e *indexEntry) (int, bool) {
+			a, b := value(e), literal
+			if caseless {
+				a, b = strings.ToLower(a), strings.ToLower(b)
+			}
+			return strings.Compare(a, b), true
+		}
+	case "getcontentlength":
+		n, err := strconv.ParseInt(strings.TrimSpace(literal), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid length %q", literal)
+		}
+		cmp = func(e *indexEntry) (int, bool) {
+			if e.IsDir {
+				return 0, false
+			}
+			return compareInt64(e.Size, n), true
+		}
+	case "getlastmodified":
+		t, err := http.ParseTime(strings.TrimSpace(literal))
+		if err != nil {
+			if t, err = time.Parse(time.RFC3339, strings.TrimSpace(literal)); err != nil {
+				return nil, fmt.Errorf("invalid date %q", literal)
+			}
+		}
+		cmp = func(e *indexEntry) (int, bool) {
+			m := e.ModTime.Truncate(time.Second)
+			switch {
+			case m.Before(t):
+				return -1, true
+			case m.After(t):
+				return 1, true
+			}
+			return 0, true
+		}
+	default:
+		return nil, fmt.Errorf("unsupported property %s", prop.Local)
+	}
+	if op == "like" {
+		return nil, fmt.Errorf("like is not supported for %s", prop.Local)
+	}
+
+	return func(e *indexEntry) bool {
+		c, ok := cmp(e)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return c == 0
+		case "lt":
+			return c < 0
+		case "lte":
+			return c <= 0
+		case "gt":
+			return c > 0
+		}
+		return c >= 0
+	}, nil
+}
+
+// searchString returns a function returning a string property of an entry.
+func searchString(prop string) func(e *indexEntry) string {
+	if prop == "getcontenttype" {
+		return func(e *indexEntry) string { return e.ContentType() }
+	}
+
+	return func(e *indexEntry) string { return e.Name }
+}
+
+// searchLess returns a function ordering entries by a property.
+func searchLess(prop xml.Name) (func(a, b *indexEntry) bool, error) {
+	if prop.Space != "DAV:" {
+		return nil, fmt.Errorf("unsupported property %s", prop.Local)
+	}
+
+	switch prop.Local {
+	case "displayname":
+		return func(a, b *indexEntry) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }, nil
+	case "getcontenttype":
+		return func(a, b *indexEntry) bool { return a.ContentType() < b.ContentType() }, nil
+	case "getcontentlength":
+		return func(a, b *indexEntry) bool { return a.Size < b.Size }, nil
+	case "getlastmodified":
+		return func(a, b *indexEntry) bool { return a.ModTime.Before(b.ModTime) }, nil
+	}
+
+	return nil, fmt.Errorf("unsupported property %s", prop.Local)
+}
+
+// likePattern translates the pattern of the like operator, where "%" matches any number
+// of characters, "_" a single character and "\" escapes them, into a regular expression.
+func likePattern(pattern string, caseless bool) (*regexp.Regexp, error) {
+	var b strings.Builder
+	if caseless {
+		b.WriteString("(?is)")
+	} else {
+		b.WriteString("(?s)")
+	}
+	b.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			b.WriteString(".*")
+		case r == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+// writeSearchResults writes the results as multistatus response.
+func writeSearchResults(w http.ResponseWriter, a *App, view searchScope, results []*indexEntry, props []xml.Name) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+	for _, e := range results {
+		href := (&url.URL{Path: a.Config.Prefix + view.userPath(e)}).EscapedPath()
+		buf.WriteString("<D:response><D:href>")
+		xml.EscapeText(&buf, []byte(href))
+		buf.WriteString("</D:href>")
+
+		var found, missing bytes.Buffer
+		for _, p := range props {
+			value, ok := searchPropValue(e, p)
+			if !ok {
+				writeSearchProp(&missing, p, "")
+				continue
+			}
+			writeSearchProp(&found, p, value)
+		}
+		if found.Len() > 0 {
+			fmt.Fprintf(&buf, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>", found.String())
+		}
+		if missing.Len() > 0 {
+			fmt.Fprintf(&buf, "<D:propstat><D:prop>%s</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>", missing.String())
+		}
+		buf.WriteString("</D:response>")
+	}
+	buf.WriteString("</D:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	w.Write(buf.Bytes())
+}
+
+// writeSearchProp writes an element of a property with an escaped value. The name and
+// namespace stem from the request, so they are escaped as well.
+func writeSearchProp(buf *bytes.Buffer, p xml.Name, value string) {
+	buf.WriteString("<")
+	xml.EscapeText(buf, []byte(p.Local))
+	buf.WriteString(` xmlns="`)
+	xml.EscapeText(buf, []byte(p.Space))
+	if value == "" {
+		buf.WriteString(`"/>`)
+		return
+	}
+	buf.WriteString(`">`)
+	buf.WriteString(value)
+	buf.WriteString("</")
+	xml.EscapeText(buf, []byte(p.Local))
+	buf.WriteString(">")
+}
+
+// searchPropValue returns the escaped xml value of a property of an entry.
+func searchPropValue(e *indexEntry, prop xml.Name) (string, bool) {
+	if prop.Space != "DAV:" {
+		return "", false
+	}
+
+	var value string
+	switch prop.Local {
+	case "displayname":
+		value = e.Name
+	case "getcontentlength":
+		if e.IsDir {
+			return "", false
+		}
+		value = strconv.FormatInt(e.Size, 10)
+	case "getlastmodified":
+		value = e.ModTime.UTC().Format(http.TimeFormat)
+	case "getcontenttype":
+		if e.IsDir {
+			return "", false
+		}
+		value = e.ContentType()
+	case "resourcetype":
+		if e.IsDir {
+			return "<D:collection/>", true
+		}
+		return "", true
+	default:
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+
+	return buf.String(), true
+}
@@ -0,0 +1,304 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		caseless bool
+		value    string
+		want     bool
+	}{
+		{"%.pdf", true, "Spec.PDF", true},
+		{"%.pdf", false, "Spec.PDF", false},
+		{"spec_.txt", true, "spec1.txt", true},
+		{"spec_.txt", true, "spec12.txt", false},
+		{"100\\%", true, "100%", true},
+		{"100\\%", true, "1000", false},
+		{"a.c", true, "abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.value, func(t *testing.T) {
+			re, err := likePattern(tt.pattern, tt.caseless)
+			if err != nil {
+				t.Fatalf("likePattern() error = %v", err)
+			}
+			if got := re.MatchString(tt.value); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeSearch(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "specs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "specs", "api.pdf"), []byte("0123456789"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "specs", "notes.txt"), []byte("0123"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "inbox", "secret.pdf"), []byte("0123"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "other.pdf"), []byte("0123"), 0600)
+
+	config := createTestConfig(tmpDir)
+	config.Prefix = "/dav"
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox"}}
+	events := NewEventBus()
+	dir := &Dir{Config: config, Events: events}
+	index := NewIndex(config)
+	index.addTree("/")
+	events.Subscribe(index.apply)
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{Prefix: "/dav", FileSystem: dir, LockSystem: webdav.NewMemLS()},
+		Index:   index,
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	query := func(scope, depth, where string) string {
+		return `<?xml version="1.0"?><d:searchrequest xmlns:d="DAV:"><d:basicsearch>` +
+			`<d:select><d:prop><d:displayname/><d:getcontentlength/></d:prop></d:select>` +
+			`<d:from><d:scope><d:href>` + scope + `</d:href><d:depth>` + depth + `</d:depth></d:scope></d:from>` +
+			`<d:where>` + where + `</d:where>` +
+			`<d:orderby><d:order><d:prop><d:getcontentlength/></d:prop><d:descending/></d:order></d:orderby>` +
+			`</d:basicsearch></d:searchrequest>`
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		want       []string
+	}{
+		{"by name", query("/dav/", "infinity", `<d:like><d:prop><d:displayname/></d:prop><d:literal>%.PDF</d:literal></d:like>`), 207, []string{"/dav/specs/api.pdf"}},
+		{"by size", query("/dav/", "infinity", `<d:and><d:not><d:is-collection/></d:not><d:gt><d:prop><d:getcontentlength/></d:prop><d:literal>1</d:literal></d:gt></d:and>`), 207, []string{"/dav/specs/api.pdf", "/dav/specs/notes.txt"}},
+		{"directories", query("http://example.com/dav/", "1", `<d:is-collection/>`), 207, []string{"/dav/", "/dav/inbox/", "/dav/specs/"}},
+		{"depth 1", query("/dav/", "1", `<d:like><d:prop><d:displayname/></d:prop><d:literal>%.pdf</d:literal></d:like>`), 207, nil},
+		{"unsupported property", query("/dav/", "infinity", `<d:eq><d:prop><d:owner/></d:prop><d:literal>x</d:literal></d:eq>`), 400, nil},
+		{"invalid body", "<propfind/>", 400, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serve(user1, w, httptest.NewRequest("SEARCH", "/dav/", strings.NewReader(tt.body)), a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+			if tt.statusCode != 207 {
+				return
+			}
+			if got := searchHrefs(w.Body.String()); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("results = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the index follows changes made through dave
+	if err := dir.Rename(user1, "/specs", "/archive"); err != nil {
+		t.Fatalf("Rename() error = %v", err)
+	}
+	w := httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("SEARCH", "/dav/", strings.NewReader(query("/dav/", "infinity", `<d:eq><d:prop><d:displayname/></d:prop><d:literal>api.pdf</d:literal></d:eq>`))), a)
+	if got := searchHrefs(w.Body.String()); strings.Join(got, ",") != "/dav/archive/api.pdf" {
+		t.Errorf("results after rename = %v, want [/dav/archive/api.pdf]", got)
+	}
+
+	// names of requested properties are escaped
+	injection := `<?xml version="1.0"?><d:searchrequest xmlns:d="DAV:"><d:basicsearch>` +
+		`<d:select><d:prop><x:foo xmlns:x="urn:&quot;/&gt;&lt;evil/&gt;"/></d:prop></d:select>` +
+		`<d:from><d:scope><d:href>/dav/</d:href><d:depth>1</d:depth></d:scope></d:from>` +
+		`<d:where><d:is-collection/></d:where></d:basicsearch></d:searchrequest>`
+	w = httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("SEARCH", "/dav/", strings.NewReader(injection)), a)
+	if w.Code != 207 {
+		t.Fatalf("status = %v, want 207", w.Code)
+	}
+	decoder := xml.NewDecoder(strings.NewReader(w.Body.String()))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+		}
+		if e, ok := token.(xml.StartElement); ok && e.Name.Local == "evil" {
+			t.Fatalf("response contains injected element: %s", w.Body.String())
+		}
+	}
+}
+
+var hrefPattern = regexp.MustCompile(`<D:href>([^<]*)</D:href>`)
+
+func searchHrefs(body string) []string {
+	var hrefs []string
+	for _, m := range hrefPattern.FindAllStringSubmatch(body, -1) {
+		hrefs = append(hrefs, m[1])
+	}
+
+	return hrefs
+}
+
+func TestServeSearchAPI(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "specs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "specs", "api.md"), []byte("# API\nThe upload protocol uses chunks."), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "notes.txt"), []byte("Upload limits"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "inbox", "secret.txt"), []byte("upload protocol"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "other.txt"), []byte("upload protocol"), 0600)
+
+	config := createTestConfig(tmpDir)
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox"}}
+	config.Search.FullText = true
+	events := NewEventBus()
+	dir := &Dir{Config: config, Events: events}
+	index := NewIndex(config)
+	index.addTree("/")
+	events.Subscribe(index.apply)
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: dir, LockSystem: webdav.NewMemLS()},
+		Index:   index,
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		name       string
+		target     string
+		statusCode int
+		want       string
+	}{
+		{"all words", "/.dave/search?q=upload+proto", 200, "/specs/api.md"},
+		{"prefix", "/.dave/search?q=uplo", 200, "/notes.txt,/specs/api.md"},
+		{"path", "/.dave/search?q=upload&path=/specs", 200, "/specs/api.md"},
+		{"limit", "/.dave/search?q=upload&limit=1", 200, "/notes.txt"},
+		{"no match", "/.dave/search?q=missing", 200, ""},
+		{"missing query", "/.dave/search", 400, ""},
+		{"invalid limit", "/.dave/search?q=upload&limit=x", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			serve(user1, w, httptest.NewRequest("GET", tt.target, nil), a)
+			if w.Code != tt.statusCode {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+			if tt.statusCode != 200 {
+				return
+			}
+			var results []searchResult
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Path)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("results = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the contains operator of SEARCH requests uses the same index
+	body := `<?xml version="1.0"?><d:searchrequest xmlns:d="DAV:"><d:basicsearch>` +
+		`<d:select><d:prop><d:displayname/></d:prop></d:select>` +
+		`<d:from><d:scope><d:href>/</d:href><d:depth>infinity</d:depth></d:scope></d:from>` +
+		`<d:where><d:contains>Chunks</d:contains></d:where></d:basicsearch></d:searchrequest>`
+	w := httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("SEARCH", "/", strings.NewReader(body)), a)
+	if got := searchHrefs(w.Body.String()); strings.Join(got, ",") != "/specs/api.md" {
+		t.Errorf("contains results = %v, want [/specs/api.md]", got)
+	}
+
+	// changed content is indexed again
+	f, err := dir.OpenFile(user1, "/notes.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("OpenFile() error = %v", err)
+	}
+	f.Write([]byte("chunks"))
+	f.Close()
+	w = httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("GET", "/.dave/search?q=chunks", nil), a)
+	if !strings.Contains(w.Body.String(), `"/notes.txt"`) {
+		t.Errorf("results after write = %s, want /notes.txt", w.Body.String())
+	}
+}
+
+func TestServeSearchSymlinks(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "data", "subdir1"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "data", "subdir2"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "host"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "subdir1", "notes.txt"), []byte("meeting notes"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "data", "subdir2", "private.txt"), []byte("private plans"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "host", "passwd.txt"), []byte("root password"), 0600)
+	os.Symlink("notes.txt", filepath.Join(tmpDir, "data", "subdir1", "inside.txt"))
+	os.Symlink("../subdir2/private.txt", filepath.Join(tmpDir, "data", "subdir1", "other.txt"))
+	os.Symlink("../../host/passwd.txt", filepath.Join(tmpDir, "data", "subdir1", "link.txt"))
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	tests := []struct {
+		policy string
+		query  string
+		want   string
+	}{
+		{SymlinksFollow, "password", "/link.txt"},
+		{SymlinksFollow, "plans", "/other.txt"},
+		{SymlinksDeny, "password", ""},
+		{SymlinksDeny, "meeting", "/notes.txt"},
+		{SymlinksConfine, "password", ""},
+		{SymlinksConfine, "plans", ""},
+		{SymlinksConfine, "meeting", "/inside.txt,/notes.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.query, func(t *testing.T) {
+			config := createTestConfig(filepath.Join(tmpDir, "data"))
+			config.Search.FullText = true
+			config.Symlinks = tt.policy
+			index := NewIndex(config)
+			index.addTree("/")
+			a := &App{
+				Config:  config,
+				Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+				Index:   index,
+			}
+
+			w := httptest.NewRecorder()
+			serve(user1, w, httptest.NewRequest("GET", "/.dave/search?q="+tt.query, nil), a)
+			var results []searchResult
+			if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+				t.Fatalf("invalid response: %v: %s", err, w.Body.String())
+			}
+			var got []string
+			for _, r := range results {
+				got = append(got, r.Path)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("results = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,13 +6,21 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/bcrypt"
+	"net"
 	"net/http"
 	"strings"
 )
 
 type contextKey int
 
-var authInfoKey contextKey
+const (
+	authInfoKey contextKey = iota
+	remoteAddrKey
+	anonymousKey
+	uploadKey
+	throttleKey
+	forwardedAddrKey
+)
 
 // AuthInfo holds the username and authentication status
 type AuthInfo struct {
@@ -33,7 +41,7 @@ func (f authWebdavHandlerFunc) ServeHTTP(c context.Context, w http.ResponseWrite
 // The handler will use the application config for user and password lookups.
 func NewBasicAuthWebdavHandler(a *App) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.Background()
+		ctx := r.Context()
 		handlerFunc := authWebdavHandlerFunc(handle)
 		handlerFunc.ServeHTTP(ctx, w, r, a)
 	})
@@ -82,9 +90,41 @@ func handle(ctx context.Context, w http.ResponseWriter, req *http.Request, a *Ap
 		}
 	}
 
+	ctx, w, req = throttleRequest(ctx, w, req, a)
+	if cw, ok := compressResponse(w, req, a.Config.Compression); ok {
+		defer cw.Close()
+		w = cw
+	}
+
+	var ok bool
+	if ctx, w, req, ok = trackUpload(ctx, w, req, a); !ok {
+		return
+	}
+
+	// share links are resolved without the authentication of users
+	// except for copies and moves between them and the files of users
+	if endpoint, ok := apiEndpoint(a.Config, req.URL.Path); ok && strings.HasPrefix(endpoint, "s/") && !crossTransfer(a.Config, req) {
+		serveShare(ctx, w, req, a, strings.SplitN(strings.TrimPrefix(endpoint, "s/"), "/", 2)[0])
+		return
+	}
+
+	ctx = context.WithValue(ctx, remoteAddrKey, remoteAddr(req))
+	ctx = context.WithValue(ctx, forwardedAddrKey, forwardedAddr(a.Config, req))
+
 	// if there are no users, we don't need authentication here
 	if !a.Config.AuthenticationNeeded() {
-		a.Handler.ServeHTTP(w, req.WithContext(ctx))
+		serve(ctx, w, req, a)
+		return
+	}
+
+	if a.Config.Anonymous.Enabled && req.Header.Get("Authorization") == "" {
+		ctx = context.WithValue(ctx, anonymousKey, true)
+		if !readOnlyMethod(req.Method) && !(req.Method == http.MethodPut && anonymousUpload(ctx, req, a)) {
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+		ctx = context.WithValue(ctx, authInfoKey, &AuthInfo{Username: "", Authenticated: false})
+		serve(ctx, w, req, a)
 		return
 	}
 
@@ -96,18 +136,7 @@ func handle(ctx context.Context, w http.ResponseWriter, req *http.Request, a *Ap
 
 	authInfo, err := authenticate(a.Config, username, password)
 	if err != nil {
-		ipAddr := req.Header.Get("X-Forwarded-For")
-		if len(ipAddr) == 0 {
-			remoteAddr := req.RemoteAddr
-			lastIndex := strings.LastIndex(remoteAddr, ":")
-			if lastIndex != -1 {
-				ipAddr = remoteAddr[:lastIndex]
-			} else {
-				ipAddr = remoteAddr
-			}
-		}
-
-		log.WithField("user", username).WithField("address", ipAddr).WithError(err).Warn("User failed to login")
+		log.WithField("user", username).WithField("address", clientAddr(a.Config, req)).WithError(err).Warn("User failed to login")
 	}
 
 	if !authInfo.Authenticated {
@@ -116,7 +145,100 @@ func handle(ctx context.Context, w http.ResponseWriter, req *http.Request, a *Ap
 	}
 
 	ctx = context.WithValue(ctx, authInfoKey, authInfo)
-	a.Handler.ServeHTTP(w, req.WithContext(ctx))
+	serve(ctx, w, req, a)
+}
+
+// isAnonymous returns whether the request has been granted anonymous read-only access.
+func isAnonymous(ctx context.Context) bool {
+	anonymous, _ := ctx.Value(anonymousKey).(bool)
+	return anonymous
+}
+
+// anonymousUpload returns whether an anonymous request uploads into a drop box.
+func anonymousUpload(ctx context.Context, req *http.Request, a *App) bool {
+	name, ok := a.webdavPath(req.URL.Path)
+	return ok && (Dir{Config: a.Config}).acceptsUpload(ctx, name)
+}
+
+// readOnlyMethod returns whether the http method doesn't modify any resources.
+func readOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "SEARCH":
+		return true
+	}
+
+	return false
+}
+
+// RemoteAddrFromContext returns the client address of the current request.
+func RemoteAddrFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(remoteAddrKey).(string)
+	return addr
+}
+
+// forwardedAddrFromContext returns the client address which a trusted proxy forwarded for
+// the current request.
+func forwardedAddrFromContext(ctx context.Context) string {
+	addr, _ := ctx.Value(forwardedAddrKey).(string)
+	return addr
+}
+
+// remoteAddr returns the address of the connection of a request. Unlike headers, it
+// can't be forged by the client.
+func remoteAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// forwardedAddr returns the client address of the X-Forwarded-For header, if the request
+// has been sent by a trusted proxy. Trusted proxies in the chain are skipped.
+func forwardedAddr(config *Config, req *http.Request) string {
+	if !config.trustedProxy(remoteAddr(req)) {
+		return ""
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop != "" && (i == 0 || !config.trustedProxy(hop)) {
+			return hop
+		}
+	}
+
+	return ""
+}
+
+// clientAddr returns the address of the client of a request: the forwarded address if
+// the request has been sent by a trusted proxy, the address of the connection otherwise.
+func clientAddr(config *Config, req *http.Request) string {
+	if addr := forwardedAddr(config, req); addr != "" {
+		return addr
+	}
+
+	return remoteAddr(req)
+}
+
+// trustedProxy returns whether an address matches one of the trusted proxies, which are
+// given as addresses or CIDR ranges.
+func (cfg *Config) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range cfg.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func httpAuth(r *http.Request, config *Config) (string, string, bool) {
@@ -3,10 +3,16 @@ package app
 import (
 	"context"
 	"golang.org/x/net/webdav"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestAuthenticate(t *testing.T) {
@@ -182,6 +188,39 @@ func TestAuthFromContext(t *testing.T) {
 	}
 }
 
+func TestClientAddr(t *testing.T) {
+	config := &Config{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"}}
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		wantRemote    string
+		wantForwarded string
+	}{
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1", ""},
+		{"untrusted connection", "1.2.3.4:1234", []string{"5.6.7.8"}, "1.2.3.4", ""},
+		{"trusted proxy", "10.0.0.1:1234", []string{"5.6.7.8"}, "10.0.0.1", "5.6.7.8"},
+		{"forged hop", "10.0.0.1:1234", []string{"6.6.6.6, 5.6.7.8"}, "10.0.0.1", "5.6.7.8"},
+		{"chain of proxies", "192.168.1.1:1234", []string{"5.6.7.8, 10.0.0.1", "192.168.2.2"}, "192.168.1.1", "5.6.7.8"},
+		{"ipv6", "[::1]:1234", []string{"5.6.7.8"}, "::1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if got := remoteAddr(r); got != tt.wantRemote {
+				t.Errorf("remoteAddr() = %v, want %v", got, tt.wantRemote)
+			}
+			if got := forwardedAddr(config, r); got != tt.wantForwarded {
+				t.Errorf("forwardedAddr() = %v, want %v", got, tt.wantForwarded)
+			}
+		})
+	}
+}
+
 func TestHandle(t *testing.T) {
 	type args struct {
 		ctx      context.Context
@@ -266,3 +305,67 @@ func TestHandle(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleAnonymous(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["admin"].Password = GenHash([]byte("password"))
+	os.MkdirAll(filepath.Join(tmpDir, "public"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "public", "readme"), []byte("public"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "secret"), []byte("secret"), 0600)
+
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		method     string
+		path       string
+		auth       bool
+		statusCode int
+		body       string
+	}{
+		{"disabled", false, "GET", "/readme", false, 401, ""},
+		{"read public file", true, "GET", "/readme", false, 200, "public"},
+		{"no access outside", true, "GET", "/secret", false, 404, ""},
+		{"list public dir", true, "PROPFIND", "/", false, 207, "readme"},
+		{"write needs auth", true, "PUT", "/new", false, 401, ""},
+		{"delete needs auth", true, "DELETE", "/readme", false, 401, ""},
+		{"api needs auth", true, "GET", "/.dave/events", false, 401, ""},
+		{"authenticated full access", true, "GET", "/secret", true, 200, "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Anonymous = Anonymous{Enabled: tt.enabled, Subdir: "/public"}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.auth {
+				r.SetBasicAuth("admin", "password")
+			}
+
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %v, want %v", w.Body.String(), tt.body)
+			}
+		})
+	}
+
+	anonymous := context.WithValue(context.Background(), anonymousKey, true)
+	d := Dir{Config: config}
+	if err := d.Mkdir(anonymous, "/dir", 0700); err != os.ErrPermission {
+		t.Errorf("Dir.Mkdir() anonymous error = %v, want %v", err, os.ErrPermission)
+	}
+	if _, err := d.OpenFile(anonymous, "/readme", os.O_RDWR, 0); err != os.ErrPermission {
+		t.Errorf("Dir.OpenFile() anonymous error = %v, want %v", err, os.ErrPermission)
+	}
+}
@@ -0,0 +1,553 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+// Modes of share links.
+const (
+	// ShareRead allows listing and downloading the shared files.
+	ShareRead = "read"
+	// ShareUpload allows uploading new files only ("file drop").
+	ShareUpload = "upload"
+)
+
+// ErrShareNotFound is returned for unknown or expired share links.
+var ErrShareNotFound = errors.New("share not found")
+
+// Share is a link which grants access to a file or directory of a users tree without
+// authentication as that user.
+type Share struct {
+	Token        string     `json:"token"`
+	User         string     `json:"user"`
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"`
+	Password     string     `json:"password,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int        `json:"maxDownloads,omitempty"`
+	Downloads    int        `json:"downloads"`
+	Created      time.Time  `json:"created"`
+}
+
+// Expired returns whether the share is expired or used up.
+func (s *Share) Expired() bool {
+	if s.Expires != nil && time.Now().After(*s.Expires) {
+		return true
+	}
+
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// ShareStore keeps the share links in a JSON file. Changes of the file by other
+// processes, e.g. davecli, are picked up on access.
+type ShareStore struct {
+	mu      sync.Mutex
+	file    string
+	modTime time.Time
+	shares  map[string]*Share
+	locks   map[string]webdav.LockSystem
+}
+
+// NewShareStore creates a store backed by the given file.
+func NewShareStore(file string) *ShareStore {
+	return &ShareStore{
+		file:   file,
+		shares: make(map[string]*Share),
+		locks:  make(map[string]webdav.LockSystem),
+	}
+}
+
+// reload reads the file if it has been changed. The caller must hold the lock.
+func (s *ShareStore) reload() error {
+	fi, err := os.Stat(s.file)
+	if os.IsNotExist(err) {
+		s.shares = make(map[string]*Share)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+	var shares []*Share
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &shares); err != nil {
+			return fmt.Errorf("corrupt share file %s: %s", s.file, err)
+		}
+	}
+
+	s.shares = make(map[string]*Share, len(shares))
+	for _, share := range shares {
+		s.shares[share.Token] = share
+	}
+	s.modTime = fi.ModTime()
+
+	return nil
+}
+
+// persist writes all shares to the file. The caller must hold the lock.
+func (s *ShareStore) persist() error {
+	shares := make([]*Share, 0, len(s.shares))
+	for _, share := range s.shares {
+		shares = append(shares, share)
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+
+	b, err := json.MarshalIndent(shares, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(s.file); err == nil {
+		s.modTime = fi.ModTime()
+	}
+
+	return nil
+}
+
+// Get returns a copy of a valid share.
+func (s *ShareStore) Get(token string) (*Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	share := s.shares[token]
+	if share == nil || share.Expired() {
+		return nil, ErrShareNotFound
+	}
+
+	c := *share
+	return &c, nil
+}
+
+// List returns copies of all shares of a user, or of all users if username is nil.
+func (s *ShareStore) List(username *string) ([]*Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	shares := []*Share{}
+	for _, share := range s.shares {
+		if username == nil || *username == share.User {
+			c := *share
+			shares = append(shares, &c)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+
+	return shares, nil
+}
+
+// Add stores a new share.
+func (s *ShareStore) Add(share *Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+	s.shares[share.Token] = share
+
+	return s.persist()
+}
+
+// Delete removes a share. If username isn't nil, only shares of this user are removed.
+func (s *ShareStore) Delete(token string, username *string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+	share := s.shares[token]
+	if share == nil || (username != nil && *username != share.User) {
+		return ErrShareNotFound
+	}
+	delete(s.shares, token)
+	delete(s.locks, token)
+
+	return s.persist()
+}
+
+// countDownload increments the download counter of a share. It returns false if the
+// share has been used up in the meantime.
+func (s *ShareStore) countDownload(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.reload(); err != nil {
+		return false, err
+	}
+	share := s.shares[token]
+	if share == nil || share.Expired() {
+		return false, nil
+	}
+	share.Downloads++
+
+	return true, s.persist()
+}
+
+// lockSystem returns the lock system of a share.
+func (s *ShareStore) lockSystem(token string) webdav.LockSystem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ls := s.locks[token]
+	if ls == nil {
+		ls = webdav.NewMemLS()
+		s.locks[token] = ls
+	}
+
+	return ls
+}
+
+// CreateShare validates a new share of a path within the tree of the user, hashes the
+// password and adds it to the store with a random token.
+func CreateShare(config *Config, store *ShareStore, share *Share, password string) error {
+	if config.AuthenticationNeeded() && config.Users[share.User] == nil {
+		return fmt.Errorf("user %q not found", share.User)
+	}
+	if share.Mode == "" {
+		share.Mode = ShareRead
+	}
+	if share.Mode != ShareRead && share.Mode != ShareUpload {
+		return fmt.Errorf("invalid mode %q", share.Mode)
+	}
+	if share.MaxDownloads < 0 {
+		return errors.New("max downloads must not be negative")
+	}
+	share.Path = path.Clean("/" + share.Path)
+
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: share.User, Authenticated: true})
+	fi, err := (Dir{Config: config}).Stat(ctx, share.Path)
+	if err != nil {
+		return fmt.Errorf("path %q not found", share.Path)
+	}
+	if share.Mode == ShareUpload && !fi.IsDir() {
+		return errors.New("upload shares require a directory")
+	}
+
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		share.Password = string(hash)
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	share.Token = base64.RawURLEncoding.EncodeToString(token)
+	share.Created = time.Now()
+	share.Downloads = 0
+
+	return store.Add(share)
+}
+
+// shareFS restricts a file system to the shared path and the mode of a share.
+type shareFS struct {
+	fs   webdav.FileSystem
+	root string
+	mode string
+}
+
+func (s shareFS) resolve(name string) string {
+	return path.Join(s.root, path.Clean("/"+name))
+}
+
+// Mkdir is prohibited for shares.
+func (s shareFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+// OpenFile allows reading in read mode and creating new files in upload mode only.
+func (s shareFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch s.mode {
+	case ShareRead:
+		if writing || flag&os.O_CREATE != 0 {
+			return nil, os.ErrPermission
+		}
+	case ShareUpload:
+		if !writing || flag&os.O_CREATE == 0 {
+			return nil, os.ErrPermission
+		}
+		flag |= os.O_EXCL
+	default:
+		return nil, os.ErrPermission
+	}
+
+	return s.fs.OpenFile(ctx, s.resolve(name), flag, perm)
+}
+
+// RemoveAll is prohibited for shares.
+func (s shareFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+// Rename is prohibited for shares.
+func (s shareFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+// Stat reveals files in read mode only.
+func (s shareFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if s.mode != ShareRead {
+		return nil, os.ErrNotExist
+	}
+
+	return s.fs.Stat(ctx, s.resolve(name))
+}
+
+var dropTemplate = template.Must(template.ParseFS(uiFiles, "ui/drop.html"))
+
+// shareInfo is the representation of a share in the api. It hides the password hash.
+type shareInfo struct {
+	*Share
+	Password  string `json:"password,omitempty"`
+	Protected bool   `json:"protected"`
+	URL       string `json:"url"`
+}
+
+func newShareInfo(config *Config, share *Share) shareInfo {
+	return shareInfo{
+		Share:     share,
+		Protected: share.Password != "",
+		URL:       ShareURLPath(config, share.Token),
+	}
+}
+
+// ShareURLPath returns the path of the url of a share link.
+func ShareURLPath(config *Config, token string) string {
+	return strings.TrimSuffix(config.Prefix, "/") + apiPath + "s/" + token
+}
+
+// shareRequest is the body of a request creating a share.
+type shareRequest struct {
+	Path         string     `json:"path"`
+	Mode         string     `json:"mode"`
+	Expires      *time.Time `json:"expires"`
+	Password     string     `json:"password"`
+	MaxDownloads int        `json:"maxDownloads"`
+}
+
+// serveShareAPI allows authenticated users to list (GET shares), create (POST shares) and
+// delete (DELETE shares/<token>) their share links.
+func serveShareAPI(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, token string) {
+	if a.Shares == nil {
+		http.Error(w, "share links are not enabled", http.StatusNotFound)
+		return
+	}
+	username := ""
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		username = authInfo.Username
+	}
+
+	switch {
+	case token == "" && req.Method == http.MethodGet:
+		shares, err := a.Shares.List(&username)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithError(err).Error("Error reading share links")
+			return
+		}
+		infos := make([]shareInfo, 0, len(shares))
+		for _, share := range shares {
+			infos = append(infos, newShareInfo(a.Config, share))
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case token == "" && req.Method == http.MethodPost:
+		var body shareRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		share := &Share{
+			User:         username,
+			Path:         body.Path,
+			Mode:         body.Mode,
+			Expires:      body.Expires,
+			MaxDownloads: body.MaxDownloads,
+		}
+		if err := CreateShare(a.Config, a.Shares, share, body.Password); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.WithField("user", username).WithField("path", share.Path).Info("Created share link")
+		writeJSON(w, http.StatusCreated, newShareInfo(a.Config, share))
+	case token != "" && req.Method == http.MethodDelete:
+		err := a.Shares.Delete(token, &username)
+		if err == ErrShareNotFound {
+			http.NotFound(w, req)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.WithError(err).Error("Error deleting share link")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveShare serves the shared files of a share link. Requests are handled outside of
+// the basic auth of the users and act on behalf of the owner of the share.
+func serveShare(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, token string) {
+	if a.Shares == nil {
+		http.NotFound(w, req)
+		return
+	}
+	share, err := a.Shares.Get(token)
+	if err == ErrShareNotFound || (err == nil && a.Config.AuthenticationNeeded() && a.Config.Users[share.User] == nil) {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.WithError(err).Error("Error reading share links")
+		return
+	}
+
+	if share.Password != "" {
+		_, password, ok := req.BasicAuth()
+		if !ok || bcrypt.CompareHashAndPassword([]byte(share.Password), []byte(password)) != nil {
+			if ok {
+				log.WithField("share", token).WithField("address", clientAddr(a.Config, req)).Warn("Wrong password for share link")
+			}
+			writeUnauthorized(w, a.Config.Realm)
+			return
+		}
+	}
+
+	ctx = context.WithValue(ctx, authInfoKey, &AuthInfo{Username: share.User, Authenticated: share.User != ""})
+	ctx = context.WithValue(ctx, remoteAddrKey, remoteAddr(req))
+	ctx = context.WithValue(ctx, forwardedAddrKey, forwardedAddr(a.Config, req))
+
+	prefix := ShareURLPath(a.Config, token)
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: shareFS{fs: a.Handler.FileSystem, root: share.Path, mode: share.Mode},
+		LockSystem: a.Shares.lockSystem(token),
+		Logger:     a.Handler.Logger,
+	}
+	shareConfig := *a.Config
+	shareConfig.Prefix = prefix
+	shareApp := &App{Config: &shareConfig, Handler: handler}
+
+	switch {
+	case share.Mode == ShareRead && (req.Method == http.MethodGet || req.Method == http.MethodHead):
+		if serveListing(ctx, w, req, shareApp) {
+			return
+		}
+		if req.Method != http.MethodGet {
+			handler.ServeHTTP(w, req.WithContext(ctx))
+			return
+		}
+		dw := &downloadWriter{ResponseWriter: w}
+		handler.ServeHTTP(dw, req.WithContext(ctx))
+		if dw.complete() {
+			if _, err := a.Shares.countDownload(token); err != nil {
+				log.WithError(err).Error("Error counting download of share link")
+			}
+		}
+	case share.Mode == ShareRead && (req.Method == http.MethodOptions || req.Method == "PROPFIND"):
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	case share.Mode == ShareUpload && req.Method == http.MethodGet:
+		if name, _ := shareApp.webdavPath(req.URL.Path); strings.Trim(name, "/") != "" {
+			http.NotFound(w, req)
+			return
+		}
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dropTemplate.Execute(w, nil); err != nil {
+			log.WithError(err).Error("Error rendering upload page")
+		}
+	case share.Mode == ShareUpload && (req.Method == http.MethodPut || req.Method == http.MethodOptions):
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// downloadWriter records whether a GET request of a share link has been answered with
+// the whole file, which counts as download.
+type downloadWriter struct {
+	http.ResponseWriter
+	status int
+	failed bool
+}
+
+// WriteHeader records the status of the response.
+func (w *downloadWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write records whether sending the body failed.
+func (w *downloadWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.failed = true
+	}
+
+	return n, err
+}
+
+// complete returns whether the whole file has been sent.
+func (w *downloadWriter) complete() bool {
+	return w.status == http.StatusOK && !w.failed
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("Error writing json response")
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeShare(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "file"), []byte("content"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "inbox", "existing"), []byte("content"), 0600)
+
+	store := NewShareStore(filepath.Join(tmpDir, "shares.json"))
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+		Shares:  store,
+	}
+
+	read := &Share{User: "user1", Path: "/docs", Mode: ShareRead, MaxDownloads: 1}
+	if err := CreateShare(config, store, read, ""); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+	protected := &Share{User: "user1", Path: "/docs/file"}
+	if err := CreateShare(config, store, protected, "secret"); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+	upload := &Share{User: "user1", Path: "/inbox", Mode: ShareUpload}
+	if err := CreateShare(config, store, upload, ""); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+	if err := CreateShare(config, store, &Share{User: "user1", Path: "/missing"}, ""); err == nil {
+		t.Errorf("CreateShare() of missing path error = nil, want error")
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		password   string
+		statusCode int
+	}{
+		{"unknown token", "GET", "/.dave/s/unknown/file", "", 404},
+		{"listing", "GET", "/.dave/s/" + read.Token + "/", "", 200},
+		{"missing file", "GET", "/.dave/s/" + read.Token + "/missing", "", 404},
+		{"head", "HEAD", "/.dave/s/" + read.Token + "/file", "", 200},
+		{"ranged download", "GET", "/.dave/s/" + read.Token + "/file", "", 206},
+		{"download", "GET", "/.dave/s/" + read.Token + "/file", "", 200},
+		{"download limit reached", "GET", "/.dave/s/" + read.Token + "/file", "", 404},
+		{"password missing", "GET", "/.dave/s/" + protected.Token, "", 401},
+		{"password wrong", "GET", "/.dave/s/" + protected.Token, "wrong", 401},
+		{"password correct", "GET", "/.dave/s/" + protected.Token, "secret", 200},
+		{"read only", "PUT", "/.dave/s/" + protected.Token, "secret", 405},
+		{"upload page", "GET", "/.dave/s/" + upload.Token + "/", "", 200},
+		{"upload", "PUT", "/.dave/s/" + upload.Token + "/new", "", 201},
+		{"upload existing", "PUT", "/.dave/s/" + upload.Token + "/existing", "", 404},
+		{"upload no download", "GET", "/.dave/s/" + upload.Token + "/existing", "", 404},
+		{"upload no listing", "PROPFIND", "/.dave/s/" + upload.Token + "/", "", 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("upload"))
+			if tt.statusCode == 206 {
+				r.Header.Set("Range", "bytes=0-2")
+			}
+			if tt.password != "" {
+				r.SetBasicAuth("", tt.password)
+			}
+
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+		})
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "inbox", "existing")); string(b) != "content" {
+		t.Errorf("upload share overwrote existing file. content = %s", b)
+	}
+}
+
+func TestServeShareAPI(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs"), 0700)
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+		Shares:  NewShareStore(filepath.Join(tmpDir, "shares.json")),
+	}
+	user1 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	user2 := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user2", Authenticated: true})
+
+	w := httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("POST", "/.dave/shares", strings.NewReader(`{"path":"/docs","password":"pw"}`)), a)
+	if w.Code != 201 {
+		t.Fatalf("create status = %v, want 201. body = %s", w.Code, w.Body)
+	}
+	var created map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if _, ok := created["password"]; ok || created["protected"] != true {
+		t.Errorf("create response = %v, want protected share without password", created)
+	}
+	token := created["token"].(string)
+
+	w = httptest.NewRecorder()
+	serve(user2, w, httptest.NewRequest("GET", "/.dave/shares", nil), a)
+	if strings.Contains(w.Body.String(), token) {
+		t.Errorf("list of other user contains share")
+	}
+
+	w = httptest.NewRecorder()
+	serve(user2, w, httptest.NewRequest("DELETE", "/.dave/shares/"+token, nil), a)
+	if w.Code != 404 {
+		t.Errorf("delete of other user status = %v, want 404", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	serve(user1, w, httptest.NewRequest("DELETE", "/.dave/shares/"+token, nil), a)
+	if w.Code != 204 {
+		t.Errorf("delete status = %v, want 204", w.Code)
+	}
+}
@@ -0,0 +1,266 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Values of the Symlinks option. Symlinks are followed by default. Unknown values are
+// rejected when the configuration is read and confine symlinks otherwise, like
+// SymlinksConfine.
+const (
+	SymlinksFollow  = "follow"
+	SymlinksDeny    = "deny"
+	SymlinksConfine = "confine"
+)
+
+// maxSymlinks is the number of symlinks resolved in a path before it's rejected, like
+// the limit of the kernel.
+const maxSymlinks = 40
+
+// errBeneathUnsupported is returned by openBeneath and the other operations beneath a
+// directory if the platform can't resolve paths beneath a directory.
+var errBeneathUnsupported = errors.New("resolving beneath a directory is not supported")
+
+// beneathUnsupported logs once that paths are checked by checkSymlinks only.
+var beneathUnsupported sync.Once
+
+// validSymlinks returns whether a value of the Symlinks option is known.
+func validSymlinks(policy string) bool {
+	switch policy {
+	case "", SymlinksFollow, SymlinksDeny, SymlinksConfine:
+		return true
+	}
+
+	return false
+}
+
+// symlinks returns the symlink policy of the configuration.
+func (d Dir) symlinks() string {
+	switch d.Config.Symlinks {
+	case "", SymlinksFollow:
+		return SymlinksFollow
+	case SymlinksDeny:
+		return SymlinksDeny
+	}
+
+	return SymlinksConfine
+}
+
+// checkSymlinks returns os.ErrPermission if the physical path contains symlinks which
+// the policy forbids: any symlink with "deny", symlinks leaving the root of the user
+// with "confine". Absolute link targets are rejected with "confine", because they are
+// rejected when opening files beneath the root, too. The last element of the path is
+// checked only if followLast is set, since removing or renaming a symlink doesn't follow
+// it.
+func (d Dir) checkSymlinks(ctx context.Context, physical string, followLast bool) error {
+	policy := d.symlinks()
+	if policy == SymlinksFollow {
+		return nil
+	}
+	if !followLast {
+		physical = filepath.Dir(physical)
+	}
+	root := d.resolve(ctx, "/")
+	rel, err := filepath.Rel(root, physical)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return os.ErrPermission
+	}
+	if rel == "." {
+		return nil
+	}
+
+	current, links := root, 0
+	elements := strings.Split(rel, string(filepath.Separator))
+	for len(elements) > 0 {
+		element := elements[0]
+		elements = elements[1:]
+		switch element {
+		case "", ".":
+			continue
+		case "..":
+			if current == root {
+				return os.ErrPermission
+			}
+			current = filepath.Dir(current)
+			continue
+		}
+
+		next := filepath.Join(current, element)
+		fi, err := os.Lstat(next)
+		if err != nil {
+			// missing elements are created by the operation, they can't be links
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if policy == SymlinksDeny {
+			return os.ErrPermission
+		}
+		if links++; links > maxSymlinks {
+			return os.ErrPermission
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(target) || filepath.VolumeName(target) != "" {
+			return os.ErrPermission
+		}
+		elements = append(strings.Split(filepath.Clean(target), string(filepath.Separator)), elements...)
+	}
+
+	return nil
+}
+
+// beneath runs an operation on paths resolved beneath the root of the user by the
+// kernel, unless symlinks are followed, so symlinks replaced after checkSymlinks can't
+// escape the root. If the platform can't resolve paths beneath a directory, the fallback
+// operates on the plain paths.
+func (d Dir) beneath(ctx context.Context, op func(root string, deny bool) error, fallback func() error) error {
+	policy := d.symlinks()
+	if policy == SymlinksFollow {
+		return fallback()
+	}
+	err := op(d.resolve(ctx, "/"), policy == SymlinksDeny)
+	if err != errBeneathUnsupported {
+		return err
+	}
+	beneathUnsupported.Do(func() {
+		log.Warn("The kernel can't resolve paths beneath a directory, symlinks are checked before file operations only")
+	})
+
+	return fallback()
+}
+
+// openFile opens a physical file of the user of a request beneath the root of the user.
+func (d Dir) openFile(ctx context.Context, physical string, flag int, perm os.FileMode) (*os.File, error) {
+	var f *os.File
+	err := d.beneath(ctx, func(root string, deny bool) (err error) {
+		f, err = openBeneath(root, physical, flag, perm, deny)
+		return err
+	}, func() (err error) {
+		f, err = os.OpenFile(physical, flag, perm)
+		return err
+	})
+
+	return f, err
+}
+
+// stat returns the file info of a physical path beneath the root of the user.
+func (d Dir) stat(ctx context.Context, physical string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := d.beneath(ctx, func(root string, deny bool) (err error) {
+		fi, err = statBeneath(root, physical, deny)
+		return err
+	}, func() (err error) {
+		fi, err = os.Stat(physical)
+		return err
+	})
+
+	return fi, err
+}
+
+// lstat returns the file info of a physical path beneath the root of the user without
+// following the last element.
+func (d Dir) lstat(ctx context.Context, physical string) (os.FileInfo, error) {
+	var fi os.FileInfo
+	err := d.beneath(ctx, func(root string, deny bool) (err error) {
+		fi, err = lstatBeneath(root, physical, deny)
+		return err
+	}, func() (err error) {
+		fi, err = os.Lstat(physical)
+		return err
+	})
+
+	return fi, err
+}
+
+// readlink returns the target of a symlink beneath the root of the user.
+func (d Dir) readlink(ctx context.Context, physical string) (string, error) {
+	var target string
+	err := d.beneath(ctx, func(root string, deny bool) (err error) {
+		target, err = readlinkBeneath(root, physical, deny)
+		return err
+	}, func() (err error) {
+		target, err = os.Readlink(physical)
+		return err
+	})
+
+	return target, err
+}
+
+// symlink creates a symlink beneath the root of the user.
+func (d Dir) symlink(ctx context.Context, target, physical string) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return symlinkBeneath(root, target, physical, deny)
+	}, func() error {
+		return os.Symlink(target, physical)
+	})
+}
+
+// chtimes sets the access and modification times of a path beneath the root of the
+// user. Unlike os.Chtimes, a symlink gets the times itself where it's supported.
+func (d Dir) chtimes(ctx context.Context, physical string, atime, mtime time.Time) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return chtimesBeneath(root, physical, atime, mtime, deny)
+	}, func() error {
+		return os.Chtimes(physical, atime, mtime)
+	})
+}
+
+// mkdir creates a directory beneath the root of the user.
+func (d Dir) mkdir(ctx context.Context, physical string, perm os.FileMode) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return mkdirBeneath(root, physical, perm, deny)
+	}, func() error {
+		return os.Mkdir(physical, perm)
+	})
+}
+
+// remove removes a file beneath the root of the user.
+func (d Dir) remove(ctx context.Context, physical string) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return removeBeneath(root, physical, deny)
+	}, func() error {
+		return os.Remove(physical)
+	})
+}
+
+// removeAll removes a file or a directory and its content beneath the root of the user.
+func (d Dir) removeAll(ctx context.Context, physical string) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return removeAllBeneath(root, physical, deny)
+	}, func() error {
+		return os.RemoveAll(physical)
+	})
+}
+
+// link creates a hard link beneath the root of the user.
+func (d Dir) link(ctx context.Context, oldName, newName string) error {
+	return d.beneath(ctx, func(root string, deny bool) error {
+		return linkBeneath(root, oldName, newName, deny)
+	}, func() error {
+		return os.Link(oldName, newName)
+	})
+}
+
+// rename renames a file or directory beneath the root of the user of oldCtx to a path
+// beneath the root of the user of newCtx, which differ for transfers to shares.
+func (d Dir) rename(oldCtx context.Context, oldName string, newCtx context.Context, newName string) error {
+	newRoot := d.resolve(newCtx, "/")
+	return d.beneath(oldCtx, func(root string, deny bool) error {
+		return renameBeneath(root, oldName, newRoot, newName, deny)
+	}, func() error {
+		return os.Rename(oldName, newName)
+	})
+}
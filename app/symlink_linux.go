@@ -0,0 +1,340 @@
+//go:build linux
+// +build linux
+
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// oNoFollow makes opening a path fail if its last element is a symlink.
+const oNoFollow = unix.O_NOFOLLOW
+
+var (
+	// openat2Probe checks once whether openat2 can be used.
+	openat2Probe     sync.Once
+	openat2Available bool
+)
+
+// openBeneath opens a physical path with openat2, which resolves it beneath the root
+// and fails if a symlink leaves the root or, with deny, if any symlink is encountered.
+// If openat2 can't be used, the caller falls back to checkSymlinks.
+func openBeneath(root, physical string, flag int, perm os.FileMode, deny bool) (*os.File, error) {
+	rel, err := relativeBeneath(root, physical)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: physical, Err: err}
+	}
+	fd, err := resolveBeneath(root, rel, flag, perm, deny)
+	if err != nil {
+		return nil, beneathError("open", physical, err)
+	}
+
+	return os.NewFile(uintptr(fd), physical), nil
+}
+
+// statBeneath returns the file info of a physical path resolved beneath the root. The
+// last element is followed like os.Stat does.
+func statBeneath(root, physical string, deny bool) (os.FileInfo, error) {
+	f, err := openBeneath(root, physical, unix.O_PATH, 0, deny)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// lstatBeneath returns the file info of a physical path resolved beneath the root
+// without following the last element, like os.Lstat does.
+func lstatBeneath(root, physical string, deny bool) (os.FileInfo, error) {
+	f, err := openBeneath(root, physical, unix.O_PATH|unix.O_NOFOLLOW, 0, deny)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// readlinkBeneath returns the target of a symlink in a parent resolved beneath the root.
+func readlinkBeneath(root, physical string, deny bool) (string, error) {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		return "", beneathError("readlink", physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	for size := 128; ; size *= 2 {
+		b := make([]byte, size)
+		n, err := unix.Readlinkat(dirfd, name, b)
+		if err != nil {
+			return "", &os.PathError{Op: "readlink", Path: physical, Err: err}
+		}
+		if n < size {
+			return string(b[:n]), nil
+		}
+	}
+}
+
+// symlinkBeneath creates a symlink in a parent resolved beneath the root.
+func symlinkBeneath(root, target, physical string, deny bool) error {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		return linkError("symlink", target, physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	if err := unix.Symlinkat(target, dirfd, name); err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: physical, Err: err}
+	}
+
+	return nil
+}
+
+// chtimesBeneath sets the access and modification times of a path in a parent resolved
+// beneath the root. A symlink at the last element gets the times itself.
+func chtimesBeneath(root, physical string, atime, mtime time.Time, deny bool) error {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		return beneathError("chtimes", physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(dirfd, name, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &os.PathError{Op: "chtimes", Path: physical, Err: err}
+	}
+
+	return nil
+}
+
+// mkdirBeneath creates a directory in a parent resolved beneath the root.
+func mkdirBeneath(root, physical string, perm os.FileMode, deny bool) error {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		return beneathError("mkdir", physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	if err := unix.Mkdirat(dirfd, name, uint32(perm.Perm())); err != nil {
+		return &os.PathError{Op: "mkdir", Path: physical, Err: err}
+	}
+
+	return nil
+}
+
+// removeBeneath removes a file or an empty directory in a parent resolved beneath the
+// root, like os.Remove does.
+func removeBeneath(root, physical string, deny bool) error {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		return beneathError("remove", physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	err = unix.Unlinkat(dirfd, name, 0)
+	if err == nil {
+		return nil
+	}
+	rmdirErr := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+	if rmdirErr == nil {
+		return nil
+	}
+	// rmdir of a file fails with ENOTDIR, otherwise its error is the relevant one
+	if rmdirErr != unix.ENOTDIR {
+		err = rmdirErr
+	}
+
+	return &os.PathError{Op: "remove", Path: physical, Err: err}
+}
+
+// removeAllBeneath removes a file or a directory and its content in a parent resolved
+// beneath the root. Symlinks in the tree are removed, never followed.
+func removeAllBeneath(root, physical string, deny bool) error {
+	dirfd, name, err := parentBeneath(root, physical, deny)
+	if err != nil {
+		if err == unix.ENOENT {
+			return nil
+		}
+		return beneathError("unlinkat", physical, err)
+	}
+	defer unix.Close(dirfd)
+
+	if err := removeAllAt(dirfd, name); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: physical, Err: err}
+	}
+
+	return nil
+}
+
+// removeAllAt removes an entry of a directory and, if it's a directory, its content.
+func removeAllAt(dirfd int, name string) error {
+	err := unix.Unlinkat(dirfd, name, 0)
+	if err == nil || err == unix.ENOENT {
+		return nil
+	}
+	if err != unix.EISDIR && err != unix.EPERM {
+		return err
+	}
+
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err == unix.ENOENT {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dir := os.NewFile(uintptr(fd), name)
+	names, err := dir.Readdirnames(-1)
+	for _, child := range names {
+		if err = removeAllAt(fd, child); err != nil {
+			break
+		}
+	}
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Unlinkat(dirfd, name, unix.AT_REMOVEDIR); err != nil && err != unix.ENOENT {
+		return err
+	}
+
+	return nil
+}
+
+// renameBeneath renames a file or directory between parents resolved beneath their
+// roots. EXDEV of the rename itself is returned unchanged, so the caller can copy the
+// tree across file systems.
+func renameBeneath(oldRoot, oldName, newRoot, newName string, deny bool) error {
+	return linkAt("rename", oldRoot, oldName, newRoot, newName, deny, func(olddirfd int, oldBase string, newdirfd int, newBase string) error {
+		return unix.Renameat(olddirfd, oldBase, newdirfd, newBase)
+	})
+}
+
+// linkBeneath creates a hard link between parents resolved beneath the root.
+func linkBeneath(root, oldName, newName string, deny bool) error {
+	return linkAt("link", root, oldName, root, newName, deny, func(olddirfd int, oldBase string, newdirfd int, newBase string) error {
+		return unix.Linkat(olddirfd, oldBase, newdirfd, newBase, 0)
+	})
+}
+
+// linkAt resolves the parents of two physical paths beneath their roots and runs a
+// syscall on them.
+func linkAt(op, oldRoot, oldName, newRoot, newName string, deny bool, call func(int, string, int, string) error) error {
+	olddirfd, oldBase, err := parentBeneath(oldRoot, oldName, deny)
+	if err != nil {
+		return linkError(op, oldName, newName, err)
+	}
+	defer unix.Close(olddirfd)
+	newdirfd, newBase, err := parentBeneath(newRoot, newName, deny)
+	if err != nil {
+		return linkError(op, oldName, newName, err)
+	}
+	defer unix.Close(newdirfd)
+
+	if err := call(olddirfd, oldBase, newdirfd, newBase); err != nil {
+		return &os.LinkError{Op: op, Old: oldName, New: newName, Err: err}
+	}
+
+	return nil
+}
+
+// parentBeneath opens the parent directory of a physical path beneath the root and
+// returns it with the last element of the path. The root itself has no parent beneath
+// the root and can't be created, removed or renamed.
+func parentBeneath(root, physical string, deny bool) (int, string, error) {
+	rel, err := relativeBeneath(root, physical)
+	if err != nil {
+		return -1, "", err
+	}
+	if rel == "." {
+		return -1, "", os.ErrPermission
+	}
+	dirfd, err := resolveBeneath(root, filepath.Dir(rel), unix.O_PATH|unix.O_DIRECTORY, 0, deny)
+	if err != nil {
+		return -1, "", err
+	}
+
+	return dirfd, filepath.Base(rel), nil
+}
+
+// relativeBeneath returns the path of a physical path relative to the root, if it's
+// located beneath the root.
+func relativeBeneath(root, physical string) (string, error) {
+	rel, err := filepath.Rel(root, physical)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", os.ErrPermission
+	}
+
+	return rel, nil
+}
+
+// hasOpenat2 returns whether openat2 can be used. Kernels before 5.6 answer ENOSYS, the
+// seccomp profiles of older container runtimes EPERM.
+func hasOpenat2() bool {
+	openat2Probe.Do(func() {
+		fd, err := unix.Openat2(unix.AT_FDCWD, "/", &unix.OpenHow{Flags: unix.O_PATH | unix.O_CLOEXEC})
+		if err == nil {
+			unix.Close(fd)
+		}
+		openat2Available = err != unix.ENOSYS && err != unix.EPERM
+	})
+
+	return openat2Available
+}
+
+// resolveBeneath opens a path relative to the root with openat2. ENOSYS is returned if
+// openat2 can't be used.
+func resolveBeneath(root, rel string, flag int, perm os.FileMode, deny bool) (int, error) {
+	if !hasOpenat2() {
+		return -1, unix.ENOSYS
+	}
+	rootfd, err := unix.Open(root, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer unix.Close(rootfd)
+
+	how := unix.OpenHow{Flags: uint64(flag) | unix.O_CLOEXEC, Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS}
+	if flag&os.O_CREATE != 0 {
+		how.Mode = uint64(perm.Perm())
+	}
+	if deny {
+		how.Resolve |= unix.RESOLVE_NO_SYMLINKS
+	}
+
+	return unix.Openat2(rootfd, rel, &how)
+}
+
+// beneathError maps the errors of resolving a path beneath the root: ENOSYS means that
+// openat2 can't be used, EXDEV and ELOOP mean that a symlink is forbidden.
+func beneathError(op, physical string, err error) error {
+	switch err {
+	case unix.ENOSYS:
+		return errBeneathUnsupported
+	case unix.EXDEV, unix.ELOOP:
+		err = os.ErrPermission
+	}
+
+	return &os.PathError{Op: op, Path: physical, Err: err}
+}
+
+// linkError maps the errors of resolving the parents of a rename or link like
+// beneathError.
+func linkError(op, oldName, newName string, err error) error {
+	switch err {
+	case unix.ENOSYS:
+		return errBeneathUnsupported
+	case unix.EXDEV, unix.ELOOP:
+		err = os.ErrPermission
+	}
+
+	return &os.LinkError{Op: op, Old: oldName, New: newName, Err: err}
+}
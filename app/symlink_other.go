@@ -0,0 +1,58 @@
+//go:build !linux
+// +build !linux
+
+package app
+
+import (
+	"os"
+	"time"
+)
+
+// oNoFollow is not supported on all of these platforms, the last element of paths is
+// checked by checkSymlinks only.
+const oNoFollow = 0
+
+// openBeneath isn't supported on this platform, paths are checked by checkSymlinks only.
+func openBeneath(root, physical string, flag int, perm os.FileMode, deny bool) (*os.File, error) {
+	return nil, errBeneathUnsupported
+}
+
+func statBeneath(root, physical string, deny bool) (os.FileInfo, error) {
+	return nil, errBeneathUnsupported
+}
+
+func lstatBeneath(root, physical string, deny bool) (os.FileInfo, error) {
+	return nil, errBeneathUnsupported
+}
+
+func readlinkBeneath(root, physical string, deny bool) (string, error) {
+	return "", errBeneathUnsupported
+}
+
+func symlinkBeneath(root, target, physical string, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func chtimesBeneath(root, physical string, atime, mtime time.Time, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func mkdirBeneath(root, physical string, perm os.FileMode, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func removeBeneath(root, physical string, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func removeAllBeneath(root, physical string, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func renameBeneath(oldRoot, oldName, newRoot, newName string, deny bool) error {
+	return errBeneathUnsupported
+}
+
+func linkBeneath(root, oldName, newName string, deny bool) error {
+	return errBeneathUnsupported
+}
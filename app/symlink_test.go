@@ -0,0 +1,209 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDirSymlinks(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "subdir1")
+	os.MkdirAll(filepath.Join(root, "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "secret"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "docs", "file"), []byte("docs"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "secret", "file"), []byte("secret"), 0600)
+	os.Symlink("docs", filepath.Join(root, "inside"))
+	os.Symlink("../docs", filepath.Join(root, "docs", "up"))
+	os.Symlink("../secret", filepath.Join(root, "escape"))
+	os.Symlink(filepath.Join(tmpDir, "secret"), filepath.Join(root, "absolute"))
+
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	tests := []struct {
+		policy  string
+		name    string
+		allowed bool
+	}{
+		{"", "/escape/file", true},
+		{"follow", "/absolute/file", true},
+		{"deny", "/docs/file", true},
+		{"deny", "/inside/file", false},
+		{"deny", "/escape/file", false},
+		{"confine", "/inside/file", true},
+		{"confine", "/docs/up/up/file", true},
+		{"confine", "/escape/file", false},
+		{"confine", "/absolute/file", false},
+		{"unknown", "/escape/file", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+tt.name, func(t *testing.T) {
+			config := createTestConfig(tmpDir)
+			config.Symlinks = tt.policy
+			d := Dir{Config: config}
+
+			_, err := d.Stat(ctx, tt.name)
+			if (err == nil) != tt.allowed || (err != nil && !os.IsPermission(err)) {
+				t.Errorf("Dir.Stat() error = %v, allowed %v", err, tt.allowed)
+			}
+			f, err := d.OpenFile(ctx, tt.name, os.O_RDONLY, 0)
+			if (err == nil) != tt.allowed || (err != nil && !os.IsPermission(err)) {
+				t.Errorf("Dir.OpenFile() error = %v, allowed %v", err, tt.allowed)
+			}
+			if err == nil {
+				f.Close()
+			}
+			err = d.Mkdir(ctx, filepath.Dir(tt.name)+"/new", 0700)
+			if (err == nil) != tt.allowed {
+				t.Errorf("Dir.Mkdir() error = %v, allowed %v", err, tt.allowed)
+			}
+			if err == nil {
+				d.RemoveAll(ctx, filepath.Dir(tt.name)+"/new")
+			}
+		})
+	}
+
+	listings := map[string][]string{
+		"follow":  {"absolute", "docs", "escape", "inside"},
+		"deny":    {"docs"},
+		"confine": {"docs", "inside"},
+	}
+	for policy, want := range listings {
+		t.Run("readdir "+policy, func(t *testing.T) {
+			config := createTestConfig(tmpDir)
+			config.Symlinks = policy
+			d := Dir{Config: config}
+
+			f, err := d.OpenFile(ctx, "/", os.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("Dir.OpenFile() error = %v", err)
+			}
+			defer f.Close()
+			infos, err := f.Readdir(0)
+			if err != nil {
+				t.Fatalf("Readdir() error = %v", err)
+			}
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("Readdir() = %v, want %v", names, want)
+			}
+		})
+	}
+
+	config := createTestConfig(tmpDir)
+	config.Symlinks = SymlinksDeny
+	d := Dir{Config: config}
+	if err := d.RemoveAll(ctx, "/escape"); err != nil {
+		t.Errorf("Dir.RemoveAll() of a symlink error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "secret", "file")); err != nil {
+		t.Errorf("target of removed symlink is gone, err = %v", err)
+	}
+}
+
+func TestDirBeneath(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "subdir1")
+	os.MkdirAll(filepath.Join(root, "docs"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "secret"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "docs", "file"), []byte("docs"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "secret", "file"), []byte("secret"), 0600)
+	os.Symlink("../secret", filepath.Join(root, "escape"))
+	os.Symlink("../../secret", filepath.Join(root, "docs", "escape"))
+	if f, err := openBeneath(root, root, os.O_RDONLY, 0, false); err == errBeneathUnsupported {
+		t.Skip("resolving beneath a directory is not supported")
+	} else if err == nil {
+		f.Close()
+	}
+
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	config := createTestConfig(tmpDir)
+	config.Symlinks = SymlinksConfine
+	d := Dir{Config: config}
+
+	// the operations are called without checkSymlinks, like after a symlink has been
+	// swapped in between
+	escaped := filepath.Join(root, "escape", "file")
+	if _, err := d.stat(ctx, escaped); !os.IsPermission(err) {
+		t.Errorf("stat() error = %v, want permission error", err)
+	}
+	if err := d.mkdir(ctx, filepath.Join(root, "escape", "new"), 0700); !os.IsPermission(err) {
+		t.Errorf("mkdir() error = %v, want permission error", err)
+	}
+	if err := d.remove(ctx, escaped); !os.IsPermission(err) {
+		t.Errorf("remove() error = %v, want permission error", err)
+	}
+	if err := d.link(ctx, escaped, filepath.Join(root, "linked")); !os.IsPermission(err) {
+		t.Errorf("link() error = %v, want permission error", err)
+	}
+	if err := d.rename(ctx, escaped, ctx, filepath.Join(root, "moved")); !os.IsPermission(err) {
+		t.Errorf("rename() error = %v, want permission error", err)
+	}
+	if err := d.rename(ctx, filepath.Join(root, "docs", "file"), ctx, filepath.Join(root, "escape", "moved")); !os.IsPermission(err) {
+		t.Errorf("rename() into a symlink error = %v, want permission error", err)
+	}
+	if err := d.removeAll(ctx, filepath.Join(root, "docs")); err != nil {
+		t.Errorf("removeAll() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "secret", "file")); err != nil {
+		t.Errorf("target of a symlink has been modified, err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "secret", "moved")); !os.IsNotExist(err) {
+		t.Errorf("file has been moved out of the root, err = %v", err)
+	}
+}
+
+func TestDirSwappedSymlinkEvents(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "subdir1")
+	os.MkdirAll(root, 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "secret"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "secret", "file"), []byte("secret"), 0600)
+	// written files which have been replaced by a symlink before their events are published
+	os.Symlink("../secret/file", filepath.Join(root, "written"))
+	os.Symlink("../secret/file", filepath.Join(root, "removed"))
+
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	config := createTestConfig(tmpDir)
+	config.Symlinks = SymlinksConfine
+	events := NewEventBus()
+	var published []Event
+	events.Subscribe(func(e Event) { published = append(published, e) })
+	d := Dir{Config: config, Events: events}
+
+	d.fileWritten(ctx, "/written", filepath.Join(root, "written"), false, nil)
+	if size, hash := d.auditFile(ctx, filepath.Join(root, "written")); size != nil || hash != "" {
+		t.Errorf("auditFile() = %v, %q, want the target not to be read", *size, hash)
+	}
+	if err := d.RemoveAll(ctx, "/removed"); err != nil {
+		t.Fatalf("Dir.RemoveAll() error = %v", err)
+	}
+
+	if len(published) != 2 {
+		t.Fatalf("published events = %+v, want 2", published)
+	}
+	if published[0].Size != nil {
+		t.Errorf("size of written file = %v, want none", *published[0].Size)
+	}
+	if size := published[1].Size; size == nil || *size != int64(len("../secret/file")) {
+		t.Errorf("size of removed symlink = %v, want the size of the symlink", size)
+	}
+}
@@ -0,0 +1,217 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Directions of throttled transfers.
+const (
+	directionUpload = iota
+	directionDownload
+)
+
+// tokenBucket allows a rate of bytes per second with bursts of up to one second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// take removes up to n tokens from the bucket. It returns the number of tokens taken,
+// or how long to wait for tokens if none are available.
+func (b *tokenBucket) take(rate int64, n int) (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.rate != rate {
+		// a changed rate starts with a full bucket
+		b.rate, b.tokens, b.last = rate, float64(rate), now
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return 0, time.Duration((1 - b.tokens) / float64(rate) * float64(time.Second))
+	}
+	taken := n
+	if float64(taken) > b.tokens {
+		taken = int(b.tokens)
+	}
+	b.tokens -= float64(taken)
+
+	return taken, 0
+}
+
+// Throttle limits the bandwidth of uploads and downloads globally and per user. The
+// rates are read from the configuration on every transfer, so they follow hot reloads.
+type Throttle struct {
+	config *Config
+	global [2]tokenBucket
+	mu     sync.Mutex
+	users  map[string]*[2]tokenBucket
+}
+
+// NewThrottle creates the token buckets of the configured bandwidth limits.
+func NewThrottle(config *Config) *Throttle {
+	return &Throttle{config: config, users: make(map[string]*[2]tokenBucket)}
+}
+
+// limit returns the configured rate of a direction, 0 if unlimited.
+func (b Bandwidth) limit(direction int) int64 {
+	if direction == directionUpload {
+		return b.Upload
+	}
+
+	return b.Download
+}
+
+// wait blocks until n bytes may be transferred in the direction by the user, or the
+// context is done.
+func (t *Throttle) wait(ctx context.Context, username string, direction int, n int) error {
+	type limit struct {
+		bucket *tokenBucket
+		rate   int64
+	}
+	var limits []limit
+	if rate := t.config.Bandwidth.limit(direction); rate > 0 {
+		limits = append(limits, limit{&t.global[direction], rate})
+	}
+	if userInfo := t.config.Users[username]; username != "" && userInfo != nil {
+		if rate := userInfo.Bandwidth.limit(direction); rate > 0 {
+			t.mu.Lock()
+			buckets, ok := t.users[username]
+			if !ok {
+				buckets = &[2]tokenBucket{}
+				t.users[username] = buckets
+			}
+			t.mu.Unlock()
+			limits = append(limits, limit{&buckets[direction], rate})
+		}
+	}
+
+	for _, l := range limits {
+		for remaining := n; remaining > 0; {
+			taken, delay := l.bucket.take(l.rate, remaining)
+			remaining -= taken
+			if delay == 0 {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	return nil
+}
+
+// throttleUser returns the name of the user whose limits apply to a request.
+func throttleUser(ctx context.Context) string {
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		return authInfo.Username
+	}
+
+	return ""
+}
+
+// throttledRequest holds the context of a throttled request. The user is known once the
+// request has been authenticated, so the context is replaced by serve.
+type throttledRequest struct {
+	throttle *Throttle
+	ctx      context.Context
+}
+
+// wait blocks until n bytes may be transferred in the direction.
+func (t *throttledRequest) wait(direction int, n int) error {
+	return t.throttle.wait(t.ctx, throttleUser(t.ctx), direction, n)
+}
+
+// throttleRequest limits the rate at which the body of a request is read and its
+// response is written, if a throttle is configured. Only the transfers between client
+// and server are throttled, not the files written by the server itself, like copies or
+// extracted archives. The returned context allows serve to attach the authenticated user.
+func throttleRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) (context.Context, http.ResponseWriter, *http.Request) {
+	if a.Handler == nil {
+		return ctx, w, req
+	}
+	d, ok := a.Handler.FileSystem.(*Dir)
+	if !ok || d.Throttle == nil {
+		return ctx, w, req
+	}
+	t := &throttledRequest{throttle: d.Throttle, ctx: ctx}
+	if req.Body != nil && req.Body != http.NoBody {
+		req.Body = &throttledReader{ReadCloser: req.Body, request: t}
+	}
+
+	return context.WithValue(ctx, throttleKey, t), &throttledWriter{ResponseWriter: w, request: t}, req
+}
+
+// throttleAuthenticated updates the context of a throttled request once the user is
+// known.
+func throttleAuthenticated(ctx context.Context) {
+	if t, ok := ctx.Value(throttleKey).(*throttledRequest); ok {
+		t.ctx = ctx
+	}
+}
+
+// throttledReader limits the rate at which the body of a request is read.
+type throttledReader struct {
+	io.ReadCloser
+	request *throttledRequest
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		if werr := r.request.wait(directionUpload, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
+
+// throttledWriter limits the rate of a response.
+type throttledWriter struct {
+	http.ResponseWriter
+	request *throttledRequest
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > 32*1024 {
+			chunk = chunk[:32*1024]
+		}
+		if err := w.request.wait(directionDownload, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// Flush delegates to the underlying response writer, if it supports flushing.
+func (w *throttledWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/net/webdav"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	if taken, delay := b.take(100, 60); taken != 60 || delay != 0 {
+		t.Errorf("take() = %v, %v, want 60, 0", taken, delay)
+	}
+	if taken, _ := b.take(100, 60); taken != 40 {
+		t.Errorf("take() = %v, want the remaining 40", taken)
+	}
+	if taken, delay := b.take(100, 60); taken != 0 || delay <= 0 || delay > 10*time.Millisecond {
+		t.Errorf("take() = %v, %v, want 0 and a delay of up to 10ms", taken, delay)
+	}
+	// a changed rate starts over
+	if taken, _ := b.take(1000, 600); taken != 600 {
+		t.Errorf("take() after rate change = %v, want 600", taken)
+	}
+}
+
+// transferTimer records when the first byte of a request or response has been
+// transferred, so that the time of the authentication isn't measured.
+type transferTimer struct {
+	first time.Time
+	last  time.Time
+}
+
+func (t *transferTimer) record() {
+	if t.first.IsZero() {
+		t.first = time.Now()
+	}
+	t.last = time.Now()
+}
+
+type timedReader struct {
+	io.Reader
+	timer *transferTimer
+}
+
+func (r timedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.timer.record()
+	return n, err
+}
+
+type timedRecorder struct {
+	*httptest.ResponseRecorder
+	timer *transferTimer
+}
+
+func (w timedRecorder) Write(p []byte) (int, error) {
+	n, err := w.ResponseRecorder.Write(p)
+	w.timer.record()
+	return n, err
+}
+
+func TestHandleThrottle(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir2"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	const rate = 100000
+	content := bytes.Repeat([]byte("x"), rate*3/2)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "file"), content, 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir2", "file"), content, 0600)
+
+	config := createTestConfig(tmpDir)
+	config.Log = Logging{}
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	config.Users["user1"].Password = string(hash)
+	config.Users["user2"].Password = string(hash)
+	dir := &Dir{Config: config, Throttle: NewThrottle(config)}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: dir, LockSystem: webdav.NewMemLS()},
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		user      string
+		global    Bandwidth
+		user1     Bandwidth
+		throttled bool
+	}{
+		{"global download", "GET", "user2", Bandwidth{Download: rate}, Bandwidth{}, true},
+		{"user download", "GET", "user1", Bandwidth{}, Bandwidth{Download: rate}, true},
+		{"other user", "GET", "user2", Bandwidth{}, Bandwidth{Download: rate}, false},
+		{"user upload", "PUT", "user1", Bandwidth{}, Bandwidth{Upload: rate}, true},
+		{"download limit on upload", "PUT", "user1", Bandwidth{Download: rate}, Bandwidth{}, false},
+		{"copy on the server", "COPY", "user1", Bandwidth{Upload: rate}, Bandwidth{Upload: rate}, false},
+		{"unlimited", "GET", "user1", Bandwidth{}, Bandwidth{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// limits are read on every transfer, like after a hot reload
+			config.Bandwidth = tt.global
+			config.Users["user1"].Bandwidth = tt.user1
+
+			timer := &transferTimer{}
+			var r = httptest.NewRequest(tt.method, "/file", nil)
+			switch tt.method {
+			case "PUT":
+				r = httptest.NewRequest(tt.method, "/file", timedReader{bytes.NewReader(content), timer})
+			case "COPY":
+				r.Header.Set("Destination", "http://example.com/copy")
+			}
+			r.SetBasicAuth(tt.user, "password")
+			w := httptest.NewRecorder()
+			start := time.Now()
+			handle(context.Background(), timedRecorder{w, timer}, r, a)
+
+			if w.Code >= 300 {
+				t.Fatalf("status = %v", w.Code)
+			}
+			// only the transfer of the content is measured
+			elapsed := timer.last.Sub(timer.first)
+			switch tt.method {
+			case "GET":
+				if w.Body.Len() != len(content) {
+					t.Errorf("body length = %v, want %v", w.Body.Len(), len(content))
+				}
+			case "COPY":
+				elapsed = time.Since(start)
+			}
+			// the first second is a burst, the remaining half second has to be waited for
+			if throttled := elapsed >= 400*time.Millisecond; throttled != tt.throttled {
+				t.Errorf("elapsed = %v, want throttled = %v", elapsed, tt.throttled)
+			}
+		})
+	}
+}
@@ -0,0 +1,560 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+// transferArea is a tree a COPY or MOVE between the files of a user and a share link
+// reads from or writes to.
+type transferArea struct {
+	fs    webdav.FileSystem
+	ls    webdav.LockSystem
+	ctx   context.Context
+	name  string
+	share *Share
+}
+
+// child returns the area of an entry of a directory.
+func (t *transferArea) child(name string) *transferArea {
+	c := *t
+	c.name = path.Join(t.name, name)
+
+	return &c
+}
+
+// physical returns the dir an area is stored in with the physical and the virtual path
+// of its name, or a nil dir if the file system isn't backed by one.
+func (t *transferArea) physical() (*Dir, string, string) {
+	fs, name := t.fs, t.name
+	if s, ok := fs.(shareFS); ok {
+		fs, name = s.fs, s.resolve(name)
+	}
+	d, ok := fs.(*Dir)
+	if !ok {
+		return nil, "", ""
+	}
+
+	return d, d.resolve(t.ctx, name), name
+}
+
+// shareToken returns the token of the share link an url path points into and the path
+// within the share.
+func shareToken(config *Config, urlPath string) (string, string, bool) {
+	endpoint, ok := apiEndpoint(config, urlPath)
+	if !ok || !strings.HasPrefix(endpoint, "s/") {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(endpoint, "s/"), "/", 2)
+	name := "/"
+	if len(parts) == 2 {
+		name += parts[1]
+	}
+
+	return parts[0], name, true
+}
+
+// destinationPath returns the path of the Destination header like the webdav handler
+// parses it, with the status to answer if it's invalid.
+func destinationPath(req *http.Request) (string, int) {
+	header := req.Header.Get("Destination")
+	if header == "" {
+		return "", http.StatusBadRequest
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		return "", http.StatusBadRequest
+	}
+	if u.Host != "" && u.Host != req.Host {
+		return "", http.StatusBadGateway
+	}
+
+	return u.Path, 0
+}
+
+// crossTransfer returns whether a request copies or moves files between the files of a
+// user and a share link, or between two share links. Those requests are authenticated
+// like any other request of a user.
+func crossTransfer(config *Config, req *http.Request) bool {
+	if req.Method != "COPY" && req.Method != "MOVE" {
+		return false
+	}
+	dst, status := destinationPath(req)
+	if status != 0 {
+		return false
+	}
+	srcToken, _, srcShare := shareToken(config, req.URL.Path)
+	dstToken, _, dstShare := shareToken(config, dst)
+
+	return (srcShare || dstShare) && !(srcShare && dstShare && srcToken == dstToken)
+}
+
+// transferArea resolves the url path of a source or destination. Share links are used
+// on behalf of their owners with the permissions of their mode. Share links protected
+// by a password can only be used by their owners, because the basic auth of the request
+// authenticates the user.
+func (a *App) transferArea(ctx context.Context, urlPath string) (*transferArea, int) {
+	token, name, ok := shareToken(a.Config, urlPath)
+	if !ok {
+		name, ok := a.webdavPath(urlPath)
+		if !ok {
+			return nil, http.StatusNotFound
+		}
+		return &transferArea{fs: a.Handler.FileSystem, ls: a.Handler.LockSystem, ctx: ctx, name: name}, 0
+	}
+
+	if a.Shares == nil {
+		return nil, http.StatusNotFound
+	}
+	share, err := a.Shares.Get(token)
+	if err == ErrShareNotFound || (err == nil && a.Config.AuthenticationNeeded() && a.Config.Users[share.User] == nil) {
+		return nil, http.StatusNotFound
+	}
+	if err != nil {
+		log.WithError(err).Error("Error reading share links")
+		return nil, http.StatusInternalServerError
+	}
+	if share.Password != "" {
+		if authInfo := AuthFromContext(ctx); authInfo == nil || authInfo.Username != share.User {
+			return nil, http.StatusForbidden
+		}
+	}
+
+	shareCtx := context.WithValue(ctx, authInfoKey, &AuthInfo{Username: share.User, Authenticated: share.User != ""})
+	return &transferArea{
+		fs:    shareFS{fs: a.Handler.FileSystem, root: share.Path, mode: share.Mode},
+		ls:    a.Shares.lockSystem(token),
+		ctx:   shareCtx,
+		name:  name,
+		share: share,
+	}, 0
+}
+
+// serveTransfer copies or moves files between the files of a user and the share links
+// they know on the server. Read shares can be copied from and upload shares accept new
+// files. Moves within the same dir are renames, moves across file systems copy the files
+// and remove the source.
+func serveTransfer(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) {
+	if isAnonymous(ctx) {
+		writeUnauthorized(w, a.Config.Realm)
+		return
+	}
+	dstPath, status := destinationPath(req)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	src, status := a.transferArea(ctx, req.URL.Path)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	dst, status := a.transferArea(ctx, dstPath)
+	if status != 0 {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	move := req.Method == "MOVE"
+	recursive := true
+	switch req.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		if move {
+			http.Error(w, "moves require depth infinity", http.StatusBadRequest)
+			return
+		}
+		recursive = false
+	default:
+		http.Error(w, "invalid depth", http.StatusBadRequest)
+		return
+	}
+	if move && src.share != nil {
+		http.Error(w, "files can't be moved out of share links", http.StatusForbidden)
+		return
+	}
+	if dst.share != nil && dst.share.Mode != ShareUpload {
+		http.Error(w, "share link doesn't accept uploads", http.StatusForbidden)
+		return
+	}
+
+	fi, err := src.fs.Stat(src.ctx, src.name)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if dst.share != nil && fi.IsDir() {
+		http.Error(w, "share links accept files only", http.StatusForbidden)
+		return
+	}
+	if sd, srcPhysical, _ := src.physical(); sd != nil {
+		if dd, dstPhysical, _ := dst.physical(); dd == sd &&
+			(dstPhysical == srcPhysical || strings.HasPrefix(dstPhysical, srcPhysical+string(filepath.Separator))) {
+			http.Error(w, "destination is within the source", http.StatusForbidden)
+			return
+		}
+	}
+
+	release, status, err := a.confirmLocks(req, src, dst, move)
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer release()
+
+	_, err = dst.fs.Stat(dst.ctx, dst.name)
+	exists := err == nil
+	if exists && req.Header.Get("Overwrite") == "F" {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+
+	// a replaced destination is kept until the transfer succeeded
+	replaced := func(bool) {}
+	if exists {
+		if replaced, err = setAside(dst); err != nil {
+			writeFileError(w, err)
+			return
+		}
+	}
+
+	if move {
+		err = moveAcross(src, dst, fi)
+	} else {
+		err = copyAcross(src, dst, fi, recursive)
+	}
+	replaced(err == nil)
+	if os.IsExist(err) {
+		// upload shares never replace files
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	// like downloads, only complete transfers of files count
+	if src.share != nil && !fi.IsDir() {
+		if _, err := a.Shares.countDownload(src.share.Token); err != nil {
+			log.WithError(err).Error("Error counting download of share link")
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"method":      req.Method,
+		"path":        req.URL.Path,
+		"destination": dstPath,
+		"user":        Dir{Config: a.Config}.resolveUser(ctx),
+	}).Info("Transferred files with a share link")
+	if !exists {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// confirmLocks confirms the locks of a transfer like the webdav handler does for COPY and
+// MOVE requests: the destination and the source of a move must not be locked, unless the
+// If header holds the tokens of the locks. Without an If header, the areas are locked
+// for the request. The returned function releases the locks.
+func (a *App) confirmLocks(req *http.Request, src, dst *transferArea, move bool) (func(), int, error) {
+	areas := []*transferArea{dst}
+	if move {
+		areas = append(areas, src)
+	}
+
+	var releases []func()
+	release := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+	for _, area := range areas {
+		r, status, err := a.confirmLock(req, area)
+		if err != nil {
+			release()
+			return nil, status, err
+		}
+		releases = append(releases, r)
+	}
+
+	return release, 0, nil
+}
+
+// confirmLock confirms the locks of an area of a transfer. The lists of the If header are
+// alternatives; a list applies to the resource of its tag, if it's located in the area,
+// and to the area.
+func (a *App) confirmLock(req *http.Request, area *transferArea) (func(), int, error) {
+	now := time.Now()
+	header := req.Header.Get("If")
+	if header == "" {
+		token, err := area.ls.Create(now, webdav.LockDetails{Root: area.name, Duration: -1, ZeroDepth: true})
+		if err == webdav.ErrLocked {
+			return nil, http.StatusLocked, err
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return func() { area.ls.Unlock(now, token) }, 0, nil
+	}
+
+	lists, ok := parseIfHeader(header)
+	if !ok {
+		return nil, http.StatusBadRequest, errInvalidIfHeader
+	}
+	for _, l := range lists {
+		tagged := ""
+		if l.resourceTag != "" {
+			u, err := url.Parse(l.resourceTag)
+			if err != nil || (u.Host != "" && u.Host != req.Host) {
+				continue
+			}
+			tagged, _ = a.lockName(area, u.Path)
+		}
+		release, err := area.ls.Confirm(now, tagged, area.name, l.conditions...)
+		if err == webdav.ErrConfirmationFailed {
+			continue
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return release, 0, nil
+	}
+
+	return nil, http.StatusPreconditionFailed, webdav.ErrLocked
+}
+
+// lockName returns the name of an url path in the lock system of an area, if the path
+// points into the area.
+func (a *App) lockName(area *transferArea, urlPath string) (string, bool) {
+	token, name, ok := shareToken(a.Config, urlPath)
+	switch {
+	case ok && area.share != nil && token == area.share.Token:
+		return name, true
+	case ok || area.share != nil:
+		return "", false
+	}
+
+	return a.webdavPath(urlPath)
+}
+
+// errInvalidIfHeader is returned for If headers which can't be parsed.
+var errInvalidIfHeader = errors.New("invalid If header")
+
+// ifList is a list of conditions of an If header, which apply together. Tagged lists
+// apply to the resource of their tag.
+type ifList struct {
+	resourceTag string
+	conditions  []webdav.Condition
+}
+
+// parseIfHeader parses an If header as defined by RFC 4918, section 10.4.
+func parseIfHeader(header string) ([]ifList, bool) {
+	var lists []ifList
+	tag, s := "", strings.TrimSpace(header)
+	for s != "" {
+		if s[0] == '<' {
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			tag, s = s[1:end], strings.TrimSpace(s[end+1:])
+			if !strings.HasPrefix(s, "(") {
+				return nil, false
+			}
+			continue
+		}
+		if s[0] != '(' {
+			return nil, false
+		}
+
+		l := ifList{resourceTag: tag}
+		s = strings.TrimSpace(s[1:])
+		for s != "" && s[0] != ')' {
+			var c webdav.Condition
+			if strings.HasPrefix(s, "Not") {
+				c.Not, s = true, strings.TrimSpace(s[3:])
+			}
+			closing := byte('>')
+			switch {
+			case strings.HasPrefix(s, "<"):
+			case strings.HasPrefix(s, "["):
+				closing = ']'
+			default:
+				return nil, false
+			}
+			end := strings.IndexByte(s, closing)
+			if end < 0 {
+				return nil, false
+			}
+			if closing == '>' {
+				c.Token = s[1:end]
+			} else {
+				c.ETag = s[1:end]
+			}
+			l.conditions = append(l.conditions, c)
+			s = strings.TrimSpace(s[end+1:])
+		}
+		if s == "" || len(l.conditions) == 0 {
+			return nil, false
+		}
+		lists = append(lists, l)
+		s = strings.TrimSpace(s[1:])
+	}
+
+	return lists, len(lists) > 0
+}
+
+// setAside prepares the replacement of the destination of a transfer. The destination is
+// moved to a temporary name and recorded as deleted, so that it can be restored if the
+// transfer fails. The returned function removes it after a successful transfer, or
+// restores it. Without a dir, the destination is removed at once.
+func setAside(dst *transferArea) (func(bool), error) {
+	d, physical, virtual := dst.physical()
+	if d == nil {
+		return func(bool) {}, dst.fs.RemoveAll(dst.ctx, dst.name)
+	}
+	if physical == "" {
+		return nil, os.ErrNotExist
+	}
+	if err := d.removable(dst.ctx, physical); err != nil {
+		return nil, err
+	}
+	fi, err := d.lstat(dst.ctx, physical)
+	if err != nil {
+		return nil, err
+	}
+	aside := tempName(physical)
+	if err := d.rename(dst.ctx, physical, dst.ctx, aside); err != nil {
+		return nil, err
+	}
+	d.moveMeta(physical, aside)
+	d.removePreviews(physical)
+	var size *int64
+	if !fi.IsDir() {
+		s := fi.Size()
+		size = &s
+	}
+	d.removed(dst.ctx, virtual, physical, size, fi.IsDir())
+
+	return func(ok bool) {
+		if ok {
+			if err := d.removeAll(dst.ctx, aside); err != nil {
+				log.WithField("path", aside).WithError(err).Error("Can't remove the replaced destination of a transfer")
+			}
+			d.removeMeta(aside)
+			return
+		}
+
+		// drop the remains of the failed transfer and restore the destination
+		if remains, err := d.lstat(dst.ctx, physical); err == nil {
+			d.removeAll(dst.ctx, physical)
+			d.removeMeta(physical)
+			d.removed(dst.ctx, virtual, physical, nil, remains.IsDir())
+		}
+		if err := d.rename(dst.ctx, aside, dst.ctx, physical); err != nil {
+			log.WithField("path", physical).WithError(err).Error("Can't restore the destination of a failed transfer")
+			return
+		}
+		d.moveMeta(aside, physical)
+		if !fi.IsDir() {
+			d.fileWritten(dst.ctx, virtual, physical, true, nil)
+			return
+		}
+		d.audit(dst.ctx, &AuditRecord{Operation: AuditMkdir, Path: virtual, Physical: physical})
+		d.publish(dst.ctx, Event{Type: EventMkdir, Path: d.relative(physical), IsDir: true})
+	}, nil
+}
+
+// moveAcross renames the source to the destination if both are stored in the same dir
+// and no drop box is involved. Otherwise the files are copied and the source is removed.
+func moveAcross(src, dst *transferArea, fi os.FileInfo) error {
+	sd, oldName, oldVirtual := src.physical()
+	dd, newName, newVirtual := dst.physical()
+	if sd != nil && sd == dd && oldName != "" && newName != "" &&
+		!sd.readOnly(src.ctx) && !sd.readOnly(dst.ctx) &&
+		!sd.containsDropbox(src.ctx, oldName) && !sd.containsDropbox(dst.ctx, newName) {
+		if err := sd.renamable(src.ctx, oldName, dst.ctx, newName); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(newName); err == nil {
+			return os.ErrExist
+		}
+		if err := sd.renamePhysical(src.ctx, oldName, dst.ctx, newName); err != nil {
+			return err
+		}
+		sd.renamed(src.ctx, oldName, dst.ctx, newName, oldVirtual, newVirtual)
+		return nil
+	}
+
+	if err := copyAcross(src, dst, fi, true); err != nil {
+		return err
+	}
+
+	return src.fs.RemoveAll(src.ctx, src.name)
+}
+
+// copyAcross copies a file or directory through the file systems of the areas, so the
+// permissions of both apply.
+func copyAcross(src, dst *transferArea, fi os.FileInfo, recursive bool) error {
+	if !fi.IsDir() {
+		return copyFileAcross(src, dst, fi)
+	}
+	if err := dst.fs.Mkdir(dst.ctx, dst.name, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	if !recursive {
+		return nil
+	}
+
+	f, err := src.fs.OpenFile(src.ctx, src.name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	children, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := copyAcross(src.child(child.Name()), dst.child(child.Name()), child, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFileAcross(src, dst *transferArea, fi os.FileInfo) error {
+	r, err := src.fs.OpenFile(src.ctx, src.name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := dst.fs.OpenFile(dst.ctx, dst.name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		// a failed copy leaves the previous file in place
+		if wf, ok := f.(*file); ok {
+			wf.failed = true
+		}
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeTransfer(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	config.Users["user1"].Password = GenHash([]byte("password"))
+	config.Users["user2"].Password = GenHash([]byte("password"))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "docs", "sub"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	os.MkdirAll(filepath.Join(tmpDir, "subdir2", "dir"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "file"), []byte("shared"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "docs", "sub", "nested"), []byte("nested"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir2", "report"), []byte("report"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir2", "draft"), []byte("draft"), 0600)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir2", "notes"), []byte("notes"), 0600)
+	os.Symlink("../../subdir2", filepath.Join(tmpDir, "subdir1", "inbox", "escape"))
+	config.Hidden.Patterns = []string{"*.tmp"}
+	config.Symlinks = SymlinksConfine
+
+	store := NewShareStore(filepath.Join(tmpDir, "shares.json"))
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+		Shares:  store,
+	}
+	read := &Share{User: "user1", Path: "/docs", Mode: ShareRead}
+	if err := CreateShare(config, store, read, ""); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+	protected := &Share{User: "user1", Path: "/docs", Mode: ShareRead}
+	if err := CreateShare(config, store, protected, "secret"); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+	upload := &Share{User: "user1", Path: "/inbox", Mode: ShareUpload}
+	if err := CreateShare(config, store, upload, ""); err != nil {
+		t.Fatalf("CreateShare() error = %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir2", "locked"), []byte("locked"), 0600)
+	locked, err := a.Handler.LockSystem.Create(time.Now(), webdav.LockDetails{Root: "/locked", Duration: time.Hour})
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if _, err := store.lockSystem(upload.Token).Create(time.Now(), webdav.LockDetails{Root: "/held", Duration: time.Hour}); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		destination string
+		user        string
+		headers     map[string]string
+		statusCode  int
+	}{
+		{"unauthenticated", "COPY", "/.dave/s/" + read.Token + "/file", "/file", "", nil, 401},
+		{"copy from read share", "COPY", "/.dave/s/" + read.Token + "/file", "/copy", "user2", nil, 201},
+		{"copy tree from read share", "COPY", "/.dave/s/" + read.Token + "/", "/docs", "user2", nil, 201},
+		{"copy without overwrite", "COPY", "/.dave/s/" + read.Token + "/file", "/copy", "user2", map[string]string{"Overwrite": "F"}, 412},
+		{"copy with overwrite", "COPY", "/.dave/s/" + read.Token + "/file", "/copy", "user2", nil, 204},
+		{"move from read share", "MOVE", "/.dave/s/" + read.Token + "/file", "/moved", "user2", nil, 403},
+		{"protected share of other user", "COPY", "/.dave/s/" + protected.Token + "/file", "/other", "user2", nil, 403},
+		{"protected share of owner", "COPY", "/.dave/s/" + protected.Token + "/file", "/copy", "user1", nil, 201},
+		{"copy into own share", "COPY", "/.dave/s/" + protected.Token + "/", "/docs/sub/copy", "user1", nil, 403},
+		{"copy to read share", "COPY", "/report", "/.dave/s/" + read.Token + "/report", "user2", nil, 403},
+		{"copy to upload share", "COPY", "/report", "/.dave/s/" + upload.Token + "/report", "user2", nil, 201},
+		{"copy to existing in upload share", "COPY", "/report", "/.dave/s/" + upload.Token + "/report", "user2", nil, 412},
+		{"copy directory to upload share", "COPY", "/dir", "/.dave/s/" + upload.Token + "/dir", "user2", nil, 403},
+		{"move to upload share", "MOVE", "/draft", "/.dave/s/" + upload.Token + "/draft", "user2", nil, 201},
+		{"move hidden to upload share", "MOVE", "/notes", "/.dave/s/" + upload.Token + "/notes.tmp", "user2", nil, 403},
+		{"move through symlink to upload share", "MOVE", "/notes", "/.dave/s/" + upload.Token + "/escape/moved", "user2", nil, 403},
+		{"copy to locked destination", "COPY", "/.dave/s/" + read.Token + "/file", "/locked", "user2", nil, 423},
+		{"copy with invalid If header", "COPY", "/.dave/s/" + read.Token + "/file", "/locked", "user2", map[string]string{"If": "token"}, 400},
+		{"copy with other lock token", "COPY", "/.dave/s/" + read.Token + "/file", "/locked", "user2", map[string]string{"If": "(<urn:other>)"}, 412},
+		{"move locked source", "MOVE", "/locked", "/.dave/s/" + upload.Token + "/locked", "user2", nil, 423},
+		{"copy to locked share destination", "COPY", "/report", "/.dave/s/" + upload.Token + "/held", "user2", nil, 423},
+		{"copy with lock token", "COPY", "/.dave/s/" + read.Token + "/file", "/locked", "user2", map[string]string{"If": "(<" + locked + ">)"}, 204},
+		{"missing source", "MOVE", "/draft", "/.dave/s/" + upload.Token + "/again", "user2", nil, 404},
+		{"unknown share", "COPY", "/report", "/.dave/s/unknown/report", "user2", nil, 404},
+		{"foreign host", "COPY", "/report", "http://other.com/.dave/s/" + upload.Token + "/x", "user2", nil, 502},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Destination", tt.destination)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, "password")
+			}
+
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v: %s", w.Code, tt.statusCode, w.Body.String())
+			}
+		})
+	}
+
+	files := map[string]string{
+		filepath.Join("subdir2", "copy"):                  "shared",
+		filepath.Join("subdir2", "docs", "sub", "nested"): "nested",
+		filepath.Join("subdir1", "copy"):                  "shared",
+		filepath.Join("subdir1", "inbox", "report"):       "report",
+		filepath.Join("subdir1", "inbox", "draft"):        "draft",
+		filepath.Join("subdir2", "report"):                "report",
+		filepath.Join("subdir2", "locked"):                "shared",
+	}
+	for name, content := range files {
+		if b, err := ioutil.ReadFile(filepath.Join(tmpDir, name)); err != nil || string(b) != content {
+			t.Errorf("file %s = %q, %v, want %q", name, b, err, content)
+		}
+	}
+	for _, name := range []string{filepath.Join("subdir1", "inbox", "notes.tmp"), filepath.Join("subdir2", "moved")} {
+		if _, err := os.Lstat(filepath.Join(tmpDir, name)); !os.IsNotExist(err) {
+			t.Errorf("file %s has been moved, err = %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "subdir2", "draft")); !os.IsNotExist(err) {
+		t.Errorf("moved source still exists, err = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "subdir1", "docs", "sub", "copy")); !os.IsNotExist(err) {
+		t.Errorf("copy into source exists, err = %v", err)
+	}
+}
+
+func TestSetAside(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "dir"), 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+	events := NewEventBus()
+	var published []string
+	events.Subscribe(func(e Event) { published = append(published, e.Type+" "+e.Path) })
+	d := &Dir{Config: config, Events: events}
+	target := filepath.Join(tmpDir, "subdir1", "dir", "file")
+	ioutil.WriteFile(target, []byte("previous"), 0600)
+
+	// a failed transfer restores the destination
+	replaced, err := setAside(&transferArea{fs: d, ctx: ctx, name: "/dir/file"})
+	if err != nil {
+		t.Fatalf("setAside() error = %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("destination hasn't been set aside, err = %v", err)
+	}
+	ioutil.WriteFile(target, []byte("partial"), 0600)
+	replaced(false)
+	if b, _ := ioutil.ReadFile(target); string(b) != "previous" {
+		t.Errorf("content after failed transfer = %q, want %q", b, "previous")
+	}
+
+	// a successful transfer removes the previous destination
+	replaced, err = setAside(&transferArea{fs: d, ctx: ctx, name: "/dir"})
+	if err != nil {
+		t.Fatalf("setAside() error = %v", err)
+	}
+	os.Mkdir(filepath.Join(tmpDir, "subdir1", "dir"), 0700)
+	replaced(true)
+	if infos, _ := ioutil.ReadDir(filepath.Join(tmpDir, "subdir1")); len(infos) != 1 || infos[0].Name() != "dir" {
+		t.Errorf("entries after transfer = %v, want the new dir only", infos)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("previous content still exists, err = %v", err)
+	}
+
+	want := []string{"delete /subdir1/dir/file", "delete /subdir1/dir/file", "create /subdir1/dir/file", "delete /subdir1/dir"}
+	if strings.Join(published, ",") != strings.Join(want, ",") {
+		t.Errorf("published events = %v, want %v", published, want)
+	}
+}
+
+func TestParseIfHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []ifList
+		ok     bool
+	}{
+		{"(<urn:a>)", []ifList{{conditions: []webdav.Condition{{Token: "urn:a"}}}}, true},
+		{`(Not <urn:a> ["etag"]) (<urn:b>)`, []ifList{
+			{conditions: []webdav.Condition{{Not: true, Token: "urn:a"}, {ETag: `"etag"`}}},
+			{conditions: []webdav.Condition{{Token: "urn:b"}}},
+		}, true},
+		{"<http://example.com/dir> (<urn:a>)", []ifList{{resourceTag: "http://example.com/dir", conditions: []webdav.Condition{{Token: "urn:a"}}}}, true},
+		{"", nil, false},
+		{"<urn:a>", nil, false},
+		{"()", nil, false},
+		{"(<urn:a>", nil, false},
+		{"(urn:a)", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, ok := parseIfHeader(tt.header)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseIfHeader() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
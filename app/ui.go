@@ -0,0 +1,73 @@
+package app
+
+import (
+	"context"
+	"embed"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed ui
+var uiFiles embed.FS
+
+var uiIndex = template.Must(template.ParseFS(uiFiles, "ui/index.html"))
+
+// serveUI serves the web interface for a directory, if the request comes from a browser.
+// It returns false if the request must be handled otherwise.
+func serveUI(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App) bool {
+	if a.Config.UI.Disabled || !acceptsHTML(req) || req.URL.Query().Get("format") != "" {
+		return false
+	}
+	name, ok := a.webdavPath(req.URL.Path)
+	if !ok {
+		return false
+	}
+	fi, err := a.Handler.FileSystem.Stat(ctx, name)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+
+	if !strings.HasSuffix(req.URL.Path, "/") {
+		http.Redirect(w, req, req.URL.Path+"/", http.StatusMovedPermanently)
+		return true
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	err = uiIndex.Execute(w, struct {
+		Path   string
+		Root   string
+		Assets string
+	}{
+		Path:   name,
+		Root:   strings.TrimSuffix(a.Config.Prefix, "/") + "/",
+		Assets: strings.TrimSuffix(a.Config.Prefix, "/") + strings.TrimSuffix(apiPath, "/") + "/ui",
+	})
+	if err != nil {
+		log.WithError(err).Error("Error rendering web interface")
+	}
+
+	return true
+}
+
+// serveUIAsset serves the static files of the web interface.
+func serveUIAsset(w http.ResponseWriter, req *http.Request, name string) {
+	assets, _ := fs.Sub(uiFiles, "ui")
+	if name == "" || path.Ext(name) == ".html" {
+		http.NotFound(w, req)
+		return
+	}
+
+	req.URL.Path = "/" + name
+	http.FileServer(http.FS(assets)).ServeHTTP(w, req)
+}
+
+// acceptsHTML returns whether the request is a GET of a browser.
+func acceptsHTML(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
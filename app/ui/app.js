@@ -0,0 +1,205 @@
+(function () {
+  "use strict";
+
+  var DAV = "DAV:";
+  var base = location.pathname.replace(/\/?$/, "/");
+  var entries = document.getElementById("entries");
+  var status = document.getElementById("status");
+
+  function setStatus(text) {
+    status.textContent = text;
+  }
+
+  function request(method, url, headers, body) {
+    return fetch(url, { method: method, headers: headers || {}, body: body, credentials: "same-origin" })
+      .then(function (resp) {
+        if (!resp.ok && resp.status !== 207) {
+          throw new Error(method + " " + decodeURIComponent(url) + ": " + resp.status + " " + resp.statusText);
+        }
+        return resp;
+      });
+  }
+
+  function prop(el, name) {
+    var found = el.getElementsByTagNameNS(DAV, name);
+    return found.length ? found[0].textContent : "";
+  }
+
+  function formatSize(size) {
+    var units = ["B", "KB", "MB", "GB", "TB"];
+    var i = 0;
+    while (size >= 1024 && i < units.length - 1) {
+      size /= 1024;
+      i++;
+    }
+    return (i === 0 ? size : size.toFixed(1)) + " " + units[i];
+  }
+
+  function list() {
+    setStatus("Loading...");
+    var body = '<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop>' +
+      "<d:resourcetype/><d:getcontentlength/><d:getlastmodified/></d:prop></d:propfind>";
+    return request("PROPFIND", base, { "Depth": "1", "Content-Type": "application/xml" }, body)
+      .then(function (resp) { return resp.text(); })
+      .then(function (text) {
+        var doc = new DOMParser().parseFromString(text, "application/xml");
+        var items = [];
+        Array.prototype.forEach.call(doc.getElementsByTagNameNS(DAV, "response"), function (r) {
+          var href = prop(r, "href");
+          var path = new URL(href, location.href).pathname;
+          if (path.replace(/\/?$/, "/") === base) {
+            return;
+          }
+          var isDir = r.getElementsByTagNameNS(DAV, "collection").length > 0;
+          items.push({
+            href: path,
+            name: decodeURIComponent(path.replace(/\/$/, "").split("/").pop()),
+            dir: isDir,
+            size: isDir ? null : parseInt(prop(r, "getcontentlength"), 10),
+            modified: prop(r, "getlastmodified")
+          });
+        });
+        items.sort(function (a, b) {
+          return a.dir === b.dir ? a.name.localeCompare(b.name) : (a.dir ? -1 : 1);
+        });
+        render(items);
+        setStatus(items.length + " items");
+      })
+      .catch(function (err) { setStatus(err.message); });
+  }
+
+  function render(items) {
+    entries.innerHTML = "";
+    items.forEach(function (item) {
+      var tr = document.createElement("tr");
+
+      var name = document.createElement("td");
+      name.className = "name";
+      var link = document.createElement("a");
+      link.href = item.dir ? item.href.replace(/\/?$/, "/") : item.href;
+      link.textContent = item.name + (item.dir ? "/" : "");
+      if (item.dir) {
+        link.className = "dir";
+      } else {
+        link.setAttribute("download", item.name);
+      }
+      name.appendChild(link);
+
+      var size = document.createElement("td");
+      size.className = "size";
+      size.textContent = item.dir ? "" : formatSize(item.size);
+
+      var modified = document.createElement("td");
+      modified.className = "modified";
+      modified.textContent = item.modified ? new Date(item.modified).toLocaleString() : "";
+
+      var ops = document.createElement("td");
+      ops.className = "ops";
+      ops.appendChild(button("Rename", function () { rename(item); }));
+      ops.appendChild(button("Delete", function () { remove(item); }));
+
+      tr.appendChild(name);
+      tr.appendChild(size);
+      tr.appendChild(modified);
+      tr.appendChild(ops);
+      entries.appendChild(tr);
+    });
+  }
+
+  function button(label, onClick) {
+    var b = document.createElement("button");
+    b.type = "button";
+    b.textContent = label;
+    b.addEventListener("click", onClick);
+    return b;
+  }
+
+  function rename(item) {
+    var name = prompt("New name", item.name);
+    if (!name || name === item.name) {
+      return;
+    }
+    var destination = location.origin + base + encodeURIComponent(name) + (item.dir ? "/" : "");
+    request("MOVE", item.href, { "Destination": destination, "Overwrite": "F" })
+      .then(list)
+      .catch(function (err) { setStatus(err.message); });
+  }
+
+  function remove(item) {
+    if (!confirm("Delete " + item.name + "?")) {
+      return;
+    }
+    request("DELETE", item.href)
+      .then(list)
+      .catch(function (err) { setStatus(err.message); });
+  }
+
+  function upload(files) {
+    var pending = Array.prototype.slice.call(files);
+    var next = function () {
+      if (!pending.length) {
+        return list();
+      }
+      var f = pending.shift();
+      setStatus("Uploading " + f.name + "...");
+      return request("PUT", base + encodeURIComponent(f.name), {}, f).then(next);
+    };
+    next().catch(function (err) { setStatus(err.message); });
+  }
+
+  function breadcrumbs() {
+    var nav = document.getElementById("breadcrumbs");
+    var root = document.body.getAttribute("data-root");
+    var parts = base.slice(root.length).split("/").filter(function (p) { return p; });
+    var href = root;
+    var home = document.createElement("a");
+    home.href = href;
+    home.textContent = "/";
+    nav.appendChild(home);
+    parts.forEach(function (part, i) {
+      href += part + "/";
+      if (i > 0) {
+        var sep = document.createElement("span");
+        sep.className = "sep";
+        sep.textContent = "/";
+        nav.appendChild(sep);
+      }
+      var a = document.createElement("a");
+      a.href = href;
+      a.textContent = decodeURIComponent(part);
+      nav.appendChild(a);
+    });
+  }
+
+  document.getElementById("mkdir").addEventListener("click", function () {
+    var name = prompt("Folder name");
+    if (!name) {
+      return;
+    }
+    request("MKCOL", base + encodeURIComponent(name) + "/")
+      .then(list)
+      .catch(function (err) { setStatus(err.message); });
+  });
+
+  document.getElementById("upload").addEventListener("change", function (e) {
+    upload(e.target.files);
+    e.target.value = "";
+  });
+
+  var drop = document.getElementById("drop");
+  drop.addEventListener("dragover", function (e) {
+    e.preventDefault();
+    drop.classList.add("dragover");
+  });
+  drop.addEventListener("dragleave", function () {
+    drop.classList.remove("dragover");
+  });
+  drop.addEventListener("drop", function (e) {
+    e.preventDefault();
+    drop.classList.remove("dragover");
+    upload(e.dataTransfer.files);
+  });
+
+  breadcrumbs();
+  list();
+})();
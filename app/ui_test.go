@@ -0,0 +1,56 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestServeUI(t *testing.T) {
+	fs := webdav.NewMemFS()
+	fs.Mkdir(context.Background(), "/dir", 0700)
+	f, _ := fs.OpenFile(context.Background(), "/dir/file", os.O_RDWR|os.O_CREATE, 0600)
+	f.Close()
+
+	tests := []struct {
+		name       string
+		disabled   bool
+		path       string
+		accept     string
+		statusCode int
+		contains   string
+	}{
+		{"browser on directory", false, "/dir/", "text/html,*/*", 200, "/.dave/ui/app.js"},
+		{"redirect to trailing slash", false, "/dir", "text/html", 301, ""},
+		{"browser on file", false, "/dir/file", "text/html", 200, ""},
+		{"no browser", false, "/dir/", "*/*", 200, "Index of /dir/"},
+		{"disabled", true, "/dir/", "text/html", 200, "Index of /dir/"},
+		{"listing requested", false, "/dir/?format=json", "text/html", 200, `"name":"file"`},
+		{"asset", false, "/.dave/ui/app.js", "*/*", 200, "PROPFIND"},
+		{"template not served as asset", false, "/.dave/ui/index.html", "*/*", 404, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &App{
+				Config:  &Config{UI: UI{Disabled: tt.disabled}},
+				Handler: &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()},
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept", tt.accept)
+
+			handle(context.Background(), w, r, a)
+
+			if w.Code != tt.statusCode {
+				t.Errorf("status = %v, want %v", w.Code, tt.statusCode)
+			}
+			if !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("body doesn't contain %v", tt.contains)
+			}
+		})
+	}
+}
@@ -0,0 +1,623 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// partialPrefix is the name prefix of the temporary files of incomplete uploads.
+	partialPrefix = ".~dave-partial-"
+	// uploadSessionMaxAge is the time after which abandoned chunked uploads are removed.
+	uploadSessionMaxAge = 24 * time.Hour
+)
+
+var (
+	contentRangePattern = regexp.MustCompile(`^bytes (?:(\d+)-(\d+)|\*)/(\d+)$`)
+	uploadNamePattern   = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+)
+
+// partialName returns the name of the temporary file of an incomplete upload. The key
+// identifies the upload, so concurrent uploads of the same file don't share a temporary
+// file.
+func partialName(name, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(path.Dir(path.Clean("/"+name)), partialPrefix+hex.EncodeToString(sum[:8])+"-"+tempBase(path.Base(name)))
+}
+
+// partialKey identifies a ranged upload by the user, the total size and the optional
+// X-Upload-Id header of its requests.
+func partialKey(ctx context.Context, req *http.Request, total int64) string {
+	return strings.Join([]string{uploadOwner(ctx), req.Header.Get("X-Upload-Id"), strconv.FormatInt(total, 10)}, "\x00")
+}
+
+// isPartial returns whether the physical path is the temporary file of an upload.
+func isPartial(physical string) bool {
+	return strings.HasPrefix(filepath.Base(physical), partialPrefix)
+}
+
+// parseContentRange parses a Content-Range header of a partial PUT. A start of -1 means
+// that the client asks for the state of the upload ("bytes */total").
+func parseContentRange(header string) (start, end, total int64, err error) {
+	m := contentRangePattern.FindStringSubmatch(header)
+	if m == nil {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	total, _ = strconv.ParseInt(m[3], 10, 64)
+	if m[1] == "" {
+		return -1, -1, total, nil
+	}
+	start, _ = strconv.ParseInt(m[1], 10, 64)
+	end, _ = strconv.ParseInt(m[2], 10, 64)
+	if end < start || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+
+	return start, end, total, nil
+}
+
+// servePartialPut writes a range of a file into a temporary file next to the target. The
+// temporary file is moved into place once all bytes have been received, so an upload can
+// be resumed after a broken connection.
+func servePartialPut(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, name string) {
+	start, end, total, err := parseContentRange(req.Header.Get("Content-Range"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if start >= 0 && req.ContentLength >= 0 && req.ContentLength != end-start+1 {
+		http.Error(w, "Content-Length doesn't match Content-Range", http.StatusBadRequest)
+		return
+	}
+
+	fs := a.Handler.FileSystem
+	tmp := partialName(name, partialKey(ctx, req, total))
+	f, err := openPartial(ctx, fs, tmp, name, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		writeFileError(w, err)
+		return
+	}
+	size := fi.Size()
+
+	if start > size {
+		f.Close()
+		setReceivedRange(w, size)
+		http.Error(w, http.StatusText(http.StatusRequestedRangeNotSatisfiable), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if start >= 0 {
+		if _, err = f.Seek(start, io.SeekStart); err == nil {
+			var n int64
+			var r io.Reader = io.LimitReader(req.Body, end-start+1)
+			sums := rangeChecksummer(ctx)
+			if sums != nil {
+				r = io.TeeReader(r, sums)
+			}
+			n, err = io.Copy(f, r)
+			if start+n > size {
+				size = start + n
+			}
+			if err == nil && sums != nil && !sums.verify(uploadFromContext(ctx).expected) {
+				// the range has to be sent again, the bytes before it are kept
+				err, size = errChecksumMismatch, start
+				if t, ok := f.(interface{ Truncate(int64) error }); !ok {
+					size = 0
+				} else if truncErr := t.Truncate(start); truncErr != nil {
+					err = truncErr
+				}
+			}
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == errChecksumMismatch {
+		if size == 0 {
+			removePartial(ctx, fs, tmp)
+		}
+		setReceivedRange(w, size)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.WithField("path", name).WithError(err).Warn("Partial upload interrupted")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if size < total {
+		setReceivedRange(w, size)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if size > total {
+		removePartial(ctx, fs, tmp)
+		http.Error(w, "upload exceeds announced size, please restart", http.StatusConflict)
+		return
+	}
+
+	var mtime time.Time
+	if u := uploadFromContext(ctx); u != nil {
+		mtime = u.mtime
+	}
+	created, err := commitUpload(ctx, fs, tmp, name, mtime)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// rangeChecksummer returns a checksummer for the algorithms of the checksums which the
+// client sent with a partial PUT, nil if there are none. The checksums of a partial PUT
+// cover the range in its body.
+func rangeChecksummer(ctx context.Context) checksummer {
+	u := uploadFromContext(ctx)
+	if u == nil || len(u.expected) == 0 {
+		return nil
+	}
+	algorithms := make([]string, 0, len(u.expected))
+	for algorithm := range u.expected {
+		algorithms = append(algorithms, algorithm)
+	}
+
+	return newChecksummer(algorithms...)
+}
+
+// setReceivedRange announces the bytes of an incomplete upload which have been received.
+func setReceivedRange(w http.ResponseWriter, size int64) {
+	if size > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", size-1))
+	}
+}
+
+// openPartial opens the temporary file of an upload of name.
+func openPartial(ctx context.Context, fs webdav.FileSystem, tmp, name string, flag int) (webdav.File, error) {
+	if d, ok := fs.(*Dir); ok {
+		return d.openPartial(ctx, tmp, name, flag)
+	}
+
+	return fs.OpenFile(ctx, tmp, flag, 0666)
+}
+
+// openPartial opens the temporary file of an upload of name, if the user may create or
+// replace name. It's written by several requests, so in a drop box it may exist already
+// as long as name doesn't.
+func (d Dir) openPartial(ctx context.Context, tmp, name string, flag int) (*os.File, error) {
+	physicalTmp, physical := d.resolveInternal(ctx, tmp), d.resolve(ctx, name)
+	if physicalTmp == "" || physical == "" {
+		return nil, os.ErrNotExist
+	}
+	box, inBox := d.dropbox(ctx, physical)
+	switch {
+	case inBox && physical == box:
+		return nil, os.ErrPermission
+	case inBox:
+		if _, err := os.Lstat(physical); err == nil {
+			return nil, os.ErrPermission
+		}
+	case d.readOnly(ctx):
+		return nil, os.ErrPermission
+	}
+	if err := d.checkSymlinks(ctx, physical, false); err != nil {
+		return nil, err
+	}
+	if d.hidden(physical) && !d.discardHidden() {
+		return nil, os.ErrPermission
+	}
+
+	return d.openFile(ctx, physicalTmp, flag, 0666)
+}
+
+// removePartial removes the temporary file of an upload.
+func removePartial(ctx context.Context, fs webdav.FileSystem, tmp string) {
+	if d, ok := fs.(*Dir); ok {
+		if physical := d.resolveInternal(ctx, tmp); physical != "" {
+			d.remove(ctx, physical)
+		}
+		return
+	}
+
+	fs.RemoveAll(ctx, tmp)
+}
+
+// commitUpload moves the temporary file of a completed upload to its target and returns
+// whether the target has been created. The modification time is set if not zero.
+func commitUpload(ctx context.Context, fs webdav.FileSystem, tmp, name string, mtime time.Time) (bool, error) {
+	if d, ok := fs.(*Dir); ok {
+		return d.commitUpload(ctx, tmp, name, mtime)
+	}
+
+	_, err := fs.Stat(ctx, name)
+	return os.IsNotExist(err), fs.Rename(ctx, tmp, name)
+}
+
+// commitUpload moves the temporary file of an upload to its target and records the
+// operation as write of the target. Within a drop box, existing files aren't replaced.
+func (d Dir) commitUpload(ctx context.Context, tmp, name string, mtime time.Time) (bool, error) {
+	physicalTmp, physical := d.resolveInternal(ctx, tmp), d.resolve(ctx, name)
+	if physicalTmp == "" || physical == "" {
+		return false, os.ErrNotExist
+	}
+	box, inBox := d.dropbox(ctx, physical)
+	inBox = inBox && physical != box
+	if !inBox && (d.readOnly(ctx) || d.containsDropbox(ctx, physical)) {
+		return false, os.ErrPermission
+	}
+	if err := d.checkSymlinks(ctx, physical, false); err != nil {
+		return false, err
+	}
+	if d.hidden(physical) {
+		if d.discardHidden() {
+			return true, d.remove(ctx, physicalTmp)
+		}
+		return false, os.ErrPermission
+	}
+	if fi, err := d.stat(ctx, physical); err == nil && fi.IsDir() {
+		return false, os.ErrExist
+	}
+
+	if !mtime.IsZero() {
+		if err := d.chtimes(ctx, physicalTmp, time.Now(), mtime); err != nil {
+			return false, err
+		}
+	}
+
+	_, err := d.stat(ctx, physical)
+	created := os.IsNotExist(err)
+	if err := d.replace(ctx, physicalTmp, physical, inBox); err != nil {
+		if inBox && os.IsExist(err) {
+			d.remove(ctx, physicalTmp)
+			return false, os.ErrPermission
+		}
+		return false, err
+	}
+	d.fileWritten(ctx, name, physical, created, nil)
+
+	return created, nil
+}
+
+// serveChunkedUpload implements uploads in chunks below <prefix>/.dave/uploads:
+//
+//	MKCOL  uploads/<id>             starts an upload
+//	PUT    uploads/<id>/<chunk>     stores a chunk, chunks are assembled in order of their names
+//	GET    uploads/<id>             lists the received chunks
+//	MOVE   uploads/<id>/.file       assembles the chunks at the Destination
+//	DELETE uploads/<id>             aborts the upload
+func serveChunkedUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, rest string) {
+	parts := strings.SplitN(rest, "/", 2)
+	id, chunk := parts[0], ""
+	if len(parts) == 2 {
+		chunk = parts[1]
+	}
+	if !uploadNamePattern.MatchString(id) || (chunk != "" && chunk != ".file" && !uploadNamePattern.MatchString(chunk)) {
+		http.Error(w, "invalid upload or chunk name", http.StatusBadRequest)
+		return
+	}
+
+	session := filepath.Join(uploadsDir(a.Config), uploadOwner(ctx), id)
+
+	switch {
+	case req.Method == "MKCOL" && chunk == "":
+		cleanupUploadSessions(filepath.Dir(session))
+		if err := os.MkdirAll(filepath.Dir(session), 0700); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		if err := os.Mkdir(session, 0700); err != nil {
+			if os.IsExist(err) {
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			writeFileError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && chunk != "" && chunk != ".file":
+		if _, err := os.Stat(session); err != nil {
+			http.Error(w, "upload not found", http.StatusNotFound)
+			return
+		}
+		limit, err := chunkAllowance(ctx, a, filepath.Dir(session), filepath.Join(session, chunk))
+		if err == nil {
+			err = writeChunk(ctx, filepath.Join(session, chunk), req.Body, limit)
+		}
+		switch err {
+		case nil:
+		case errQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		case errChecksumMismatch:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			log.WithField("upload", id).WithError(err).Warn("Error writing chunk")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodGet && chunk == "":
+		chunks, err := uploadChunks(session)
+		if err != nil {
+			writeFileError(w, err)
+			return
+		}
+		type chunkInfo struct {
+			Name string `json:"name"`
+			Size int64  `json:"size"`
+		}
+		infos := make([]chunkInfo, 0, len(chunks))
+		for _, c := range chunks {
+			infos = append(infos, chunkInfo{Name: c.Name(), Size: c.Size()})
+		}
+		writeJSON(w, http.StatusOK, infos)
+	case req.Method == "MOVE" && chunk == ".file":
+		assembleUpload(ctx, w, req, a, session)
+	case req.Method == http.MethodDelete && chunk == "":
+		if err := os.RemoveAll(session); err != nil {
+			writeFileError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// assembleUpload concatenates the chunks of an upload into a temporary file next to the
+// destination and moves it into place.
+func assembleUpload(ctx context.Context, w http.ResponseWriter, req *http.Request, a *App, session string) {
+	dest, status := destinationPath(req)
+	if status == 0 && dest == "" {
+		status = http.StatusBadRequest
+	}
+	if status != 0 {
+		http.Error(w, "invalid Destination", status)
+		return
+	}
+	name, ok := a.webdavPath(dest)
+	if !ok {
+		http.Error(w, "invalid Destination", http.StatusBadGateway)
+		return
+	}
+	mtime, err := parseMtime(req.Header.Get("X-OC-Mtime"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chunks, err := uploadChunks(session)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+
+	fs := a.Handler.FileSystem
+	if req.Header.Get("Overwrite") == "F" {
+		if _, err := fs.Stat(ctx, name); err == nil {
+			http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	tmp := partialName(name, session)
+	f, err := openPartial(ctx, fs, tmp, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+	var size int64
+	for _, c := range chunks {
+		var n int64
+		n, err = copyFile(f, filepath.Join(session, c.Name()))
+		size += n
+		if err != nil {
+			break
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		if expected := req.Header.Get("OC-Total-Length"); expected != "" && expected != strconv.FormatInt(size, 10) {
+			err = errors.New("size of the chunks doesn't match OC-Total-Length")
+		}
+	}
+	if err != nil {
+		removePartial(ctx, fs, tmp)
+		log.WithField("path", name).WithError(err).Warn("Error assembling chunked upload")
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	created, err := commitUpload(ctx, fs, tmp, name, mtime)
+	if err != nil {
+		removePartial(ctx, fs, tmp)
+		writeFileError(w, err)
+		return
+	}
+	os.RemoveAll(session)
+
+	if !mtime.IsZero() {
+		w.Header().Set("X-OC-MTime", "accepted")
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// uploadChunks returns the chunks of an upload in the order of assembly. Chunks with
+// numeric names are ordered numerically, all others by name.
+func uploadChunks(session string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(session)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := infos[:0]
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && !strings.HasPrefix(fi.Name(), ".") {
+			chunks = append(chunks, fi)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		a, errA := strconv.ParseUint(chunks[i].Name(), 10, 64)
+		b, errB := strconv.ParseUint(chunks[j].Name(), 10, 64)
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return chunks[i].Name() < chunks[j].Name()
+	})
+
+	return chunks, nil
+}
+
+// writeChunk stores a chunk via a temporary file, so that interrupted chunks and chunks
+// which don't match their checksums don't end up in the assembled file. Chunks longer
+// than a limit of 0 or more are rejected with errQuotaExceeded.
+func writeChunk(ctx context.Context, name string, r io.Reader, limit int64) error {
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	n, err := io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	switch {
+	case err != nil:
+	case limit >= 0 && n > limit:
+		err = errQuotaExceeded
+	case uploadFailed(ctx):
+		err = errChecksumMismatch
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// chunkAllowance returns how many bytes a chunk may have to fit into the quota of the
+// user, -1 if the user has no quota. The chunks spooled by all uploads of the user count
+// like the files in their directory, except for the chunk which is replaced.
+func chunkAllowance(ctx context.Context, a *App, owner, replaced string) (int64, error) {
+	quota := userQuota(ctx, a.Config)
+	if quota <= 0 {
+		return -1, nil
+	}
+	var used int64
+	if d, ok := a.Handler.FileSystem.(*Dir); ok {
+		var err error
+		if used, err = d.usage(ctx); err != nil {
+			return 0, err
+		}
+	}
+	err := filepath.Walk(owner, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && p != replaced {
+			used += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if used >= quota {
+		return 0, nil
+	}
+
+	return quota - used, nil
+}
+
+func copyFile(w io.Writer, name string) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(w, f)
+}
+
+// uploadsDir returns the directory which keeps the chunks of uploads.
+func uploadsDir(config *Config) string {
+	if config.Uploads.Dir != "" {
+		return config.Uploads.Dir
+	}
+
+	return filepath.Join(os.TempDir(), "dave-uploads")
+}
+
+// uploadOwner returns the name of the directory which keeps the uploads of the user.
+func uploadOwner(ctx context.Context) string {
+	if authInfo := AuthFromContext(ctx); authInfo != nil && authInfo.Authenticated {
+		return url.PathEscape(authInfo.Username)
+	}
+
+	return "_"
+}
+
+// cleanupUploadSessions removes abandoned uploads of a user.
+func cleanupUploadSessions(dir string) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, fi := range infos {
+		if fi.IsDir() && time.Since(fi.ModTime()) > uploadSessionMaxAge {
+			os.RemoveAll(filepath.Join(dir, fi.Name()))
+		}
+	}
+}
+
+// writeFileError answers a request with the status matching a file system error.
+func writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case os.IsPermission(err):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case os.IsExist(err):
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	default:
+		log.WithError(err).Error("Error handling upload")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,264 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header             string
+		wantStart, wantEnd int64
+		wantTotal          int64
+		wantErr            bool
+	}{
+		{"bytes 0-4/10", 0, 4, 10, false},
+		{"bytes 5-9/10", 5, 9, 10, false},
+		{"bytes */10", -1, -1, 10, false},
+		{"bytes 5-10/10", 0, 0, 0, true},
+		{"bytes 5-4/10", 0, 0, 0, true},
+		{"bytes 0-4/*", 0, 0, 0, true},
+		{"items 0-4/10", 0, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			start, end, total, err := parseContentRange(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseContentRange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if start != tt.wantStart || end != tt.wantEnd || total != tt.wantTotal {
+				t.Errorf("parseContentRange() = %d, %d, %d, want %d, %d, %d", start, end, total, tt.wantStart, tt.wantEnd, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestServePartialPut(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	os.Mkdir(filepath.Join(tmpDir, "subdir1"), 0700)
+	config := createTestConfig(tmpDir)
+	events := NewEventBus()
+	var published []Event
+	events.Subscribe(func(e Event) { published = append(published, e) })
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config, Events: events}, LockSystem: webdav.NewMemLS()},
+	}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	steps := []struct {
+		name         string
+		contentRange string
+		checksum     string
+		body         string
+		statusCode   int
+		wantRange    string
+	}{
+		{"first part", "bytes 0-4/11", "", "hello", 202, "bytes=0-4"},
+		{"query state", "bytes */11", "", "", 202, "bytes=0-4"},
+		{"gap", "bytes 6-10/11", "", "world", 416, "bytes=0-4"},
+		{"wrong checksum", "bytes 3-5/11", "MD5:7d793037a0760186574b0282f2f435e7", "lo ", 400, "bytes=0-2"},
+		{"repeated part", "bytes 3-5/11", "MD5:e91671aebf4dcbc0ced71f770078cf36", "lo ", 202, "bytes=0-5"},
+		{"last part", "bytes 6-10/11", "MD5:7d793037a0760186574b0282f2f435e7", "world", 201, ""},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest("PUT", "/big.txt", strings.NewReader(s.body))
+		req.Header.Set("Content-Range", s.contentRange)
+		if s.checksum != "" {
+			req.Header.Set("OC-Checksum", s.checksum)
+		}
+		w := httptest.NewRecorder()
+		uploadCtx, uw, req, _ := trackUpload(ctx, w, req, a)
+		serve(uploadCtx, uw, req, a)
+		if w.Code != s.statusCode {
+			t.Errorf("%s: status = %v, want %v", s.name, w.Code, s.statusCode)
+		}
+		if got := w.Header().Get("Range"); got != s.wantRange {
+			t.Errorf("%s: Range = %q, want %q", s.name, got, s.wantRange)
+		}
+		if s.statusCode == 202 {
+			if _, err := os.Stat(filepath.Join(tmpDir, "subdir1", "big.txt")); !os.IsNotExist(err) {
+				t.Errorf("%s: incomplete upload has been moved into place", s.name)
+			}
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "big.txt"))
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("uploaded file = %q, %v, want %q", b, err, "hello world")
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(tmpDir, "subdir1", partialPrefix+"*")); len(tmps) > 0 {
+		t.Errorf("temporary files haven't been removed: %v", tmps)
+	}
+	if len(published) != 1 || published[0].Type != EventCreate || published[0].Path != "/subdir1/big.txt" {
+		t.Errorf("published events = %+v, want a single create of /subdir1/big.txt", published)
+	}
+}
+
+func TestServePartialPutConcurrent(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	os.MkdirAll(filepath.Join(tmpDir, "subdir1", "inbox"), 0700)
+	config := createTestConfig(tmpDir)
+	config.Dropboxes = []*Dropbox{{Path: "/subdir1/inbox", Owners: []string{"admin"}}}
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	steps := []struct {
+		name         string
+		path         string
+		uploadID     string
+		contentRange string
+		body         string
+		statusCode   int
+	}{
+		{"first upload", "/big.txt", "a", "bytes 0-4/10", "aaaaa", 202},
+		{"second upload", "/big.txt", "b", "bytes 0-4/10", "bbbbb", 202},
+		{"first upload done", "/big.txt", "a", "bytes 5-9/10", "AAAAA", 201},
+		{"second upload done", "/big.txt", "b", "bytes 5-9/10", "BBBBB", 204},
+		{"drop box first part", "/inbox/file", "", "bytes 0-4/10", "hello", 202},
+		{"drop box last part", "/inbox/file", "", "bytes 5-9/10", "world", 201},
+		{"drop box overwrite", "/inbox/file", "", "bytes 0-4/5", "again", 403},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest("PUT", s.path, strings.NewReader(s.body))
+		req.Header.Set("Content-Range", s.contentRange)
+		if s.uploadID != "" {
+			req.Header.Set("X-Upload-Id", s.uploadID)
+		}
+		w := httptest.NewRecorder()
+		serve(ctx, w, req, a)
+		if w.Code != s.statusCode {
+			t.Errorf("%s: status = %v, want %v", s.name, w.Code, s.statusCode)
+		}
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "big.txt")); string(b) != "bbbbbBBBBB" {
+		t.Errorf("uploaded file = %q, want %q", b, "bbbbbBBBBB")
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "inbox", "file")); string(b) != "helloworld" {
+		t.Errorf("file in drop box = %q, want %q", b, "helloworld")
+	}
+}
+
+func TestServeChunkedUpload(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	os.Mkdir(filepath.Join(tmpDir, "subdir1"), 0700)
+	config := createTestConfig(tmpDir)
+	config.Uploads.Dir = filepath.Join(tmpDir, ".uploads")
+	config.Prefix = "/dav"
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{Prefix: "/dav", FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		header     map[string]string
+		statusCode int
+	}{
+		{"chunk without upload", "PUT", "/dav/.dave/uploads/abc/1", "x", nil, 404},
+		{"start upload", "MKCOL", "/dav/.dave/uploads/abc", "", nil, 201},
+		{"start upload twice", "MKCOL", "/dav/.dave/uploads/abc", "", nil, 405},
+		{"invalid chunk name", "PUT", "/dav/.dave/uploads/abc/..", "x", nil, 400},
+		{"chunk 10", "PUT", "/dav/.dave/uploads/abc/10", "world", nil, 201},
+		{"chunk 2", "PUT", "/dav/.dave/uploads/abc/2", "hello ", nil, 201},
+		{"chunk with wrong checksum", "PUT", "/dav/.dave/uploads/abc/3", "world", map[string]string{"OC-Checksum": "MD5:f814893777bcc2295fff05f00e508da6"}, 400},
+		{"chunk with checksum", "PUT", "/dav/.dave/uploads/abc/2", "hello ", map[string]string{"OC-Checksum": "MD5:f814893777bcc2295fff05f00e508da6"}, 201},
+		{"list chunks", "GET", "/dav/.dave/uploads/abc", "", nil, 200},
+		{"foreign destination", "MOVE", "/dav/.dave/uploads/abc/.file", "", map[string]string{"Destination": "http://elsewhere.org/dav/big.txt"}, 502},
+		{"wrong total length", "MOVE", "/dav/.dave/uploads/abc/.file", "", map[string]string{"Destination": "http://example.com/dav/big.txt", "OC-Total-Length": "12"}, 409},
+		{"assemble", "MOVE", "/dav/.dave/uploads/abc/.file", "", map[string]string{"Destination": "http://example.com/dav/big.txt", "OC-Total-Length": "11"}, 201},
+		{"upload is gone", "GET", "/dav/.dave/uploads/abc", "", nil, 404},
+		{"abort upload", "MKCOL", "/dav/.dave/uploads/def", "", nil, 201},
+		{"abort upload", "DELETE", "/dav/.dave/uploads/def", "", nil, 204},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+		for k, v := range s.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		uploadCtx, uw, req, _ := trackUpload(ctx, w, req, a)
+		serve(uploadCtx, uw, req, a)
+		if w.Code != s.statusCode {
+			t.Errorf("%s: status = %v, want %v", s.name, w.Code, s.statusCode)
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "subdir1", "big.txt"))
+	if err != nil || string(b) != "hello world" {
+		t.Errorf("assembled file = %q, %v, want %q", b, err, "hello world")
+	}
+	if _, err := os.Stat(filepath.Join(config.Uploads.Dir, "user1", "def")); !os.IsNotExist(err) {
+		t.Errorf("aborted upload hasn't been removed")
+	}
+}
+
+func TestServeChunkedUploadQuota(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	os.Mkdir(filepath.Join(tmpDir, "subdir1"), 0700)
+	ioutil.WriteFile(filepath.Join(tmpDir, "subdir1", "existing"), []byte("0123456789"), 0600)
+	config := createTestConfig(tmpDir)
+	config.Uploads.Dir = filepath.Join(tmpDir, ".uploads")
+	config.Users["user1"].Quota = 20
+	a := &App{
+		Config:  config,
+		Handler: &webdav.Handler{FileSystem: &Dir{Config: config}, LockSystem: webdav.NewMemLS()},
+	}
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "user1", Authenticated: true})
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{"start upload", "MKCOL", "/.dave/uploads/abc", "", 201},
+		{"start another upload", "MKCOL", "/.dave/uploads/def", "", 201},
+		{"first chunk", "PUT", "/.dave/uploads/abc/1", "01234", 201},
+		{"replaced chunk", "PUT", "/.dave/uploads/abc/1", "01234", 201},
+		{"chunk of another upload", "PUT", "/.dave/uploads/def/1", "01234", 201},
+		{"chunk exceeding quota", "PUT", "/.dave/uploads/abc/2", "0", 507},
+	}
+	for _, s := range steps {
+		req := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+		w := httptest.NewRecorder()
+		serve(ctx, w, req, a)
+		if w.Code != s.statusCode {
+			t.Errorf("%s: status = %v, want %v", s.name, w.Code, s.statusCode)
+		}
+	}
+
+	if chunks, _ := uploadChunks(filepath.Join(config.Uploads.Dir, "user1", "abc")); len(chunks) != 1 {
+		t.Errorf("chunks = %d, want 1", len(chunks))
+	}
+}
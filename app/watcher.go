@@ -0,0 +1,220 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// watchQuietPeriod is the time a file must not change before a write is published.
+	watchQuietPeriod = 500 * time.Millisecond
+	// watchOwnWindow is the time changes made through dave are ignored by the watcher.
+	watchOwnWindow = 2 * time.Second
+)
+
+// pendingWrite is a file which has been written outside of dave.
+type pendingWrite struct {
+	last    time.Time
+	created bool
+}
+
+// Watcher publishes changes of the base dir which haven't been made through dave.
+type Watcher struct {
+	dir         Dir
+	fsw         *fsnotify.Watcher
+	mu          sync.Mutex
+	own         map[string]time.Time
+	pending     map[string]*pendingWrite
+	done        chan struct{}
+	unsubscribe func()
+}
+
+// NewWatcher creates a watcher for the base dir and all of its subdirectories.
+func NewWatcher(config *Config, events *EventBus) (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		dir:     Dir{Config: config, Events: events},
+		fsw:     fsw,
+		own:     make(map[string]time.Time),
+		pending: make(map[string]*pendingWrite),
+		done:    make(chan struct{}),
+	}
+	w.unsubscribe = events.Subscribe(w.remember)
+
+	if err := w.addTree(config.Dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Run publishes file system events until the watcher is closed.
+func (w *Watcher) Run() {
+	ticker := time.NewTicker(watchQuietPeriod / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case e, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			w.handle(e)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.WithError(err).Warn("Error watching base dir")
+		case <-ticker.C:
+			w.flush()
+		}
+	}
+}
+
+// Close stops watching the base dir.
+func (w *Watcher) Close() error {
+	w.unsubscribe()
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+
+	return w.fsw.Close()
+}
+
+// remember records the paths of events published by dave itself, so that the
+// resulting file system events can be ignored.
+func (w *Watcher) remember(e Event) {
+	if e.External {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	w.own[e.Path] = now
+	if e.NewPath != "" {
+		w.own[e.NewPath] = now
+	}
+	for p, t := range w.own {
+		if now.Sub(t) > watchOwnWindow {
+			delete(w.own, p)
+		}
+	}
+}
+
+func (w *Watcher) isOwn(rel string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t, ok := w.own[rel]
+	return ok && time.Since(t) <= watchOwnWindow
+}
+
+func (w *Watcher) handle(e fsnotify.Event) {
+	rel := w.dir.relative(e.Name)
+	if rel == "" || rel == "/" || isInternal(e.Name) {
+		return
+	}
+
+	switch {
+	case e.Has(fsnotify.Create):
+		fi, err := os.Lstat(e.Name)
+		if err != nil {
+			return
+		}
+		if fi.IsDir() {
+			if err := w.addTree(e.Name); err != nil {
+				log.WithField("path", e.Name).WithError(err).Warn("Can't watch directory")
+			}
+			if !w.isOwn(rel) {
+				w.publish(Event{Type: EventMkdir, Path: rel, IsDir: true})
+			}
+			return
+		}
+		w.schedule(rel, true)
+	case e.Has(fsnotify.Write):
+		w.schedule(rel, false)
+	case e.Has(fsnotify.Remove), e.Has(fsnotify.Rename):
+		w.mu.Lock()
+		delete(w.pending, rel)
+		w.mu.Unlock()
+		if !w.isOwn(rel) {
+			w.publish(Event{Type: EventDelete, Path: rel})
+		}
+	}
+}
+
+// schedule delays the publication of a written file until it stopped changing.
+func (w *Watcher) schedule(rel string, created bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p, ok := w.pending[rel]; ok {
+		p.last = time.Now()
+		return
+	}
+	w.pending[rel] = &pendingWrite{last: time.Now(), created: created}
+}
+
+// flush publishes all written files which didn't change within the quiet period.
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	due := make(map[string]*pendingWrite)
+	for rel, p := range w.pending {
+		if time.Since(p.last) >= watchQuietPeriod {
+			due[rel] = p
+			delete(w.pending, rel)
+		}
+	}
+	w.mu.Unlock()
+
+	for rel, p := range due {
+		if w.isOwn(rel) {
+			continue
+		}
+		fi, err := os.Stat(w.dir.physical(rel))
+		if err != nil {
+			continue
+		}
+		eventType := EventOverwrite
+		if p.created {
+			eventType = EventCreate
+		}
+		size := fi.Size()
+		w.publish(Event{Type: eventType, Path: rel, Size: &size})
+	}
+}
+
+func (w *Watcher) publish(e Event) {
+	e.External = true
+	e.Time = time.Now()
+	w.dir.Events.Publish(e)
+}
+
+// addTree watches a directory and all of its subdirectories.
+func (w *Watcher) addTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			return w.fsw.Add(path)
+		}
+		return nil
+	})
+}
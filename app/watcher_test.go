@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	config := createTestConfig(tmpDir)
+	bus := NewEventBus()
+	events := make(chan Event, 16)
+	bus.Subscribe(func(e Event) { events <- e })
+
+	watcher, err := NewWatcher(config, bus)
+	if err != nil {
+		t.Fatalf("NewWatcher() error = %v", err)
+	}
+	defer watcher.Close()
+	go watcher.Run()
+
+	// changes made through dave are published once
+	ctx := context.WithValue(context.Background(), authInfoKey, &AuthInfo{Username: "admin", Authenticated: true})
+	d := Dir{Config: config, Events: bus}
+	if err := d.Mkdir(ctx, "own", 0700); err != nil {
+		t.Fatalf("Dir.Mkdir() error = %v", err)
+	}
+	if e := <-events; e.Type != EventMkdir || e.External {
+		t.Errorf("got event %+v, want own mkdir", e)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "external"), []byte("content"), 0600); err != nil {
+		t.Fatalf("error writing file. error = %v", err)
+	}
+
+	select {
+	case e := <-events:
+		if e.Type != EventCreate || e.Path != "/external" || !e.External {
+			t.Errorf("got event %+v, want external create of /external", e)
+		}
+		if e.Size == nil || *e.Size != 7 {
+			t.Errorf("got size %v, want 7", e.Size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event for external change")
+	}
+}
@@ -0,0 +1,370 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebhookRetries = 5
+	defaultWebhookSize    = 10000
+	webhookBackoff        = 10 * time.Second
+	maxWebhookBackoff     = time.Hour
+)
+
+// webhookDelivery is a pending notification of a webhook. The secret isn't part of the
+// delivery, so it is never written to the persistent queue. Hook is the position of the
+// webhook in the configuration.
+type webhookDelivery struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Hook     int             `json:"hook"`
+	Event    string          `json:"event"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Next     time.Time       `json:"next"`
+}
+
+// WebhookDispatcher delivers file events to the configured webhooks. Failed deliveries
+// are retried with an exponential backoff and kept in a persistent queue, if configured.
+// The queue is written by the delivery goroutine only, never while publishing an event.
+type WebhookDispatcher struct {
+	config *Config
+	client *http.Client
+	mu     sync.Mutex
+	queue  []*webhookDelivery
+	dirty  bool
+	wake   chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+}
+
+// NewWebhookDispatcher creates a dispatcher and restores the persistent retry queue.
+func NewWebhookDispatcher(config *Config) (*WebhookDispatcher, error) {
+	w := &WebhookDispatcher{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+
+	if config.Webhooks.Queue != "" {
+		b, err := ioutil.ReadFile(config.Webhooks.Queue)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &w.queue); err != nil {
+				return nil, fmt.Errorf("corrupt webhook queue %s: %s", config.Webhooks.Queue, err)
+			}
+		}
+	}
+
+	return w, nil
+}
+
+// Notify enqueues a delivery of the event for each matching webhook. Changes which
+// haven't been made through dave are ignored, as well as changes of hidden files and
+// within drop boxes. If the queue is full, the oldest deliveries are dropped.
+func (w *WebhookDispatcher) Notify(e Event) {
+	if e.External {
+		return
+	}
+	e, visible := e.ForUser(w.config, "")
+	if !visible {
+		return
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.WithError(err).Error("Error encoding webhook event")
+		return
+	}
+
+	w.mu.Lock()
+	enqueued := false
+	for i, hook := range w.config.Webhooks.Hooks {
+		if !hook.matches(e) {
+			continue
+		}
+		w.queue = append(w.queue, &webhookDelivery{
+			ID:    newDeliveryID(),
+			URL:   hook.URL,
+			Hook:  i,
+			Event: e.Type,
+			Body:  body,
+			Next:  time.Now(),
+		})
+		enqueued = true
+	}
+	if enqueued {
+		w.dirty = true
+		w.trim()
+	}
+	w.mu.Unlock()
+
+	if enqueued {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run delivers queued events until Stop is called. Changes of the queue are written
+// to the queue file once per round of deliveries.
+func (w *WebhookDispatcher) Run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	defer close(w.exited)
+
+	for {
+		select {
+		case <-w.done:
+			w.persist()
+			return
+		case <-w.wake:
+		case <-timer.C:
+		}
+
+		w.persist()
+		next := w.deliverDue()
+		w.persist()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// Stop terminates Run and waits until the queue has been written.
+func (w *WebhookDispatcher) Stop() {
+	close(w.done)
+	<-w.exited
+}
+
+// deliverDue sends all deliveries which are due and returns the time of the next
+// pending delivery.
+func (w *WebhookDispatcher) deliverDue() time.Time {
+	w.mu.Lock()
+	var due []*webhookDelivery
+	now := time.Now()
+	for _, d := range w.queue {
+		if !d.Next.After(now) {
+			due = append(due, d)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, d := range due {
+		err := w.send(d)
+
+		w.mu.Lock()
+		if err == nil {
+			w.remove(d)
+		} else {
+			d.Attempts++
+			retries := w.config.Webhooks.Retries
+			if retries <= 0 {
+				retries = defaultWebhookRetries
+			}
+			if d.Attempts > retries {
+				log.WithField("url", d.URL).WithField("event", d.Event).WithError(err).Error("Giving up webhook delivery")
+				w.remove(d)
+			} else {
+				log.WithField("url", d.URL).WithField("attempt", d.Attempts).WithError(err).Warn("Webhook delivery failed")
+				d.Next = time.Now().Add(backoff(d.Attempts))
+			}
+		}
+		w.dirty = true
+		w.mu.Unlock()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var next time.Time
+	for _, d := range w.queue {
+		if next.IsZero() || d.Next.Before(next) {
+			next = d.Next
+		}
+	}
+
+	return next
+}
+
+// send posts a delivery signed with the secret of its webhook.
+func (w *WebhookDispatcher) send(d *webhookDelivery) error {
+	secret := ""
+	if hook := w.hook(d); hook != nil {
+		secret = hook.Secret
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dave-Event", d.Event)
+	req.Header.Set("X-Dave-Delivery", d.ID)
+	if secret != "" {
+		req.Header.Set("X-Dave-Signature", "sha256="+sign([]byte(secret), d.Body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// hook returns the webhook of a delivery. Webhooks may share an URL with different
+// secrets, so a delivery refers to its webhook by position. Only if the webhooks have
+// been reconfigured since it was queued, the webhook is looked up by URL.
+func (w *WebhookDispatcher) hook(d *webhookDelivery) *Webhook {
+	hooks := w.config.Webhooks.Hooks
+	if d.Hook >= 0 && d.Hook < len(hooks) && hooks[d.Hook].URL == d.URL {
+		return hooks[d.Hook]
+	}
+	for _, hook := range hooks {
+		if hook.URL == d.URL {
+			return hook
+		}
+	}
+
+	return nil
+}
+
+// trim drops the oldest deliveries if the queue exceeds its size. The caller must hold
+// the lock.
+func (w *WebhookDispatcher) trim() {
+	size := w.config.Webhooks.Size
+	if size <= 0 {
+		size = defaultWebhookSize
+	}
+	if dropped := len(w.queue) - size; dropped > 0 {
+		log.WithField("dropped", dropped).Warn("Webhook queue is full, dropping the oldest deliveries")
+		w.queue = w.queue[dropped:]
+	}
+}
+
+// remove drops a delivery from the queue. The caller must hold the lock.
+func (w *WebhookDispatcher) remove(d *webhookDelivery) {
+	for i, q := range w.queue {
+		if q == d {
+			w.queue = append(w.queue[:i], w.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// persist writes the queue to the configured file, if it has changed since it has been
+// written last. It's only called by the delivery goroutine.
+func (w *WebhookDispatcher) persist() {
+	file := w.config.Webhooks.Queue
+	w.mu.Lock()
+	if file == "" || !w.dirty {
+		w.mu.Unlock()
+		return
+	}
+	b, err := json.Marshal(w.queue)
+	w.dirty = false
+	w.mu.Unlock()
+
+	if err == nil {
+		tmp := file + ".tmp"
+		if err = ioutil.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, file)
+		}
+	}
+	if err != nil {
+		log.WithField("path", file).WithError(err).Error("Error writing webhook queue")
+	}
+}
+
+// matches returns whether the webhook is interested in the event.
+func (hook *Webhook) matches(e Event) bool {
+	if len(hook.Events) > 0 && !containsString(hook.Events, e.Type) {
+		return false
+	}
+	if len(hook.Paths) == 0 {
+		return true
+	}
+
+	for _, pattern := range hook.Paths {
+		if matchPath(pattern, e.Path) || (e.NewPath != "" && matchPath(pattern, e.NewPath)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPath matches a slash separated path against a glob. Patterns without a slash are
+// matched against the last element of the path only.
+func matchPath(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(pattern, name)
+
+	return ok
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func backoff(attempts int) time.Duration {
+	d := webhookBackoff << uint(attempts-1)
+	if d <= 0 || d > maxWebhookBackoff {
+		return maxWebhookBackoff
+	}
+
+	return d
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// sign calculates the hex encoded HMAC-SHA256 of a request body.
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
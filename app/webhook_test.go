@@ -0,0 +1,116 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	tests := []struct {
+		name  string
+		hook  *Webhook
+		event Event
+		want  bool
+	}{
+		{"no filter", &Webhook{}, Event{Type: EventCreate, Path: "/a/b.csv"}, true},
+		{"event type", &Webhook{Events: []string{EventDelete}}, Event{Type: EventCreate, Path: "/a"}, false},
+		{"base name glob", &Webhook{Paths: []string{"*.csv"}}, Event{Type: EventCreate, Path: "/a/b.csv"}, true},
+		{"base name mismatch", &Webhook{Paths: []string{"*.csv"}}, Event{Type: EventCreate, Path: "/a/b.txt"}, false},
+		{"full path glob", &Webhook{Paths: []string{"/a/*"}}, Event{Type: EventCreate, Path: "/a/b.txt"}, true},
+		{"full path mismatch", &Webhook{Paths: []string{"/a/*"}}, Event{Type: EventCreate, Path: "/b/c/d"}, false},
+		{"rename target", &Webhook{Paths: []string{"/in/*"}}, Event{Type: EventRename, Path: "/tmp/x", NewPath: "/in/x"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hook.matches(tt.event); got != tt.want {
+				t.Errorf("Webhook.matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	config := &Config{Webhooks: Webhooks{Hooks: []*Webhook{
+		{URL: server.URL, Secret: "secret", Events: []string{EventCreate}},
+	}}}
+	dispatcher, err := NewWebhookDispatcher(config)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher() error = %v", err)
+	}
+	go dispatcher.Run()
+	defer dispatcher.Stop()
+
+	dispatcher.Notify(Event{Type: EventDelete, Path: "/ignored"})
+	dispatcher.Notify(Event{Type: EventCreate, Path: "/a"})
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		if got := r.Header.Get("X-Dave-Event"); got != EventCreate {
+			t.Errorf("X-Dave-Event = %v, want %v", got, EventCreate)
+		}
+		if got, want := r.Header.Get("X-Dave-Signature"), "sha256="+sign([]byte("secret"), body); got != want {
+			t.Errorf("X-Dave-Signature = %v, want %v", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	tmpDir := filepath.Join(os.TempDir(), "dave__"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	os.Mkdir(tmpDir, 0700)
+	defer os.RemoveAll(tmpDir)
+
+	queue := filepath.Join(tmpDir, "queue.json")
+	config := &Config{Webhooks: Webhooks{Queue: queue, Size: 3, Hooks: []*Webhook{
+		{URL: "http://127.0.0.1:1/hook", Secret: "first"},
+		{URL: "http://127.0.0.1:1/hook", Secret: "second"},
+	}}}
+	dispatcher, err := NewWebhookDispatcher(config)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher() error = %v", err)
+	}
+
+	dispatcher.Notify(Event{Type: EventCreate, Path: "/a"})
+	dispatcher.Notify(Event{Type: EventCreate, Path: "/b"})
+	if _, err := os.Stat(queue); !os.IsNotExist(err) {
+		t.Errorf("queue written while publishing, err = %v", err)
+	}
+	if len(dispatcher.queue) != 3 {
+		t.Fatalf("queue length = %v, want 3", len(dispatcher.queue))
+	}
+	if got := string(dispatcher.queue[0].Body); !strings.Contains(got, `"/a"`) || dispatcher.queue[0].Hook != 1 {
+		t.Errorf("oldest delivery has not been dropped: %s", got)
+	}
+	for _, d := range dispatcher.queue {
+		if got, want := dispatcher.hook(d), config.Webhooks.Hooks[d.Hook]; got != want {
+			t.Errorf("hook() = %v, want %v", got, want)
+		}
+	}
+
+	dispatcher.persist()
+	restored, err := NewWebhookDispatcher(config)
+	if err != nil {
+		t.Fatalf("NewWebhookDispatcher() error = %v", err)
+	}
+	if len(restored.queue) != 3 || restored.hook(restored.queue[2]).Secret != "second" {
+		t.Errorf("restored queue = %v", restored.queue)
+	}
+}
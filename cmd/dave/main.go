@@ -30,11 +30,58 @@ func main() {
 	defer writer.Close()
 	syslog.SetOutput(writer)
 
+	if removed, err := app.CleanupTempFiles(config); err != nil {
+		log.WithField("path", config.Dir).WithError(err).Warn("Can't remove temporary files")
+	} else if removed > 0 {
+		log.WithField("count", removed).Info("Removed temporary files of interrupted writes")
+	}
+
+	dir := &app.Dir{
+		Config:   config,
+		Events:   app.NewEventBus(),
+		Throttle: app.NewThrottle(config),
+	}
+
+	if config.Metadata.Dir != "" {
+		dir.Meta = app.NewMetaStore(config.Metadata.Dir)
+	}
+
+	if config.Audit.File != "" {
+		auditLog, err := app.OpenAuditLog(config.Audit.File)
+		if err != nil {
+			log.WithField("path", config.Audit.File).WithError(err).Fatal("Can't open audit log")
+		}
+		defer auditLog.Close()
+		dir.Audit = auditLog
+	}
+
+	webhooks, err := app.NewWebhookDispatcher(config)
+	if err != nil {
+		log.WithField("path", config.Webhooks.Queue).WithError(err).Fatal("Can't restore webhook queue")
+	}
+	dir.Events.Subscribe(webhooks.Notify)
+	go webhooks.Run()
+
+	var index *app.Index
+	if config.Search.Enabled {
+		index = app.NewIndex(config)
+		dir.Events.Subscribe(index.Notify)
+		defer index.Close()
+		go index.Run()
+	}
+
+	if config.Events.Watch || config.Search.Enabled {
+		watcher, err := app.NewWatcher(config, dir.Events)
+		if err != nil {
+			log.WithField("path", config.Dir).WithError(err).Fatal("Can't watch base dir")
+		}
+		defer watcher.Close()
+		go watcher.Run()
+	}
+
 	wdHandler := &webdav.Handler{
-		Prefix: config.Prefix,
-		FileSystem: &app.Dir{
-			Config: config,
-		},
+		Prefix:     config.Prefix,
+		FileSystem: dir,
 		LockSystem: webdav.NewMemLS(),
 		Logger: func(request *http.Request, err error) {
 			if config.Log.Error && err != nil {
@@ -43,12 +90,20 @@ func main() {
 		},
 	}
 
+	limiter := app.NewLimiter(config)
 	a := &app.App{
 		Config:  config,
 		Handler: wdHandler,
+		Events:  dir.Events,
+		Index:   index,
+		Limiter: limiter,
+	}
+
+	if config.Shares.File != "" {
+		a.Shares = app.NewShareStore(config.Shares.File)
 	}
 
-	http.Handle("/", wrapRecovery(app.NewBasicAuthWebdavHandler(a), config))
+	http.Handle("/", wrapRecovery(limiter.Wrap(app.NewBasicAuthWebdavHandler(a)), config))
 	connAddr := fmt.Sprintf("%s:%s", config.Address, config.Port)
 
 	if config.TLS != nil {
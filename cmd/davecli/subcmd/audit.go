@@ -0,0 +1,40 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Tools for the audit log of file operations",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify [audit log file]",
+	Short: "Verifies the hash chain of an audit log",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		f, err := os.Open(args[0])
+		if err != nil {
+			fmt.Printf("An error occurred opening the audit log: %s\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+
+		count, err := app.VerifyAuditLog(f)
+		if err != nil {
+			fmt.Printf("Audit log is invalid after %d valid records: %s\n", count, err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Audit log is valid. Verified records: %d\n", count)
+	},
+}
+
+func init() {
+	auditCmd.AddCommand(auditVerifyCmd)
+	RootCmd.AddCommand(auditCmd)
+}
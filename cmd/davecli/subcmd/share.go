@@ -0,0 +1,125 @@
+package subcmd
+
+import (
+	"fmt"
+	"github.com/micromata/dave/app"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var (
+	shareConfigPath string
+	shareUser       string
+	sharePath       string
+	shareMode       string
+	shareExpires    time.Duration
+	shareDownloads  int
+	sharePassword   bool
+)
+
+var shareCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Manages share links",
+}
+
+var shareCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates a share link of a file or directory of a user",
+	Run: func(cmd *cobra.Command, args []string) {
+		config, store := readShareStore()
+
+		share := &app.Share{
+			User:         shareUser,
+			Path:         sharePath,
+			Mode:         shareMode,
+			MaxDownloads: shareDownloads,
+		}
+		if shareExpires > 0 {
+			expires := time.Now().Add(shareExpires)
+			share.Expires = &expires
+		}
+
+		password := ""
+		if sharePassword {
+			pw1 := readPassword()
+			pw2 := readPassword()
+			if string(pw1) != string(pw2) {
+				fmt.Println("Passwords doesn't match.")
+				os.Exit(1)
+			}
+			password = string(pw1)
+		}
+
+		if err := app.CreateShare(config, store, share, password); err != nil {
+			fmt.Printf("An error occurred creating the share link: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Created share link: %s\n", app.ShareURLPath(config, share.Token))
+	},
+}
+
+var shareListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists all share links",
+	Run: func(cmd *cobra.Command, args []string) {
+		_, store := readShareStore()
+
+		shares, err := store.List(nil)
+		if err != nil {
+			fmt.Printf("An error occurred reading the share links: %s\n", err)
+			os.Exit(1)
+		}
+
+		for _, share := range shares {
+			expires := "never"
+			if share.Expires != nil {
+				expires = share.Expires.Format(time.RFC3339)
+			}
+			fmt.Printf("%s\tuser=%s\tpath=%s\tmode=%s\texpires=%s\tdownloads=%d/%d\tprotected=%t\n",
+				share.Token, share.User, share.Path, share.Mode, expires,
+				share.Downloads, share.MaxDownloads, share.Password != "")
+		}
+	},
+}
+
+var shareDeleteCmd = &cobra.Command{
+	Use:   "delete [token]",
+	Short: "Deletes a share link",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		_, store := readShareStore()
+
+		if err := store.Delete(args[0], nil); err != nil {
+			fmt.Printf("An error occurred deleting the share link: %s\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Println("Deleted share link.")
+	},
+}
+
+func readShareStore() (*app.Config, *app.ShareStore) {
+	config := app.ParseConfig(shareConfigPath)
+	if config.Shares.File == "" {
+		fmt.Println("Share links are not enabled. Please configure shares.file.")
+		os.Exit(1)
+	}
+
+	return config, app.NewShareStore(config.Shares.File)
+}
+
+func init() {
+	shareCmd.PersistentFlags().StringVar(&shareConfigPath, "config", "", "Path to configuration file")
+
+	shareCreateCmd.Flags().StringVar(&shareUser, "user", "", "Owner of the shared file or directory")
+	shareCreateCmd.Flags().StringVar(&sharePath, "path", "/", "Path within the directory of the user")
+	shareCreateCmd.Flags().StringVar(&shareMode, "mode", app.ShareRead, "Mode of the share: read or upload")
+	shareCreateCmd.Flags().DurationVar(&shareExpires, "expires", 0, "Duration until the share link expires, e.g. 72h")
+	shareCreateCmd.Flags().IntVar(&shareDownloads, "downloads", 0, "Maximum number of downloads")
+	shareCreateCmd.Flags().BoolVar(&sharePassword, "password", false, "Protect the share link with a password")
+
+	shareCmd.AddCommand(shareCreateCmd, shareListCmd, shareDeleteCmd)
+	RootCmd.AddCommand(shareCmd)
+}
@@ -1,9 +1,11 @@
 module github.com/micromata/dave
 
-go 1.17
+go 1.22
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/fsnotify/fsnotify v1.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/magefile/mage v1.10.0
 	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.6.0
@@ -11,6 +13,7 @@ require (
 	github.com/spf13/viper v1.15.0
 	golang.org/x/crypto v0.14.0
 	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.13.0
 )
 
 require (
@@ -25,7 +28,6 @@ require (
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/subosito/gotenv v1.4.2 // indirect
-	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect